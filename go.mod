@@ -4,8 +4,12 @@ go 1.25
 
 require (
 	fyne.io/fyne/v2 v2.7.0
+	github.com/HugoSmits86/nativewebp v0.9.3
 	github.com/schollz/peerdiscovery v1.7.6
 	golang.design/x/clipboard v0.7.1
+	golang.org/x/image v0.28.0
+	golang.org/x/net v0.44.0
+	golang.org/x/sys v0.36.0
 )
 
 require (
@@ -37,10 +41,7 @@ require (
 	github.com/stretchr/testify v1.11.1 // indirect
 	github.com/yuin/goldmark v1.7.8 // indirect
 	golang.org/x/exp/shiny v0.0.0-20250606033433-dcc06ee1d476 // indirect
-	golang.org/x/image v0.28.0 // indirect
 	golang.org/x/mobile v0.0.0-20250606033058-a2a15c67f36f // indirect
-	golang.org/x/net v0.44.0 // indirect
-	golang.org/x/sys v0.36.0 // indirect
 	golang.org/x/text v0.29.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
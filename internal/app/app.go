@@ -1,11 +1,15 @@
 package app
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,6 +21,7 @@ import (
 	"fyne.io/fyne/v2/widget"
 
 	"github.com/Krasnovvvvv/share-my-clipboard/internal/clipboard"
+	"github.com/Krasnovvvvv/share-my-clipboard/internal/config"
 	"github.com/Krasnovvvvv/share-my-clipboard/internal/ipc"
 	"github.com/Krasnovvvvv/share-my-clipboard/internal/network"
 	"github.com/Krasnovvvvv/share-my-clipboard/internal/ui"
@@ -30,10 +35,24 @@ type FileTransferState struct {
 	Checksum    string
 	FromIP      string
 	Chunks      map[int][]byte
+	BatchID     string
+	BatchTotal  int
 	mu          sync.RWMutex
 }
 
-func Run() {
+// autoConnectRetry is how long to wait before asking a group member again
+const autoConnectRetry = time.Minute
+
+// previewLength is how much of a large received text the notification shows
+const previewLength = 80
+
+// fileBatch collects the files of one batch until all of them arrived
+type fileBatch struct {
+	paths    []string
+	finished int
+}
+
+func Run(cfg *config.Config, listen network.ListenConfig) {
 	a := app.NewWithID("share-my-clipboard")
 	a.Settings().SetTheme(theme.DarkTheme())
 	w := a.NewWindow("Share My Clipboard")
@@ -43,20 +62,182 @@ func Run() {
 	page := 0
 	const pageSize = 3
 
-	ds := &network.DeviceStore{}
-
 	hostName, err := os.Hostname()
 	if err != nil {
 		hostName = "Unknown"
 	}
 
-	connMgr := network.NewConnectionManager(hostName)
+	ds := &network.DeviceStore{}
+	if ds.Backends, err = network.NewDiscoverers(cfg.Discovery, listen.Interfaces); err != nil {
+		fmt.Printf("Warning: %v, using all discovery backends\n", err)
+		if ds.Backends, err = network.NewDiscoverers(nil, listen.Interfaces); err != nil {
+			ds.Backends = []network.Discoverer{}
+		}
+	}
+	staticPeers := network.NewStaticDiscoverer(cfg.StaticPeers)
+	ds.Backends = append(ds.Backends, staticPeers)
+
+	connMgr := network.NewConnectionManager(hostName, listen)
+	connMgr.SetLimits(network.Limits{
+		MaxSendSize:    cfg.MaxSendSize,
+		MaxReceiveSize: cfg.MaxReceiveSize,
+	})
+	connMgr.SetRelayHops(cfg.RelayHops)
+	connMgr.SetGroups(cfg.Groups, cfg.GroupSecrets)
+	if deviceID, err := config.DeviceID(); err != nil {
+		fmt.Printf("Warning: Failed to store device ID: %v\n", err)
+	} else {
+		connMgr.SetDeviceID(deviceID)
+	}
+	if key, err := config.DeviceKey(); err != nil {
+		fmt.Printf("Warning: Failed to store device key: %v\n", err)
+	} else {
+		connMgr.SetDeviceKey(key.Public().(ed25519.PublicKey))
+	}
+
+	// Items for trusted devices that are offline wait in a queue on disk
+	var queue *network.OutboundQueue
+	var queueBtn *widget.Button
+	if cfg.OfflineQueue.Enabled {
+		queue, err = network.NewOutboundQueue(filepath.Join(config.Dir(), "queue"), network.QueueLimits{
+			MaxItems: cfg.OfflineQueue.MaxItems,
+			MaxBytes: cfg.OfflineQueue.MaxBytes,
+			TTL:      time.Duration(cfg.OfflineQueue.ExpiryMinutes) * time.Minute,
+		})
+		if err != nil {
+			fmt.Printf("Warning: Failed to open offline queue: %v\n", err)
+			queue = nil
+		} else {
+			queue.OnChange = func() {
+				count := len(queue.Items())
+				fyne.Do(func() {
+					if queueBtn != nil {
+						queueBtn.SetText(fmt.Sprintf("Queue (%d)", count))
+					}
+				})
+			}
+			connMgr.SetQueue(queue)
+		}
+	}
+
+	// notifyTooLarge tells the user an item was not sent because of the limit
+	notifyTooLarge := func(err error) {
+		if errors.Is(err, network.ErrTooLarge) {
+			fyne.Do(func() {
+				ui.NotifyError(fmt.Sprintf("Not sent, larger than %s: %v",
+					formatSize(cfg.MaxSendSize), err))
+			})
+		}
+	}
 
 	// Create downloads directory and clipboard manager
 	homeDir, _ := os.UserHomeDir()
 	downloadDir := filepath.Join(homeDir, "Downloads", "ShareMyClipboard")
 	os.MkdirAll(downloadDir, 0755)
 	clipboardMgr := clipboard.NewManager(downloadDir)
+	if clipboardMgr != nil {
+		imageFormat, err := clipboard.ParseImageFormat(cfg.Images.Format)
+		if err != nil {
+			fmt.Printf("Warning: %v, sending images as PNG\n", err)
+			imageFormat = clipboard.ImageFormatPNG
+		}
+		clipboardMgr.SetImageOptions(clipboard.ImageOptions{
+			Format:        imageFormat,
+			Quality:       cfg.Images.Quality,
+			MaxDimension:  cfg.Images.MaxDimension,
+			StripMetadata: cfg.Images.StripMetadata,
+			SaveCopies:    cfg.Images.SaveCopies,
+		})
+	}
+	if clipboardMgr != nil && cfg.SyncPrimary {
+		if err := clipboardMgr.EnablePrimary(); err != nil {
+			fmt.Printf("Warning: Failed to enable PRIMARY selection sync: %v\n", err)
+		}
+	}
+
+	// announcePrimary advertises PRIMARY support while we sync it
+	announcePrimary := func() {
+		if clipboardMgr != nil && clipboardMgr.PrimaryEnabled() {
+			connMgr.SetCapabilities(network.CapPrimary)
+		} else {
+			connMgr.SetCapabilities()
+		}
+	}
+	announcePrimary()
+
+	// sendFiles reads the given files and broadcasts them to all connected devices
+	sendFiles := func(filePaths []string) error {
+		offlinePeers := 0
+		if queue != nil {
+			offlinePeers = len(queue.Trusted())
+		}
+		if len(connMgr.GetConnectedIPs()) == 0 && offlinePeers == 0 {
+			fyne.Do(func() {
+				ui.NotifyError("There are no connected devices to send the file!")
+			})
+			return errors.New("no connected devices")
+		}
+
+		// Process each file
+		for _, filePath := range filePaths {
+			// Read file
+			fileData, err := os.ReadFile(filePath)
+			if err != nil {
+				fmt.Printf("[IPC] Failed to read %s: %v\n", filePath, err)
+				continue
+			}
+
+			// Calculate checksum
+			checksum := clipboard.ComputeFileChecksum(fileData)
+			fileName := filepath.Base(filePath)
+
+			// Broadcast to all connected devices
+			if err := connMgr.BroadcastFileClipboard(fileName, fileData, checksum); err != nil {
+				notifyTooLarge(err)
+				continue
+			}
+
+			fmt.Printf("[IPC] Sent %s (%d bytes) to connected devices\n",
+				fileName, len(fileData))
+
+			// Show notification
+			fyne.Do(func() {
+				ui.NotifyInfo(fmt.Sprintf("Sending %s to connected devices...", fileName))
+			})
+		}
+
+		return nil
+	}
+
+	// addStaticPeer saves an address that discovery can't find; it is
+	// probed on every scan from now on
+	addStaticPeer := func(addr string) error {
+		return cfg.Update(func(c *config.Config) {
+			if !slices.Contains(c.StaticPeers, addr) {
+				c.StaticPeers = append(c.StaticPeers, addr)
+			}
+			staticPeers.SetPeers(c.StaticPeers)
+		})
+	}
+
+	// connectAddress asks the device at a raw "host[:port]" address to connect
+	connectAddress := func(addr string) error {
+		ip, port, err := network.ResolvePeer(addr)
+		if err != nil {
+			return err
+		}
+		if ds.FindName(ip) == "" {
+			if err := addStaticPeer(addr); err != nil {
+				fmt.Printf("[APP] Failed to save %s: %v\n", addr, err)
+			}
+		}
+		connMgr.SetPeerPort(ip, port)
+		return connMgr.SendRequest(network.ConnectionRequest{
+			FromName: hostName,
+			FromIP:   connMgr.LocalIP,
+			ToIP:     ip,
+		})
+	}
 
 	// Start IPC server for context menu integration
 	ipcServer, err := ipc.NewIPCServer()
@@ -69,42 +250,65 @@ func Run() {
 			if err := json.Unmarshal(data, &req); err != nil {
 				return fmt.Errorf("failed to unmarshal request: %w", err)
 			}
+			fmt.Printf("[IPC] Received request to send %d file(s)\n", len(req.FilePaths))
+			return sendFiles(req.FilePaths)
+		})
 
-			if len(connMgr.GetConnectedIPs()) == 0 {
-				fyne.Do(func() {
-					ui.NotifyError("There are no connected devices to send the file!")
-				})
-				return errors.New("no connected devices")
+		// A second launch hands its arguments over and asks us to show the window
+		ipcServer.RegisterHandler("activate", func(data []byte) error {
+			var req ipc.ActivateRequest
+			if err := json.Unmarshal(data, &req); err != nil {
+				return fmt.Errorf("failed to unmarshal request: %w", err)
 			}
+			fyne.Do(func() {
+				w.Show()
+				w.RequestFocus()
+			})
 
-			fmt.Printf("[IPC] Received request to send %d file(s)\n", len(req.FilePaths))
-
-			// Process each file
-			for _, filePath := range req.FilePaths {
-				// Read file
-				fileData, err := os.ReadFile(filePath)
-				if err != nil {
-					fmt.Printf("[IPC] Failed to read %s: %v\n", filePath, err)
-					continue
+			filePaths := make([]string, 0, len(req.Args))
+			for _, arg := range req.Args {
+				if !filepath.IsAbs(arg) {
+					arg = filepath.Join(req.WorkDir, arg)
 				}
+				if stat, err := os.Stat(arg); err == nil && !stat.IsDir() {
+					filePaths = append(filePaths, arg)
+				}
+			}
+			if len(filePaths) == 0 {
+				return nil
+			}
+			fmt.Printf("[IPC] Second launch forwarded %d file(s)\n", len(filePaths))
+			return sendFiles(filePaths)
+		})
 
-				// Calculate checksum
-				checksum := clipboard.ComputeFileChecksum(fileData)
-				fileName := filepath.Base(filePath)
-
-				// Broadcast to all connected devices
-				connMgr.BroadcastFileClipboard(fileName, fileData, checksum)
+		// Offline queue inspection for the command line
+		ipcServer.RegisterQuery("queue_list", func(data []byte) (interface{}, error) {
+			if queue == nil {
+				return nil, errors.New("offline queue is disabled")
+			}
+			return queue.Items(), nil
+		})
+		ipcServer.RegisterHandler("queue_cancel", func(data []byte) error {
+			var req ipc.QueueCancelRequest
+			if err := json.Unmarshal(data, &req); err != nil {
+				return fmt.Errorf("failed to unmarshal request: %w", err)
+			}
+			if queue == nil {
+				return errors.New("offline queue is disabled")
+			}
+			return queue.Cancel(req.ID)
+		})
 
-				fmt.Printf("[IPC] Sent %s (%d bytes) to connected devices\n",
-					fileName, len(fileData))
+		ipcServer.RegisterQuery("stats", func(data []byte) (interface{}, error) {
+			return connMgr.Stats(), nil
+		})
 
-				// Show notification
-				fyne.Do(func() {
-					ui.NotifyInfo(fmt.Sprintf("Sending %s to connected devices...", fileName))
-				})
+		ipcServer.RegisterHandler("connect", func(data []byte) error {
+			var req ipc.ConnectRequest
+			if err := json.Unmarshal(data, &req); err != nil {
+				return fmt.Errorf("failed to unmarshal request: %w", err)
 			}
-
-			return nil
+			return connectAddress(req.Address)
 		})
 	}
 
@@ -126,17 +330,50 @@ func Run() {
 		cardsBox.Objects = nil
 
 		for _, d := range devs {
-			isConn := connMgr.IsConnected(d.IP)
+			// A device with several addresses may be connected on any
+			ip := d.IP
+			connIP := connMgr.ConnectedAddress(d)
+			isConn := connIP != ""
+			if isConn {
+				ip = connIP
+			}
 			devCopy := d
 
+			// Dropped links show how they are doing until they're back
+			status, stats := "", ""
+			if isConn {
+				if s, ok := connMgr.ConnectionStats(d.Key()); ok {
+					stats = formatStats(s)
+				}
+			} else if state, ok := connMgr.Link(d.Key()); ok && state != network.LinkConnected {
+				status = state.String()
+			}
+
+			// Devices announce tags; only our own groups have names we
+			// know
+			groups := connMgr.GroupNames(d.Groups)
+			if isConn {
+				groups = connMgr.PeerGroups(d.Key())
+			}
+
 			card := container.NewCenter(ui.MakeDeviceCard(
-				d.Name, d.IP, isConn,
+				ui.DeviceCard{
+					Name:        d.Name,
+					IP:          ip,
+					Groups:      groups,
+					Details:     d.Summary(),
+					Fingerprint: d.Fingerprint,
+					Status:      status,
+					Stats:       stats,
+				},
+				isConn,
 				func(ip string) {
 					req := network.ConnectionRequest{
 						FromName: hostName,
 						FromIP:   connMgr.LocalIP,
 						FromMAC:  "",
 						ToIP:     ip,
+						ToID:     devCopy.ID,
 					}
 					if err := connMgr.SendRequest(req); err != nil {
 						fyne.Do(func() {
@@ -149,18 +386,14 @@ func Run() {
 					})
 				},
 				func(ip string) {
-					deviceName := ds.FindNameByIP(ip)
-					if deviceName == "" {
-						deviceName = ip
-					}
-					if err := connMgr.Disconnect(ip); err != nil {
+					if err := connMgr.Disconnect(devCopy.Key()); err != nil {
 						fyne.Do(func() {
 							ui.NotifyError(fmt.Sprintf("Failed to disconnect: %v", err))
 						})
 						return
 					}
 					fyne.Do(func() {
-						ui.NotifyInfo(fmt.Sprintf("Disconnected from %s", deviceName))
+						ui.NotifyInfo(fmt.Sprintf("Disconnected from %s", devCopy.Name))
 					})
 					triggerUpdate()
 				},
@@ -168,7 +401,9 @@ func Run() {
 			cardsBox.Add(card)
 		}
 
+		ds.DevicesMu.RLock()
 		total := len(ds.Devices)
+		ds.DevicesMu.RUnlock()
 		totalPages := (total + pageSize - 1) / pageSize
 		if totalPages == 0 {
 			totalPages = 1
@@ -177,10 +412,28 @@ func Run() {
 		cardsBox.Refresh()
 	}
 
-	// Connection request handler
+	// Connection request handler. Devices that prove they know the
+	// secret of one of our groups are let in without asking.
 	connMgr.OnRequest = func(req network.ConnectionRequest) {
+		if connMgr.ProvesGroup(req) {
+			resp := network.ConnectionResponse{
+				FromIP: connMgr.LocalIP,
+				ToIP:   req.FromIP,
+				Accept: true,
+			}
+			if err := connMgr.SendResponse(resp); err != nil {
+				fmt.Printf("[APP] Failed to accept group member %s: %v\n", req.FromName, err)
+				return
+			}
+			fmt.Printf("[APP] Accepted group member %s\n", req.FromName)
+			return
+		}
+
 		fyne.Do(func() {
 			ui.ConfirmConnection(w, req.FromName, func(approved bool) {
+				if approved {
+					connMgr.Approve(req.FromID)
+				}
 				resp := network.ConnectionResponse{
 					FromIP: connMgr.LocalIP,
 					ToIP:   req.FromIP,
@@ -200,38 +453,111 @@ func Run() {
 		})
 	}
 
+	// Peers announce their groups after connecting and when they change
+	connMgr.OnPeerGroups = func(peer string, groups []string) {
+		triggerUpdate()
+	}
+
+	// Group members discovered on the network are connected automatically.
+	// Only the device with the lower ID asks, matching which connection
+	// wins when both dial at once. Only groups with a secret count, as
+	// the request has to prove membership.
+	autoConnectAttempts := make(map[string]time.Time)
+	autoConnect := func() {
+		selfID := connMgr.DeviceInfo().ID
+
+		ds.DevicesMu.RLock()
+		devices := append([]network.Device(nil), ds.Devices...)
+		ds.DevicesMu.RUnlock()
+
+		for _, d := range devices {
+			if d.ID == "" || !connMgr.SharesSecretGroup(d.Groups) || connMgr.ConnectedAddress(d) != "" {
+				continue
+			}
+			if selfID > d.ID || time.Since(autoConnectAttempts[d.Key()]) < autoConnectRetry {
+				continue
+			}
+			autoConnectAttempts[d.Key()] = time.Now()
+
+			req := network.ConnectionRequest{
+				FromName: hostName,
+				FromIP:   connMgr.LocalIP,
+				ToIP:     d.IP,
+				ToID:     d.ID,
+			}
+			if err := connMgr.SendRequest(req); err != nil {
+				fmt.Printf("[APP] Failed to reach group member %s: %v\n", d.Name, err)
+				continue
+			}
+			fmt.Printf("[APP] Asked group member %s to connect\n", d.Name)
+		}
+	}
+
 	// Connection response handler
 	connMgr.OnResult = func(resp network.ConnectionResponse) {
-		deviceName := ds.FindNameByIP(resp.FromIP)
+		deviceName := ds.FindName(resp.FromIP)
 		if deviceName == "" {
 			deviceName = resp.FromIP
 		}
+		if !resp.Accept {
+			fyne.Do(func() {
+				ui.NotifyInfo(fmt.Sprintf("%s declined connection", deviceName))
+				triggerUpdate()
+			})
+			return
+		}
+
+		// Dialing and the handshake take a while, keep them off the UI
+		// thread
+		err := connMgr.Connect(resp.FromID, resp.FromIP)
 		fyne.Do(func() {
-			if resp.Accept {
-				if err := connMgr.Connect(resp.FromIP, ""); err != nil {
-					ui.NotifyError(fmt.Sprintf("Failed to connect: %v", err))
-					triggerUpdate()
-					return
-				}
-				ui.NotifySuccess("Connected", fmt.Sprintf("Connected with %s", deviceName))
+			if err != nil {
+				ui.NotifyError(fmt.Sprintf("Failed to connect: %v", err))
 			} else {
-				ui.NotifyInfo(fmt.Sprintf("%s declined connection", deviceName))
+				ui.NotifySuccess("Connected", fmt.Sprintf("Connected with %s", deviceName))
 			}
 			triggerUpdate()
 		})
 	}
 
-	connMgr.SetOnConnEstablished(func(ip string) {
+	connMgr.SetOnConnEstablished(func(peer string) {
 		fyne.Do(func() {
-			fmt.Printf("[APP] Connection established with %s\n", ip)
+			fmt.Printf("[APP] Connection established with %s\n", peer)
 			triggerUpdate()
 		})
 	})
 
-	connMgr.OnDisconnect = func(ip string, reason string) {
-		deviceName := ds.FindNameByIP(ip)
+	// Dropped links are retried in the background; tell the user how it
+	// goes
+	linkStates := make(map[string]network.LinkState)
+	var linkStatesMu sync.Mutex
+	connMgr.OnLinkState = func(peer string, state network.LinkState) {
+		linkStatesMu.Lock()
+		previous, known := linkStates[peer]
+		linkStates[peer] = state
+		linkStatesMu.Unlock()
+
+		deviceName := ds.FindName(peer)
 		if deviceName == "" {
-			deviceName = ip
+			deviceName = peer
+		}
+		fyne.Do(func() {
+			switch {
+			case state == network.LinkReconnecting && (!known || previous != network.LinkReconnecting):
+				ui.NotifyInfo(fmt.Sprintf("Lost connection to %s, reconnecting...", deviceName))
+			case state == network.LinkConnected && previous == network.LinkReconnecting:
+				ui.NotifySuccess("Reconnected", fmt.Sprintf("Reconnected with %s", deviceName))
+			case state == network.LinkOffline && previous == network.LinkReconnecting:
+				ui.NotifyInfo(fmt.Sprintf("%s is offline", deviceName))
+			}
+			triggerUpdate()
+		})
+	}
+
+	connMgr.OnDisconnect = func(peer string, reason string) {
+		deviceName := ds.FindName(peer)
+		if deviceName == "" {
+			deviceName = peer
 		}
 		fyne.Do(func() {
 			if reason == "Hub shutdown" {
@@ -248,7 +574,7 @@ func Run() {
 		if clipboardMgr == nil {
 			return
 		}
-		deviceName := ds.FindNameByIP(data.FromIP)
+		deviceName := ds.FindName(data.FromIP)
 		if deviceName == "" {
 			deviceName = data.FromIP
 		}
@@ -256,8 +582,20 @@ func Run() {
 			Type: clipboard.ContentTypeText,
 			Text: data.Content,
 		}
+		for _, rep := range data.Representations {
+			if clipContent.Representations == nil {
+				clipContent.Representations = make(map[clipboard.Format][]byte)
+			}
+			clipContent.Representations[clipboard.Format(rep.MimeType)] = rep.Data
+		}
 		if err := clipboardMgr.SetClipboard(clipContent); err != nil {
 			fmt.Printf("Failed to set clipboard: %v\n", err)
+		} else if len(data.Content) > network.TextChunkThreshold {
+			// Huge text is easy to paste by accident, so show what it is
+			fyne.Do(func() {
+				ui.NotifySuccess(fmt.Sprintf("Large text from %s (%s)", deviceName, formatSize(int64(len(data.Content)))),
+					textPreview(data.Content, previewLength))
+			})
 		} else {
 			fyne.Do(func() {
 				ui.NotifyInfo(fmt.Sprintf("Clipboard updated from %s", deviceName))
@@ -265,13 +603,47 @@ func Run() {
 		}
 	}
 
+	// Items refused because of the receive limit
+	connMgr.OnTooLarge = func(fromIP, name string, size int64) {
+		deviceName := ds.FindName(fromIP)
+		if deviceName == "" {
+			deviceName = fromIP
+		}
+		fyne.Do(func() {
+			ui.NotifyError(fmt.Sprintf("Refused %s from %s: %s is over the %s limit",
+				name, deviceName, formatSize(size), formatSize(cfg.MaxReceiveSize)))
+		})
+	}
+
+	// PRIMARY selection handler: set our PRIMARY if we sync it, otherwise
+	// only take it into the clipboard when the user asked for that
+	connMgr.OnPrimary = func(data network.ClipboardData) {
+		if clipboardMgr == nil {
+			return
+		}
+		clipContent := clipboard.ClipboardContent{
+			Type:      clipboard.ContentTypeText,
+			Selection: clipboard.SelectionPrimary,
+			Text:      data.Content,
+		}
+		if !clipboardMgr.PrimaryEnabled() {
+			if !cfg.MapPrimaryToClipboard {
+				return
+			}
+			clipContent.Selection = clipboard.SelectionClipboard
+		}
+		if err := clipboardMgr.SetClipboard(clipContent); err != nil {
+			fmt.Printf("Failed to set PRIMARY selection: %v\n", err)
+		}
+	}
+
 	// Chunked file transfer state for receiver
 	activeTransfers := make(map[string]*FileTransferState)
 	var transfersMu sync.RWMutex
 
 	// File chunk start handler
 	connMgr.OnFileChunkStart = func(start network.FileChunkStart) {
-		deviceName := ds.FindNameByIP(start.FromIP)
+		deviceName := ds.FindName(start.FromIP)
 		if deviceName == "" {
 			deviceName = start.FromIP
 		}
@@ -285,6 +657,8 @@ func Run() {
 			Checksum:    start.Checksum,
 			FromIP:      start.FromIP,
 			Chunks:      make(map[int][]byte),
+			BatchID:     start.BatchID,
+			BatchTotal:  start.BatchTotal,
 		}
 		transfersMu.Unlock()
 		fyne.Do(func() {
@@ -311,6 +685,42 @@ func Run() {
 		}
 	}
 
+	// Files of one batch go onto the clipboard together as a file list
+	batches := make(map[string]*fileBatch)
+	var batchesMu sync.Mutex
+
+	// finishBatchFile records a finished batch member; savedPath is empty
+	// if it failed. Once all members are in, the saved files are set.
+	finishBatchFile := func(transfer *FileTransferState, savedPath string) {
+		batchesMu.Lock()
+		batch, exists := batches[transfer.BatchID]
+		if !exists {
+			batch = &fileBatch{}
+			batches[transfer.BatchID] = batch
+		}
+		batch.finished++
+		if savedPath != "" {
+			batch.paths = append(batch.paths, savedPath)
+		}
+		done := batch.finished >= transfer.BatchTotal
+		if done {
+			delete(batches, transfer.BatchID)
+		}
+		batchesMu.Unlock()
+
+		if !done || len(batch.paths) == 0 {
+			return
+		}
+		if err := clipboardMgr.SetFileList(batch.paths); err != nil {
+			fmt.Printf("Failed to set clipboard: %v\n", err)
+			return
+		}
+		fyne.Do(func() {
+			ui.NotifySuccess("Files Received",
+				fmt.Sprintf("%d files from %s", len(batch.paths), transfer.FromIP))
+		})
+	}
+
 	// File chunk complete handler
 	connMgr.OnFileChunkComplete = func(complete network.FileChunkComplete) {
 		transfersMu.Lock()
@@ -327,6 +737,9 @@ func Run() {
 			transfer.mu.RUnlock()
 			fmt.Printf("[APP] Missing chunks: got %d, expected %d\n",
 				len(transfer.Chunks), transfer.TotalChunks)
+			if transfer.BatchTotal > 1 && clipboardMgr != nil {
+				finishBatchFile(transfer, "")
+			}
 			fyne.Do(func() {
 				ui.NotifyError(fmt.Sprintf("File transfer incomplete: %s", transfer.FileName))
 			})
@@ -340,6 +753,9 @@ func Run() {
 			if !ok {
 				transfer.mu.RUnlock()
 				fmt.Printf("[APP] Missing chunk %d\n", i)
+				if transfer.BatchTotal > 1 && clipboardMgr != nil {
+					finishBatchFile(transfer, "")
+				}
 				fyne.Do(func() {
 					ui.NotifyError(fmt.Sprintf("File transfer incomplete: %s", transfer.FileName))
 				})
@@ -348,9 +764,11 @@ func Run() {
 			fileData = append(fileData, chunkData...)
 		}
 		transfer.mu.RUnlock()
-		actualChecksum := clipboard.ComputeFileChecksum(fileData)
-		if actualChecksum != transfer.Checksum {
+		if !network.VerifyChecksum(fileData, transfer.Checksum) {
 			fmt.Printf("[APP] Checksum mismatch for %s\n", transfer.FileName)
+			if transfer.BatchTotal > 1 && clipboardMgr != nil {
+				finishBatchFile(transfer, "")
+			}
 			fyne.Do(func() {
 				ui.NotifyError(fmt.Sprintf("File corrupted: %s", transfer.FileName))
 			})
@@ -365,6 +783,14 @@ func Run() {
 			FileName: transfer.FileName,
 			FileData: fileData,
 		}
+		if transfer.BatchTotal > 1 && clipboardMgr != nil {
+			savedPath, err := clipboardMgr.SaveFile(clipContent)
+			if err != nil {
+				fmt.Printf("Failed to save file: %v\n", err)
+			}
+			finishBatchFile(transfer, savedPath)
+			return
+		}
 		if clipboardMgr != nil {
 			err := clipboardMgr.SetClipboard(clipContent)
 			if err != nil {
@@ -387,15 +813,43 @@ func Run() {
 			for clipContent := range clipboardMgr.Watch() {
 				switch clipContent.Type {
 				case clipboard.ContentTypeText:
-					connMgr.BroadcastClipboard(clipContent.Text)
+					if clipContent.Selection == clipboard.SelectionPrimary {
+						// Selections change constantly; skip oversized ones silently
+						connMgr.BroadcastPrimary(clipContent.Text)
+						continue
+					}
+					reps := make([]network.Representation, 0, len(clipContent.Representations))
+					for format, data := range clipContent.Representations {
+						reps = append(reps, network.Representation{MimeType: string(format), Data: data})
+					}
+					if err := connMgr.BroadcastClipboard(clipContent.Text, reps...); err != nil {
+						notifyTooLarge(err)
+					}
+				case clipboard.ContentTypeFileList:
+					files := make([]network.OutgoingFile, 0, len(clipContent.Files))
+					for _, f := range clipContent.Files {
+						files = append(files, network.OutgoingFile{
+							Name:     f.FileName,
+							Data:     f.FileData,
+							Checksum: clipboard.ComputeFileChecksum(f.FileData),
+						})
+					}
+					if err := connMgr.BroadcastFiles(files); err != nil {
+						notifyTooLarge(err)
+						continue
+					}
+					fmt.Printf("[APP] Broadcasting %d files\n", len(files))
 				case clipboard.ContentTypeImage, clipboard.ContentTypeFile:
 					if len(clipContent.FileData) > 0 {
 						checksum := clipboard.ComputeFileChecksum(clipContent.FileData)
-						connMgr.BroadcastFileClipboard(
+						if err := connMgr.BroadcastFileClipboard(
 							clipContent.FileName,
 							clipContent.FileData,
 							checksum,
-						)
+						); err != nil {
+							notifyTooLarge(err)
+							continue
+						}
 						fmt.Printf("[APP] Broadcasting file: %s (%d bytes)\n",
 							clipContent.FileName, len(clipContent.FileData))
 					}
@@ -428,6 +882,54 @@ func Run() {
 	})
 	updateBtn.Importance = widget.HighImportance
 
+	addBtn := widget.NewButtonWithIcon("Add", theme.ContentAddIcon(), func() {
+		ui.AddDevice(w, func(addr string) error {
+			_, _, err := network.ParsePeerAddress(addr)
+			return err
+		}, func(addr string) {
+			if err := addStaticPeer(addr); err != nil {
+				ui.NotifyError(fmt.Sprintf("Failed to save device: %v", err))
+				return
+			}
+			select {
+			case scanTrigger <- struct{}{}:
+			default:
+			}
+		})
+	})
+
+	buttons := container.NewHBox(updateBtn, addBtn)
+	if queue != nil {
+		queueBtn = widget.NewButtonWithIcon(fmt.Sprintf("Queue (%d)", len(queue.Items())), theme.UploadIcon(), func() {
+			items := queue.Items()
+			rows := make([]ui.QueueRow, 0, len(items))
+			for _, item := range items {
+				peers := make([]string, 0, len(item.Peers))
+				for _, peer := range item.Peers {
+					if name := ds.FindName(peer); name != "" {
+						peer = name
+					}
+					peers = append(peers, peer)
+				}
+				detail := "for " + strings.Join(peers, ", ")
+				if !item.Expires.IsZero() {
+					detail += fmt.Sprintf(", expires in %s", time.Until(item.Expires).Round(time.Minute))
+				}
+				rows = append(rows, ui.QueueRow{
+					ID:     item.ID,
+					Title:  fmt.Sprintf("%s (%s)", item.Name, formatSize(item.Size)),
+					Detail: detail,
+				})
+			}
+			ui.ShowQueue(w, rows, func(id string) {
+				if err := queue.Cancel(id); err != nil {
+					fmt.Printf("[APP] Failed to cancel queued item: %v\n", err)
+				}
+			})
+		})
+		buttons.Add(queueBtn)
+	}
+
 	title := widget.NewLabelWithStyle("Devices on the Network", fyne.TextAlignCenter, fyne.TextStyle{Bold: true})
 	pagination := container.NewHBox(prevBtn, layout.NewSpacer(), pageLabel, layout.NewSpacer(), nextBtn)
 	paginationCentered := container.NewCenter(pagination)
@@ -436,39 +938,98 @@ func Run() {
 		container.NewCenter(title),
 		container.NewCenter(cardsBox),
 		ui.NewMargin(5),
-		container.NewCenter(updateBtn),
+		container.NewCenter(buttons),
 		ui.NewMargin(5),
 		paginationCentered,
 	)
 	deviceListContainer.Resize(fyne.NewSize(300, 450))
 
+	groupsLabel := widget.NewLabel("")
+	showGroups := func() {
+		groupsLabel.SetText("Groups: " + strings.Join(connMgr.Groups(), ", "))
+	}
+	showGroups()
+	groupsBtn := widget.NewButtonWithIcon("", theme.DocumentCreateIcon(), func() {
+		ui.EditGroups(w, cfg.Groups, cfg.GroupSecrets, func(groups []string, secrets map[string]string) {
+			connMgr.SetGroups(groups, secrets)
+			if err := cfg.Update(func(c *config.Config) {
+				c.Groups = connMgr.Groups()
+				c.GroupSecrets = secrets
+			}); err != nil {
+				fmt.Printf("Failed to save config: %v\n", err)
+			}
+			showGroups()
+			triggerUpdate()
+		})
+	})
+
 	content := container.NewVBox(
 		container.NewCenter(widget.NewLabelWithStyle("Share My Clipboard", fyne.TextAlignCenter, fyne.TextStyle{Bold: true})),
+		container.NewCenter(container.NewHBox(groupsLabel, groupsBtn)),
 		widget.NewSeparator(),
 		container.NewCenter(deviceListContainer),
 	)
+
+	// PRIMARY selection only exists on X11 and Wayland
+	if runtime.GOOS == "linux" && clipboardMgr != nil {
+		primaryCheck := widget.NewCheck("Sync middle-click selection", nil)
+		primaryCheck.Checked = clipboardMgr.PrimaryEnabled()
+		primaryCheck.OnChanged = func(enabled bool) {
+			if enabled {
+				if err := clipboardMgr.EnablePrimary(); err != nil {
+					ui.NotifyError(fmt.Sprintf("Failed to sync selection: %v", err))
+					primaryCheck.SetChecked(false)
+					return
+				}
+			} else {
+				clipboardMgr.DisablePrimary()
+			}
+			announcePrimary()
+			if err := cfg.Update(func(c *config.Config) { c.SyncPrimary = enabled }); err != nil {
+				fmt.Printf("Failed to save config: %v\n", err)
+			}
+		}
+		content.Add(container.NewCenter(primaryCheck))
+	}
 	w.SetContent(content)
 
+	discoveryEvents := ds.Start(connMgr.DeviceInfo)
+
 	go func() {
 		ticker := time.NewTicker(4 * time.Second)
 		defer ticker.Stop()
+		var manualScan time.Time
 		for {
 			select {
 			case <-scanTrigger:
-				if ds.Scan(hostName) {
+				ds.Refresh()
+				manualScan = time.Now()
+			case event := <-discoveryEvents:
+				fmt.Printf("[APP] Device %s: %s (%s)\n", event.Type, event.Device.Name, event.Device.IP)
+				if event.Type != network.DeviceLost {
+					// Peers that went offline are redialed once they're
+					// back, wherever they turn up
+					connMgr.UpdatePeer(event.Device)
+					connMgr.Reconnect(event.Device.Key())
+				}
+				// Devices found right after pressing Update are announced
+				if event.Type == network.DeviceAdded && time.Since(manualScan) < 5*time.Second {
+					manualScan = time.Time{}
 					fyne.Do(func() {
 						a.SendNotification(&fyne.Notification{
 							Title:   "Network Scan",
 							Content: "Device list updated!",
 						})
 					})
-					triggerUpdate()
 				}
+				triggerUpdate()
 			case <-ticker.C:
-				if ds.Scan(hostName) {
+				autoConnect()
+				connMgr.CheckDisconnects(ds, triggerUpdate)
+				// Keeps the connection stats on the cards current
+				if len(connMgr.GetConnectedIPs()) > 0 {
 					triggerUpdate()
 				}
-				connMgr.CheckDisconnects(ds, triggerUpdate)
 			case <-updateTrigger:
 				fyne.Do(updatePage)
 			}
@@ -485,8 +1046,46 @@ func Run() {
 		if ipcServer != nil {
 			ipcServer.Stop()
 		}
+		ds.Close()
 	})
 
 	updatePage()
 	w.ShowAndRun()
 }
+
+// formatSize renders a byte count for notifications
+func formatSize(size int64) string {
+	switch {
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+	case size >= 1024:
+		return fmt.Sprintf("%d KB", size/1024)
+	default:
+		return fmt.Sprintf("%d bytes", size)
+	}
+}
+
+// formatStats sums up a connection for its device card
+func formatStats(s network.ConnStats) string {
+	parts := []string{}
+	if s.RTT > 0 {
+		parts = append(parts, fmt.Sprintf("RTT %d ms", s.RTT.Milliseconds()))
+	}
+	parts = append(parts,
+		fmt.Sprintf("↓ %s/s", formatSize(int64(s.RateIn))),
+		fmt.Sprintf("↑ %s/s", formatSize(int64(s.RateOut))))
+	if s.Errors > 0 {
+		parts = append(parts, fmt.Sprintf("%d errors", s.Errors))
+	}
+	return strings.Join(parts, " · ")
+}
+
+// textPreview returns the first n characters of text on one line
+func textPreview(text string, n int) string {
+	text = strings.Join(strings.Fields(strings.ToValidUTF8(text[:min(len(text), n*4)], "")), " ")
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n]) + "…"
+}
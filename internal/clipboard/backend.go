@@ -0,0 +1,83 @@
+package clipboard
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// Format identifies a clipboard representation by its MIME type
+type Format string
+
+const (
+	FormatText Format = "text/plain"
+	FormatPNG  Format = "image/png"
+	FormatHTML Format = "text/html"
+	FormatRTF  Format = "text/rtf"
+
+	// FormatURIList is the freedesktop file list; on Windows it maps to CF_HDROP
+	FormatURIList Format = "text/uri-list"
+	// FormatGnomeFiles is the file list Nautilus reads on paste
+	FormatGnomeFiles Format = "x-special/gnome-copied-files"
+)
+
+// richFormats are read alongside plain text and sent as extra
+// representations of the same clipboard item
+var richFormats = []Format{FormatHTML, FormatRTF}
+
+// Backend is the system clipboard as seen by the Manager. Implementations
+// wrap a library, external tools or, for tests, plain memory.
+type Backend interface {
+	// Name identifies the backend in logs
+	Name() string
+
+	// Read returns the current clipboard contents in the given format
+	Read(format Format) ([]byte, error)
+
+	// Write replaces the clipboard contents with data in the given format
+	Write(format Format, data []byte) error
+
+	// Watch emits the clipboard contents every time they change in the
+	// given format. The channel is closed once ctx is cancelled.
+	Watch(ctx context.Context, format Format) <-chan []byte
+}
+
+// PrimaryProvider is implemented by backends that can also reach the
+// PRIMARY (middle-click) selection of X11 and Wayland
+type PrimaryProvider interface {
+	Primary() (Backend, error)
+}
+
+// MultiWriter is implemented by backends that can offer several
+// representations of one clipboard item at once. Backends without it get
+// only the plain text of a rich item.
+type MultiWriter interface {
+	WriteMulti(items map[Format][]byte) error
+}
+
+// DetectBackend returns the first backend that works in this session. In
+// a Wayland session wl-clipboard comes first, because the native library
+// only sees XWayland clients there; then the native library, then xclip.
+func DetectBackend() (Backend, error) {
+	if runtime.GOOS == "linux" && os.Getenv("WAYLAND_DISPLAY") != "" {
+		b, err := NewWlClipboardBackend()
+		if err == nil {
+			return b, nil
+		}
+		fmt.Printf("Wayland session detected but wl-clipboard is unavailable (%v), "+
+			"only XWayland applications will be synced\n", err)
+	}
+
+	native, err := NewNativeBackend()
+	if err == nil {
+		return native, nil
+	}
+	fmt.Printf("Native clipboard unavailable: %v\n", err)
+
+	if b, err := NewXclipBackend(); err == nil {
+		return b, nil
+	}
+
+	return nil, fmt.Errorf("no clipboard backend available: %w", err)
+}
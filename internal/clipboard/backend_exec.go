@@ -0,0 +1,126 @@
+package clipboard
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+const execPollInterval = 500 * time.Millisecond
+
+// execBackend drives command-line clipboard tools such as wl-clipboard
+// or xclip. Changes are detected by polling.
+type execBackend struct {
+	name     string
+	readCmd  func(format Format) []string
+	writeCmd func(format Format) []string
+	primary  func() Backend
+}
+
+// NewXclipBackend uses xclip on the X11 CLIPBOARD selection
+func NewXclipBackend() (Backend, error) {
+	if err := lookPaths("xclip"); err != nil {
+		return nil, err
+	}
+	b := newXclipBackend("clipboard")
+	b.primary = func() Backend { return newXclipBackend("primary") }
+	return b, nil
+}
+
+func newXclipBackend(selection string) *execBackend {
+	return &execBackend{
+		name: "xclip " + selection,
+		readCmd: func(format Format) []string {
+			return []string{"xclip", "-selection", selection, "-o", "-t", string(format)}
+		},
+		writeCmd: func(format Format) []string {
+			return []string{"xclip", "-selection", selection, "-i", "-t", string(format)}
+		},
+	}
+}
+
+func (b *execBackend) Name() string {
+	return b.name
+}
+
+func (b *execBackend) Primary() (Backend, error) {
+	if b.primary == nil {
+		return nil, errors.ErrUnsupported
+	}
+	return b.primary(), nil
+}
+
+func (b *execBackend) Read(format Format) ([]byte, error) {
+	args := b.readCmd(format)
+	out, err := exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", args[0], err)
+	}
+	return out, nil
+}
+
+// Write pipes data into the tool. wl-copy and xclip fork a child that keeps
+// serving the selection, so their output must not be captured: the child
+// would hold the pipe open and Write would never return.
+func (b *execBackend) Write(format Format, data []byte) error {
+	args := b.writeCmd(format)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", args[0], err)
+	}
+	return nil
+}
+
+func (b *execBackend) Watch(ctx context.Context, format Format) <-chan []byte {
+	return pollWatch(ctx, func() ([]byte, error) { return b.Read(format) })
+}
+
+// pollWatch reports changes by calling read every execPollInterval. Like
+// the native backend, it doesn't report what was there before it started.
+func pollWatch(ctx context.Context, read func() ([]byte, error)) <-chan []byte {
+	ch := make(chan []byte)
+
+	go func() {
+		defer close(ch)
+
+		ticker := time.NewTicker(execPollInterval)
+		defer ticker.Stop()
+
+		last, _ := read()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			data, err := read()
+			if err != nil || len(data) == 0 || bytes.Equal(data, last) {
+				continue
+			}
+			last = data
+
+			select {
+			case ch <- data:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+func lookPaths(names ...string) error {
+	for _, name := range names {
+		if _, err := exec.LookPath(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package clipboard
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// MemoryBackend is an in-process clipboard for tests and headless runs.
+// Every Write is delivered to the watchers of that format, just like a
+// real clipboard reports our own writes back to us.
+type MemoryBackend struct {
+	mu       sync.Mutex
+	data     map[Format][]byte
+	watchers map[Format][]chan []byte
+	primary  *MemoryBackend
+}
+
+// NewMemoryBackend creates an empty in-memory clipboard
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		data:     make(map[Format][]byte),
+		watchers: make(map[Format][]chan []byte),
+	}
+}
+
+func (b *MemoryBackend) Name() string {
+	return "memory"
+}
+
+// Primary returns a second, independent in-memory selection
+func (b *MemoryBackend) Primary() (Backend, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.primary == nil {
+		b.primary = NewMemoryBackend()
+	}
+	return b.primary, nil
+}
+
+func (b *MemoryBackend) Read(format Format) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	data, ok := b.data[format]
+	if !ok {
+		return nil, fmt.Errorf("clipboard has no %s data", format)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (b *MemoryBackend) Write(format Format, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.data[format] = append([]byte(nil), data...)
+	for _, ch := range b.watchers[format] {
+		select {
+		case ch <- append([]byte(nil), data...):
+		default:
+		}
+	}
+	return nil
+}
+
+// WriteMulti stores all representations, notifying watchers of each
+func (b *MemoryBackend) WriteMulti(items map[Format][]byte) error {
+	for format, data := range items {
+		b.Write(format, data)
+	}
+	return nil
+}
+
+func (b *MemoryBackend) Watch(ctx context.Context, format Format) <-chan []byte {
+	ch := make(chan []byte, 10)
+
+	b.mu.Lock()
+	b.watchers[format] = append(b.watchers[format], ch)
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		watchers := b.watchers[format]
+		for i, w := range watchers {
+			if w == ch {
+				b.watchers[format] = append(watchers[:i], watchers[i+1:]...)
+				break
+			}
+		}
+		close(ch)
+	}()
+
+	return ch
+}
@@ -0,0 +1,81 @@
+package clipboard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+
+	"golang.design/x/clipboard"
+)
+
+// nativeBackend uses golang.design/x/clipboard (Win32, Cocoa or X11)
+type nativeBackend struct{}
+
+// NewNativeBackend initializes the platform clipboard library
+func NewNativeBackend() (Backend, error) {
+	if err := clipboard.Init(); err != nil {
+		return nil, err
+	}
+	return nativeBackend{}, nil
+}
+
+func (nativeBackend) Name() string {
+	return "native"
+}
+
+func (nativeBackend) Read(format Format) ([]byte, error) {
+	f, err := nativeFormat(format)
+	if err != nil {
+		return readRich(format)
+	}
+	data := clipboard.Read(f)
+	if data == nil {
+		return nil, fmt.Errorf("failed to read clipboard")
+	}
+	return data, nil
+}
+
+func (nativeBackend) Write(format Format, data []byte) error {
+	f, err := nativeFormat(format)
+	if err != nil {
+		return writeRich(format, data)
+	}
+	clipboard.Write(f, data)
+	return nil
+}
+
+func (nativeBackend) Watch(ctx context.Context, format Format) <-chan []byte {
+	f, err := nativeFormat(format)
+	if err == nil {
+		return clipboard.Watch(ctx, f)
+	}
+	if richSupported(format) {
+		return pollWatch(ctx, func() ([]byte, error) { return readRich(format) })
+	}
+
+	ch := make(chan []byte)
+	close(ch)
+	return ch
+}
+
+// Primary falls back to xclip, since the library only handles CLIPBOARD
+func (nativeBackend) Primary() (Backend, error) {
+	if runtime.GOOS != "linux" {
+		return nil, errors.ErrUnsupported
+	}
+	if err := lookPaths("xclip"); err != nil {
+		return nil, fmt.Errorf("PRIMARY selection needs xclip: %w", err)
+	}
+	return newXclipBackend("primary"), nil
+}
+
+func nativeFormat(format Format) (clipboard.Format, error) {
+	switch format {
+	case FormatText:
+		return clipboard.FmtText, nil
+	case FormatPNG:
+		return clipboard.FmtImage, nil
+	}
+	return 0, fmt.Errorf("unsupported clipboard format %q", format)
+}
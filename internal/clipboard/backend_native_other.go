@@ -0,0 +1,34 @@
+//go:build !windows
+
+package clipboard
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// The native library knows nothing beyond text and images. On X11 other
+// formats are read through xclip when it is installed.
+
+func richSupported(format Format) bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	_, err := exec.LookPath("xclip")
+	return err == nil
+}
+
+func readRich(format Format) ([]byte, error) {
+	if !richSupported(format) {
+		return nil, fmt.Errorf("unsupported clipboard format %q", format)
+	}
+	return newXclipBackend("clipboard").Read(format)
+}
+
+func writeRich(format Format, data []byte) error {
+	if !richSupported(format) {
+		return fmt.Errorf("unsupported clipboard format %q", format)
+	}
+	return newXclipBackend("clipboard").Write(format, data)
+}
@@ -0,0 +1,338 @@
+package clipboard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// The native library only handles CF_UNICODETEXT and images, so rich
+// formats go straight through user32.
+
+const (
+	cfUnicodeText = 13
+	cfHDrop       = 15
+	gmemMoveable  = 0x0002
+
+	// dropFilesSize is sizeof(DROPFILES): pFiles, pt.x, pt.y, fNC, fWide
+	dropFilesSize = 20
+)
+
+var (
+	user32   = windows.NewLazySystemDLL("user32.dll")
+	kernel32 = windows.NewLazySystemDLL("kernel32.dll")
+
+	procOpenClipboard              = user32.NewProc("OpenClipboard")
+	procCloseClipboard             = user32.NewProc("CloseClipboard")
+	procEmptyClipboard             = user32.NewProc("EmptyClipboard")
+	procGetClipboardData           = user32.NewProc("GetClipboardData")
+	procSetClipboardData           = user32.NewProc("SetClipboardData")
+	procIsClipboardFormatAvailable = user32.NewProc("IsClipboardFormatAvailable")
+	procRegisterClipboardFormatW   = user32.NewProc("RegisterClipboardFormatW")
+
+	procGlobalAlloc   = kernel32.NewProc("GlobalAlloc")
+	procGlobalFree    = kernel32.NewProc("GlobalFree")
+	procGlobalLock    = kernel32.NewProc("GlobalLock")
+	procGlobalUnlock  = kernel32.NewProc("GlobalUnlock")
+	procGlobalSize    = kernel32.NewProc("GlobalSize")
+	procRtlMoveMemory = kernel32.NewProc("RtlMoveMemory")
+)
+
+// windowsFormatNames maps MIME types to registered clipboard format names
+var windowsFormatNames = map[Format]string{
+	FormatHTML: "HTML Format",
+	FormatRTF:  "Rich Text Format",
+	FormatPNG:  "PNG",
+}
+
+func richSupported(format Format) bool {
+	_, ok := windowsFormatNames[format]
+	return ok || format == FormatURIList
+}
+
+func registeredFormat(format Format) (uintptr, error) {
+	if format == FormatURIList {
+		return cfHDrop, nil
+	}
+	name, ok := windowsFormatNames[format]
+	if !ok {
+		return 0, fmt.Errorf("unsupported clipboard format %q", format)
+	}
+	namePtr, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	id, _, callErr := procRegisterClipboardFormatW.Call(uintptr(unsafe.Pointer(namePtr)))
+	if id == 0 {
+		return 0, fmt.Errorf("RegisterClipboardFormat(%s): %w", name, callErr)
+	}
+	return id, nil
+}
+
+// openClipboard retries for a moment, since other applications hold the
+// clipboard open briefly while they read or write it
+func openClipboard() error {
+	var err error
+	for i := 0; i < 10; i++ {
+		r, _, callErr := procOpenClipboard.Call(0)
+		if r != 0 {
+			return nil
+		}
+		err = callErr
+		time.Sleep(20 * time.Millisecond)
+	}
+	return fmt.Errorf("OpenClipboard: %w", err)
+}
+
+func readRich(format Format) ([]byte, error) {
+	id, err := registeredFormat(format)
+	if err != nil {
+		return nil, err
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if r, _, _ := procIsClipboardFormatAvailable.Call(id); r == 0 {
+		return nil, fmt.Errorf("clipboard has no %s data", format)
+	}
+	if err := openClipboard(); err != nil {
+		return nil, err
+	}
+	defer procCloseClipboard.Call()
+
+	h, _, callErr := procGetClipboardData.Call(id)
+	if h == 0 {
+		return nil, fmt.Errorf("GetClipboardData: %w", callErr)
+	}
+	data, err := copyFromGlobal(h)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == FormatURIList {
+		return EncodeURIList(decodeDropFiles(data)), nil
+	}
+
+	data = bytes.TrimRight(data, "\x00")
+	if format == FormatHTML {
+		data = decodeCFHTML(data)
+	}
+	return data, nil
+}
+
+func writeRich(format Format, data []byte) error {
+	if !richSupported(format) {
+		return fmt.Errorf("unsupported clipboard format %q", format)
+	}
+	return nativeBackend{}.WriteMulti(map[Format][]byte{format: data})
+}
+
+// WriteMulti puts all representations on the clipboard in one transaction
+// so that every application picks the richest format it understands
+func (nativeBackend) WriteMulti(items map[Format][]byte) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if err := openClipboard(); err != nil {
+		return err
+	}
+	defer procCloseClipboard.Call()
+
+	if r, _, callErr := procEmptyClipboard.Call(); r == 0 {
+		return fmt.Errorf("EmptyClipboard: %w", callErr)
+	}
+
+	for format, data := range items {
+		var id uintptr
+		switch format {
+		case FormatText:
+			id = cfUnicodeText
+			text, err := windows.UTF16FromString(strings.ReplaceAll(string(data), "\x00", ""))
+			if err != nil {
+				return err
+			}
+			data = unsafe.Slice((*byte)(unsafe.Pointer(&text[0])), len(text)*2)
+		case FormatHTML:
+			data = encodeCFHTML(data)
+		case FormatURIList:
+			id = cfHDrop
+			data = encodeDropFiles(ParseURIList(data))
+		}
+
+		if id == 0 {
+			var err error
+			if id, err = registeredFormat(format); err != nil {
+				continue
+			}
+		}
+		if format == FormatHTML || format == FormatRTF {
+			data = append(data, 0)
+		}
+
+		if err := setClipboardData(id, data); err != nil {
+			return fmt.Errorf("failed to set %s: %w", format, err)
+		}
+	}
+
+	return nil
+}
+
+func setClipboardData(id uintptr, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	h, _, callErr := procGlobalAlloc.Call(gmemMoveable, uintptr(len(data)))
+	if h == 0 {
+		return fmt.Errorf("GlobalAlloc: %w", callErr)
+	}
+
+	ptr, _, callErr := procGlobalLock.Call(h)
+	if ptr == 0 {
+		procGlobalFree.Call(h)
+		return fmt.Errorf("GlobalLock: %w", callErr)
+	}
+	procRtlMoveMemory.Call(ptr, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)))
+	procGlobalUnlock.Call(h)
+
+	// On success the clipboard owns the memory
+	if r, _, callErr := procSetClipboardData.Call(id, h); r == 0 {
+		procGlobalFree.Call(h)
+		return fmt.Errorf("SetClipboardData: %w", callErr)
+	}
+	return nil
+}
+
+func copyFromGlobal(h uintptr) ([]byte, error) {
+	size, _, _ := procGlobalSize.Call(h)
+	if size == 0 {
+		return nil, fmt.Errorf("empty clipboard data")
+	}
+
+	ptr, _, callErr := procGlobalLock.Call(h)
+	if ptr == 0 {
+		return nil, fmt.Errorf("GlobalLock: %w", callErr)
+	}
+	defer procGlobalUnlock.Call(h)
+
+	data := make([]byte, size)
+	procRtlMoveMemory.Call(uintptr(unsafe.Pointer(&data[0])), ptr, size)
+	return data, nil
+}
+
+// ---------- CF_HTML ----------
+
+const cfHTMLHeader = "Version:0.9\r\nStartHTML:%010d\r\nEndHTML:%010d\r\nStartFragment:%010d\r\nEndFragment:%010d\r\n"
+
+// encodeCFHTML wraps an HTML fragment in the header Windows expects
+func encodeCFHTML(fragment []byte) []byte {
+	const prefix = "<html><body>\r\n<!--StartFragment-->"
+	const suffix = "<!--EndFragment-->\r\n</body></html>"
+
+	headerLen := len(fmt.Sprintf(cfHTMLHeader, 0, 0, 0, 0))
+	startHTML := headerLen
+	startFragment := startHTML + len(prefix)
+	endFragment := startFragment + len(fragment)
+	endHTML := endFragment + len(suffix)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, cfHTMLHeader, startHTML, endHTML, startFragment, endFragment)
+	buf.WriteString(prefix)
+	buf.Write(fragment)
+	buf.WriteString(suffix)
+	return buf.Bytes()
+}
+
+// decodeCFHTML returns the fragment marked by the CF_HTML header offsets,
+// or the data unchanged if the header can't be parsed
+func decodeCFHTML(data []byte) []byte {
+	start, end := -1, -1
+	for _, line := range strings.SplitN(string(data), "\r\n", 8) {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		switch key {
+		case "StartFragment":
+			start = n
+		case "EndFragment":
+			end = n
+		}
+	}
+
+	if start < 0 || end < start || end > len(data) {
+		return data
+	}
+	return data[start:end]
+}
+
+// ---------- CF_HDROP ----------
+
+// encodeDropFiles builds a DROPFILES structure followed by the wide,
+// double-NUL-terminated path list
+func encodeDropFiles(paths []string) []byte {
+	var list []uint16
+	for _, path := range paths {
+		list = append(list, utf16.Encode([]rune(path))...)
+		list = append(list, 0)
+	}
+	list = append(list, 0)
+
+	buf := make([]byte, dropFilesSize+len(list)*2)
+	binary.LittleEndian.PutUint32(buf[0:], dropFilesSize) // pFiles
+	binary.LittleEndian.PutUint32(buf[16:], 1)            // fWide
+	for i, c := range list {
+		binary.LittleEndian.PutUint16(buf[dropFilesSize+i*2:], c)
+	}
+	return buf
+}
+
+func decodeDropFiles(data []byte) []string {
+	if len(data) < dropFilesSize {
+		return nil
+	}
+	offset := int(binary.LittleEndian.Uint32(data[0:]))
+	wide := binary.LittleEndian.Uint32(data[16:]) != 0
+	if offset >= len(data) {
+		return nil
+	}
+
+	var paths []string
+	if wide {
+		var current []uint16
+		for i := offset; i+1 < len(data); i += 2 {
+			c := binary.LittleEndian.Uint16(data[i:])
+			if c != 0 {
+				current = append(current, c)
+				continue
+			}
+			if len(current) == 0 {
+				break
+			}
+			paths = append(paths, string(utf16.Decode(current)))
+			current = nil
+		}
+		return paths
+	}
+
+	for _, path := range bytes.Split(data[offset:], []byte{0}) {
+		if len(path) == 0 {
+			break
+		}
+		paths = append(paths, string(path))
+	}
+	return paths
+}
@@ -0,0 +1,117 @@
+package clipboard
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+)
+
+// waylandBackend talks to the compositor through wl-clipboard. wl-paste
+// uses the wlr/ext data-control protocol, so it sees every Wayland client
+// and gets change notifications without having keyboard focus.
+type waylandBackend struct {
+	execBackend
+	selectionArgs []string
+}
+
+// NewWlClipboardBackend uses wl-paste/wl-copy from wl-clipboard (Wayland)
+func NewWlClipboardBackend() (Backend, error) {
+	if err := lookPaths("wl-paste", "wl-copy"); err != nil {
+		return nil, err
+	}
+	return newWaylandBackend(false), nil
+}
+
+func newWaylandBackend(primary bool) *waylandBackend {
+	name := "wl-clipboard"
+	var selectionArgs []string
+	if primary {
+		name += " primary"
+		selectionArgs = []string{"--primary"}
+	}
+
+	return &waylandBackend{
+		execBackend: execBackend{
+			name: name,
+			readCmd: func(format Format) []string {
+				args := append([]string{"wl-paste"}, selectionArgs...)
+				return append(args, "--no-newline", "--type", wlPasteType(format))
+			},
+			writeCmd: func(format Format) []string {
+				args := append([]string{"wl-copy"}, selectionArgs...)
+				return append(args, "--type", string(format))
+			},
+		},
+		selectionArgs: selectionArgs,
+	}
+}
+
+func (b *waylandBackend) Primary() (Backend, error) {
+	return newWaylandBackend(true), nil
+}
+
+// Watch runs "wl-paste --watch", which prints a line for every selection
+// change, and reads the new contents in the requested format. Compositors
+// without a data-control protocol (GNOME) make wl-paste exit right away;
+// in that case we fall back to polling.
+func (b *waylandBackend) Watch(ctx context.Context, format Format) <-chan []byte {
+	args := append(b.selectionArgs, "--watch", "echo", "changed")
+	cmd := exec.CommandContext(ctx, "wl-paste", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		fmt.Printf("[CLIPBOARD] wl-paste --watch unavailable (%v), polling instead\n", err)
+		return b.execBackend.Watch(ctx, format)
+	}
+
+	ch := make(chan []byte)
+
+	go func() {
+		defer close(ch)
+
+		last, _ := b.Read(format)
+		lines := bufio.NewScanner(stdout)
+		for lines.Scan() {
+			data, err := b.Read(format)
+			if err != nil || len(data) == 0 || bytes.Equal(data, last) {
+				continue
+			}
+			last = data
+
+			select {
+			case ch <- data:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		err := cmd.Wait()
+		if ctx.Err() != nil {
+			return
+		}
+
+		fmt.Printf("[CLIPBOARD] wl-paste --watch exited (%v), polling instead\n", err)
+		for data := range b.execBackend.Watch(ctx, format) {
+			select {
+			case ch <- data:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+// wlPasteType maps our formats to wl-paste types; "text" lets wl-paste
+// pick whichever text flavour the source offers
+func wlPasteType(format Format) string {
+	if format == FormatText {
+		return "text"
+	}
+	return string(format)
+}
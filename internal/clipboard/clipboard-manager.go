@@ -3,30 +3,56 @@ package clipboard
 import (
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
-
-	"golang.design/x/clipboard"
 )
 
 type Manager struct {
+	backend     Backend
 	watchChan   chan ClipboardContent
 	stopChan    chan struct{}
-	lastHash    string
 	isWatching  bool
 	downloadDir string
+
+	// lastHash is the digest of the last clipboard content we sent or
+	// set; lastFileListHash dedups file lists, which arrive on their own
+	// watcher. hashMu guards both, since SetClipboard runs on network
+	// goroutines while the watcher reads them.
+	lastHash         string
+	lastFileListHash string
+	hashMu           sync.Mutex
+
+	// imageOpts controls how copied images are sent, see image.go
+	imageOpts ImageOptions
+	imageMu   sync.RWMutex
+
+	// PRIMARY selection channel, see primary.go
+	primary         Backend
+	primaryCancel   context.CancelFunc
+	lastPrimaryHash string
+	primaryMu       sync.Mutex
 }
 
 type ClipboardContent struct {
-	Type     ContentType
-	Text     string
-	FilePath string
-	FileData []byte
-	FileName string
+	Type      ContentType
+	Selection Selection
+	Text      string
+	FilePath  string
+	FileData  []byte
+	FileName  string
+
+	// Representations holds richer versions of Text, such as HTML or RTF,
+	// keyed by MIME type. Text is always the plain-text fallback.
+	Representations map[Format][]byte
+
+	// Files holds the entries of a ContentTypeFileList
+	Files []ClipboardContent
 }
 
 type ContentType int
@@ -35,23 +61,33 @@ const (
 	ContentTypeText ContentType = iota
 	ContentTypeImage
 	ContentTypeFile
+	ContentTypeFileList
 )
 
 func NewManager(downloadDir string) *Manager {
 	// Initialize clipboard
-	err := clipboard.Init()
+	backend, err := DetectBackend()
 	if err != nil {
 		fmt.Printf("Failed to initialize clipboard: %v\n", err)
 		return nil
 	}
+	fmt.Printf("[CLIPBOARD] Using %s backend\n", backend.Name())
+
+	return NewManagerWithBackend(downloadDir, backend)
+}
 
+// NewManagerWithBackend creates a manager on top of the given backend,
+// e.g. a MemoryBackend in tests
+func NewManagerWithBackend(downloadDir string, backend Backend) *Manager {
 	// Ensure download directory exists
 	os.MkdirAll(downloadDir, 0755)
 
 	m := &Manager{
+		backend:     backend,
 		watchChan:   make(chan ClipboardContent, 10),
 		stopChan:    make(chan struct{}),
 		downloadDir: downloadDir,
+		imageOpts:   DefaultImageOptions(),
 	}
 
 	// Start watching clipboard changes
@@ -74,8 +110,9 @@ func (m *Manager) watchClipboard() {
 		cancel()
 	}()
 
-	textCh := clipboard.Watch(ctx, clipboard.FmtText)
-	imageCh := clipboard.Watch(ctx, clipboard.FmtImage)
+	textCh := m.backend.Watch(ctx, FormatText)
+	imageCh := m.backend.Watch(ctx, FormatPNG)
+	fileListCh := m.backend.Watch(ctx, FormatURIList)
 
 	for {
 		select {
@@ -86,263 +123,356 @@ func (m *Manager) watchClipboard() {
 			if data == nil {
 				return
 			}
+			m.handleText(data)
 
-			content := string(data)
-			hash := computeHash(content)
-
-			if hash != m.lastHash {
-				m.lastHash = hash
-
-				// ИСПРАВЛЕНО: Попытка обработать как путь к файлу
-				content = strings.TrimSpace(content)
-
-				if len(content) >= 2 && content[0] == '"' && content[len(content)-1] == '"' {
-					content = content[1 : len(content)-1]
-				}
-
-				// Проверяем, является ли это путём к файлу
-				if m.looksLikeFilePath(content) {
-					// Пытаемся прочитать файл
-					if fileInfo, err := os.Stat(content); err == nil && !fileInfo.IsDir() {
-						// Это валидный файл - читаем его
-						fileData, err := os.ReadFile(content)
-						if err == nil && len(fileData) > 0 {
-							clipContent := ClipboardContent{
-								Type:     ContentTypeFile,
-								FilePath: content,
-								FileName: filepath.Base(content),
-								FileData: fileData,
-							}
-
-							select {
-							case m.watchChan <- clipContent:
-								fmt.Printf("[CLIPBOARD] Detected file copy: %s (%d bytes)\n",
-									clipContent.FileName, len(fileData))
-							case <-time.After(500 * time.Millisecond):
-							}
-							continue
-						}
-					}
-				}
-
-				// Обычный текст
-				clipContent := ClipboardContent{
-					Type: ContentTypeText,
-					Text: content,
-				}
-
-				select {
-				case m.watchChan <- clipContent:
-				case <-time.After(500 * time.Millisecond):
-				}
-			}
-
-		case data := <-imageCh:
-			if data == nil {
+		case data, ok := <-imageCh:
+			if !ok {
+				imageCh = nil
 				continue
 			}
+			m.handleImage(data)
 
-			hash := computeHash(string(data))
-
-			if hash != m.lastHash {
-				m.lastHash = hash
-
-				fileName := fmt.Sprintf("clipboard_image_%d.png", time.Now().Unix())
-				filePath := filepath.Join(m.downloadDir, fileName)
-
-				err := os.WriteFile(filePath, data, 0644)
-				if err != nil {
-					fmt.Printf("Failed to save clipboard image: %v\n", err)
-					continue
-				}
-
-				clipContent := ClipboardContent{
-					Type:     ContentTypeImage,
-					FilePath: filePath,
-					FileName: fileName,
-					FileData: data,
-				}
-
-				select {
-				case m.watchChan <- clipContent:
-					fmt.Printf("[CLIPBOARD] Detected image copy: %s (%d bytes)\n",
-						fileName, len(data))
-				case <-time.After(500 * time.Millisecond):
-				}
+		case data, ok := <-fileListCh:
+			// Backends without file-list support close the channel
+			if !ok {
+				fileListCh = nil
+				continue
 			}
+			m.handleFileList(data)
 		}
 	}
 }
 
-func (m *Manager) looksLikeFilePath(text string) bool {
-	text = strings.TrimSpace(text)
+// handleText turns a clipboard text change into an outgoing event. Text
+// is always sent as text, even when it names a file; files go out only
+// when copied as files, see handleFileList.
+func (m *Manager) handleText(data []byte) {
+	hash := computeHash(data)
 
-	// Не должно быть переносов строк (только один путь)
-	if strings.Contains(text, "\n") {
-		return false
+	m.hashMu.Lock()
+	if hash == m.lastHash || hash == m.lastFileListHash {
+		m.hashMu.Unlock()
+		return
 	}
+	m.lastHash = hash
+	m.hashMu.Unlock()
 
-	// Слишком длинный текст - скорее всего не путь
-	if len(text) > 500 {
-		return false
+	// Copying files in a file manager also offers their paths as text;
+	// the file-list watcher sends those
+	if len(m.currentFileList()) > 0 {
+		return
 	}
 
-	// Проверяем паттерны путей
-	// Windows: C:\path\file.ext или \\server\share\file.ext
-	// Linux/Mac: /path/file.ext или ~/path/file.ext
-
-	isWindowsPath := len(text) >= 3 &&
-		((text[1] == ':' && (text[2] == '\\' || text[2] == '/')) ||
-			strings.HasPrefix(text, "\\\\"))
-
-	isUnixPath := strings.HasPrefix(text, "/") || strings.HasPrefix(text, "~/")
-
-	if !isWindowsPath && !isUnixPath {
-		return false
+	clipContent := ClipboardContent{
+		Type:            ContentTypeText,
+		Text:            strings.TrimSpace(string(data)),
+		Representations: m.readRichFormats(),
 	}
 
-	// Проверяем наличие расширения файла
-	ext := filepath.Ext(text)
-	if ext == "" {
-		return false
+	select {
+	case m.watchChan <- clipContent:
+		copiedTotal.With(metricType(clipContent)).Inc()
+	case <-time.After(500 * time.Millisecond):
 	}
-
-	return true
 }
 
-func (m *Manager) handleFilePath(path string) {
-	// Проверяем существование файла
-	fileInfo, err := os.Stat(path)
-	if err != nil {
-		// Not a valid file path, treat as text
-		clipContent := ClipboardContent{
-			Type: ContentTypeText,
-			Text: path,
-		}
-
-		select {
-		case m.watchChan <- clipContent:
-		case <-time.After(500 * time.Millisecond):
-		}
+// handleFileList sends the files copied in a file manager. Directories
+// are skipped.
+func (m *Manager) handleFileList(data []byte) {
+	paths := ParseURIList(data)
+	if len(paths) == 0 {
 		return
 	}
+	hash := computeHash([]byte(strings.Join(paths, "\n")))
 
-	if fileInfo.IsDir() {
-		// Directory - treat as text
-		clipContent := ClipboardContent{
-			Type: ContentTypeText,
-			Text: path,
+	m.hashMu.Lock()
+	if hash == m.lastFileListHash {
+		m.hashMu.Unlock()
+		return
+	}
+	m.lastFileListHash = hash
+	m.hashMu.Unlock()
+
+	files := make([]ClipboardContent, 0, len(paths))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			fmt.Printf("[CLIPBOARD] Skipping %s: not a regular file\n", path)
+			continue
 		}
-
-		select {
-		case m.watchChan <- clipContent:
-		case <-time.After(500 * time.Millisecond):
+		fileData, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Printf("[CLIPBOARD] Failed to read %s: %v\n", path, err)
+			continue
 		}
-		return
+		files = append(files, ClipboardContent{
+			Type:     ContentTypeFile,
+			FilePath: path,
+			FileName: filepath.Base(path),
+			FileData: fileData,
+		})
 	}
 
-	// Valid file - read and send
-	fileData, err := os.ReadFile(path)
-	if err != nil {
-		fmt.Printf("Failed to read file %s: %v\n", path, err)
+	var clipContent ClipboardContent
+	switch len(files) {
+	case 0:
 		return
-	}
-
-	clipContent := ClipboardContent{
-		Type:     ContentTypeFile,
-		FilePath: path,
-		FileName: filepath.Base(path),
-		FileData: fileData,
+	case 1:
+		clipContent = files[0]
+	default:
+		clipContent = ClipboardContent{Type: ContentTypeFileList, Files: files}
 	}
 
 	select {
 	case m.watchChan <- clipContent:
+		copiedTotal.With(metricType(clipContent)).Inc()
+		fmt.Printf("[CLIPBOARD] Detected file list copy: %d file(s)\n", len(files))
 	case <-time.After(500 * time.Millisecond):
 	}
 }
 
-func (m *Manager) isFilePath(text string) bool {
-	text = strings.TrimSpace(text)
+// currentFileList returns the files on the clipboard, if it holds a file list
+func (m *Manager) currentFileList() []string {
+	data, err := m.backend.Read(FormatURIList)
+	if err != nil {
+		return nil
+	}
+	return ParseURIList(data)
+}
+
+// SetImageOptions changes how copied images are prepared for sending
+func (m *Manager) SetImageOptions(opts ImageOptions) {
+	m.imageMu.Lock()
+	m.imageOpts = opts
+	m.imageMu.Unlock()
+}
+
+func (m *Manager) imageOptions() ImageOptions {
+	m.imageMu.RLock()
+	defer m.imageMu.RUnlock()
+	return m.imageOpts
+}
+
+// handleImage prepares a new clipboard image and turns it into an
+// outgoing event, keeping a copy in the download dir if configured
+func (m *Manager) handleImage(data []byte) {
+	hash := computeHash(data)
 
-	// Check if it looks like a file path
-	// Windows: C:\path\to\file or \\server\share
-	// Unix: /path/to/file or ~/path/to/file
-	if strings.HasPrefix(text, "/") ||
-		strings.HasPrefix(text, "~") ||
-		(len(text) >= 3 && text[1] == ':' && (text[2] == '\\' || text[2] == '/')) ||
-		strings.HasPrefix(text, "\\\\") {
+	m.hashMu.Lock()
+	if hash == m.lastHash {
+		m.hashMu.Unlock()
+		return
+	}
+	m.lastHash = hash
+	m.hashMu.Unlock()
 
-		// Must not contain newlines (single path only)
-		if strings.Contains(text, "\n") {
-			return false
+	opts := m.imageOptions()
+	imageData, format, err := prepareImage(data, opts)
+	if err != nil {
+		fmt.Printf("[CLIPBOARD] Failed to prepare image, sending it as is: %v\n", err)
+		imageData, format = data, ImageFormatPNG
+	}
+	data = imageData
+
+	fileName := fmt.Sprintf("clipboard_image_%d%s", time.Now().Unix(), format.Ext())
+	var filePath string
+	if opts.SaveCopies {
+		filePath = filepath.Join(m.downloadDir, fileName)
+		if err := os.WriteFile(filePath, data, 0644); err != nil {
+			fmt.Printf("Failed to save clipboard image: %v\n", err)
+			return
 		}
+	}
 
-		return true
+	clipContent := ClipboardContent{
+		Type:     ContentTypeImage,
+		FilePath: filePath,
+		FileName: fileName,
+		FileData: data,
 	}
 
-	return false
+	select {
+	case m.watchChan <- clipContent:
+		copiedTotal.With(metricType(clipContent)).Inc()
+		fmt.Printf("[CLIPBOARD] Detected image copy: %s (%d bytes)\n",
+			fileName, len(data))
+	case <-time.After(500 * time.Millisecond):
+	}
 }
 
 func (m *Manager) Watch() <-chan ClipboardContent {
 	return m.watchChan
 }
 
-func (m *Manager) SetClipboard(content ClipboardContent) error {
+func (m *Manager) SetClipboard(content ClipboardContent) (err error) {
+	defer func() {
+		if err == nil {
+			pastedTotal.With(metricType(content)).Inc()
+		}
+	}()
+
+	if content.Selection == SelectionPrimary {
+		return m.setPrimary(content.Text)
+	}
+
 	// Update last hash to prevent echo
 	switch content.Type {
 	case ContentTypeText:
-		m.lastHash = computeHash(content.Text)
-		clipboard.Write(clipboard.FmtText, []byte(content.Text))
+		m.setLastHash(computeHash([]byte(content.Text)))
+		if err := m.writeText(content); err != nil {
+			return fmt.Errorf("failed to write clipboard: %w", err)
+		}
 
 	case ContentTypeImage, ContentTypeFile:
 		if len(content.FileData) > 0 {
-			// Save file to download directory
-			savePath := filepath.Join(m.downloadDir, content.FileName)
-
-			err := os.WriteFile(savePath, content.FileData, 0644)
-			if err != nil {
-				return fmt.Errorf("failed to save file: %w", err)
+			// Images only need a copy on disk if the user wants one
+			var savePath string
+			if content.Type != ContentTypeImage || m.imageOptions().SaveCopies {
+				var err error
+				if savePath, err = m.SaveFile(content); err != nil {
+					return err
+				}
 			}
 
 			// For images, also write to clipboard as image
 			if content.Type == ContentTypeImage {
-				m.lastHash = computeHash(string(content.FileData))
-				clipboard.Write(clipboard.FmtImage, content.FileData)
+				pngData, err := toPNG(content.FileData)
+				if err != nil {
+					return err
+				}
+				m.setLastHash(computeHash(pngData))
+				if err := m.backend.Write(FormatPNG, pngData); err != nil {
+					return fmt.Errorf("failed to write clipboard: %w", err)
+				}
 			} else {
-				// For other files, write the file path to clipboard
-				m.lastHash = computeHash(savePath)
-				clipboard.Write(clipboard.FmtText, []byte(savePath))
+				// For other files, put the file itself on the clipboard
+				if err := m.writeFileList([]string{savePath}); err != nil {
+					return err
+				}
 			}
+		}
+	}
 
-			fmt.Printf("File saved to: %s\n", savePath)
+	return nil
+}
+
+// SaveFile stores a received file in the download directory
+func (m *Manager) SaveFile(content ClipboardContent) (string, error) {
+	savePath := filepath.Join(m.downloadDir, filepath.Base(content.FileName))
+
+	if err := os.WriteFile(savePath, content.FileData, 0644); err != nil {
+		return "", fmt.Errorf("failed to save file: %w", err)
+	}
+
+	fmt.Printf("File saved to: %s\n", savePath)
+	return savePath, nil
+}
+
+// SetFileList puts files on the clipboard so they can be pasted into a
+// file manager. The paths are also offered as plain text.
+func (m *Manager) SetFileList(paths []string) error {
+	if err := m.writeFileList(paths); err != nil {
+		return err
+	}
+	pastedTotal.With(ContentTypeFileList.String()).Inc()
+	return nil
+}
+
+// writeFileList is SetFileList without counting the paste
+func (m *Manager) writeFileList(paths []string) error {
+	text := strings.Join(paths, "\n")
+	hash := computeHash([]byte(text))
+	m.hashMu.Lock()
+	m.lastHash = hash
+	m.lastFileListHash = hash
+	m.hashMu.Unlock()
+
+	var err error
+	if multi, ok := m.backend.(MultiWriter); ok {
+		err = multi.WriteMulti(map[Format][]byte{
+			FormatURIList:    EncodeURIList(paths),
+			FormatGnomeFiles: encodeGnomeCopiedFiles(paths),
+			FormatText:       []byte(text),
+		})
+	} else if format := preferredFileListFormat(); format == FormatGnomeFiles {
+		err = m.backend.Write(format, encodeGnomeCopiedFiles(paths))
+	} else {
+		err = m.backend.Write(format, EncodeURIList(paths))
+	}
+
+	if err != nil {
+		fmt.Printf("[CLIPBOARD] File list not supported (%v), writing paths as text\n", err)
+		if err := m.backend.Write(FormatText, []byte(text)); err != nil {
+			return fmt.Errorf("failed to write clipboard: %w", err)
 		}
 	}
+	return nil
+}
 
+// readRichFormats collects the formatted versions of the current text
+func (m *Manager) readRichFormats() map[Format][]byte {
+	var reps map[Format][]byte
+	for _, format := range richFormats {
+		data, err := m.backend.Read(format)
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		if reps == nil {
+			reps = make(map[Format][]byte)
+		}
+		reps[format] = data
+	}
+	return reps
+}
+
+// writeText sets all representations of a text item together when the
+// backend can, and falls back to the plain text otherwise
+func (m *Manager) writeText(content ClipboardContent) error {
+	multi, ok := m.backend.(MultiWriter)
+	if !ok || len(content.Representations) == 0 {
+		return m.backend.Write(FormatText, []byte(content.Text))
+	}
+
+	items := make(map[Format][]byte, len(content.Representations)+1)
+	for format, data := range content.Representations {
+		items[format] = data
+	}
+	items[FormatText] = []byte(content.Text)
+
+	if err := multi.WriteMulti(items); err != nil {
+		fmt.Printf("[CLIPBOARD] Rich write failed, using plain text: %v\n", err)
+		return m.backend.Write(FormatText, []byte(content.Text))
+	}
 	return nil
 }
 
 func (m *Manager) GetClipboard() (string, error) {
-	data := clipboard.Read(clipboard.FmtText)
-	if data == nil {
-		return "", fmt.Errorf("failed to read clipboard")
+	data, err := m.backend.Read(FormatText)
+	if err != nil {
+		return "", err
 	}
 
 	return string(data), nil
 }
 
 func (m *Manager) Stop() {
+	m.DisablePrimary()
 	if m.isWatching {
 		close(m.stopChan)
 	}
 }
 
-// Simple hash function to detect clipboard changes
-func computeHash(s string) string {
-	if len(s) > 100 {
-		// For long strings, use first 50 + last 50 + length
-		return s[:50] + s[len(s)-50:] + fmt.Sprintf("_%d", len(s))
-	}
-	return s
+// setLastHash records the digest of content we put on the clipboard, so
+// the watcher doesn't send it back
+func (m *Manager) setLastHash(hash string) {
+	m.hashMu.Lock()
+	m.lastHash = hash
+	m.hashMu.Unlock()
+}
+
+// computeHash returns a SHA-256 digest of the whole content
+func computeHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }
 
 // ComputeFileChecksum calculates MD5 checksum of file data
@@ -0,0 +1,163 @@
+package clipboard
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestManager runs a manager on a MemoryBackend and waits until it
+// watches, so no write is missed
+func newTestManager(t *testing.T) (*Manager, *MemoryBackend) {
+	t.Helper()
+	backend := NewMemoryBackend()
+	m := NewManagerWithBackend(t.TempDir(), backend)
+	t.Cleanup(m.Stop)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		backend.mu.Lock()
+		watching := len(backend.watchers[FormatText]) > 0 && len(backend.watchers[FormatPNG]) > 0 && len(backend.watchers[FormatURIList]) > 0
+		backend.mu.Unlock()
+		if watching {
+			return m, backend
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("manager never started watching")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func next(t *testing.T, m *Manager) ClipboardContent {
+	t.Helper()
+	select {
+	case content := <-m.Watch():
+		return content
+	case <-time.After(2 * time.Second):
+		t.Fatal("no clipboard event")
+		return ClipboardContent{}
+	}
+}
+
+func none(t *testing.T, m *Manager) {
+	t.Helper()
+	select {
+	case content := <-m.Watch():
+		t.Fatalf("unexpected clipboard event: %+v", content)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	img.Set(1, 1, color.RGBA{R: 255, A: 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTextDedup(t *testing.T) {
+	m, backend := newTestManager(t)
+
+	backend.Write(FormatText, []byte("hello"))
+	if got := next(t, m); got.Type != ContentTypeText || got.Text != "hello" {
+		t.Fatalf("got %+v", got)
+	}
+
+	// Copying the same text again sends nothing
+	backend.Write(FormatText, []byte("hello"))
+	none(t, m)
+
+	backend.Write(FormatText, []byte("world"))
+	if got := next(t, m); got.Text != "world" {
+		t.Fatalf("got %+v", got)
+	}
+}
+
+func TestRichText(t *testing.T) {
+	m, backend := newTestManager(t)
+
+	backend.Write(FormatHTML, []byte("<b>bold</b>"))
+	backend.Write(FormatText, []byte("bold"))
+	got := next(t, m)
+	if got.Text != "bold" || string(got.Representations[FormatHTML]) != "<b>bold</b>" {
+		t.Fatalf("got %+v", got)
+	}
+}
+
+func TestFilePathStaysText(t *testing.T) {
+	m, backend := newTestManager(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "report.txt")
+	if err := os.WriteFile(path, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Explorer's "Copy as path" copies text, not the file
+	for _, text := range []string{path, `"` + path + `"`} {
+		backend.Write(FormatText, []byte(text))
+		got := next(t, m)
+		if got.Type != ContentTypeText || got.Text != text || got.FileData != nil {
+			t.Fatalf("%s: got %+v", text, got)
+		}
+	}
+}
+
+func TestFileListCopy(t *testing.T) {
+	m, backend := newTestManager(t)
+
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "b.txt")
+	os.WriteFile(a, []byte("a"), 0644)
+	os.WriteFile(b, []byte("b"), 0644)
+
+	// File managers offer the paths as text too; only the list is sent
+	backend.Write(FormatURIList, EncodeURIList([]string{a, b}))
+	backend.Write(FormatText, []byte(a+"\n"+b))
+	got := next(t, m)
+	if got.Type != ContentTypeFileList || len(got.Files) != 2 || got.Files[0].FilePath != a || got.Files[1].FilePath != b {
+		t.Fatalf("got %+v", got)
+	}
+	none(t, m)
+}
+
+func TestEchoSuppression(t *testing.T) {
+	m, backend := newTestManager(t)
+
+	// Content we set for a peer isn't sent back out
+	if err := m.SetClipboard(ClipboardContent{Type: ContentTypeText, Text: "from peer"}); err != nil {
+		t.Fatal(err)
+	}
+	none(t, m)
+	if text, _ := m.GetClipboard(); text != "from peer" {
+		t.Errorf("clipboard holds %q", text)
+	}
+
+	if err := m.SetClipboard(ClipboardContent{Type: ContentTypeImage, FileName: "image.png", FileData: testPNG(t)}); err != nil {
+		t.Fatal(err)
+	}
+	none(t, m)
+
+	// The user copying something afterwards still goes out
+	backend.Write(FormatText, []byte("typed locally"))
+	if got := next(t, m); got.Text != "typed locally" {
+		t.Fatalf("got %+v", got)
+	}
+
+	// A received file comes back as a file list and its paths as text
+	if err := m.SetClipboard(ClipboardContent{Type: ContentTypeFile, FileName: "doc.txt", FileData: []byte("doc")}); err != nil {
+		t.Fatal(err)
+	}
+	none(t, m)
+}
@@ -0,0 +1,74 @@
+package clipboard
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// EncodeURIList formats local paths as a text/uri-list (RFC 2483)
+func EncodeURIList(paths []string) []byte {
+	var buf bytes.Buffer
+	for _, path := range paths {
+		buf.WriteString(pathToURI(path))
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+// ParseURIList extracts local paths from a text/uri-list or an
+// x-special/gnome-copied-files list. Non-file URIs are skipped.
+func ParseURIList(data []byte) []string {
+	var paths []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// gnome-copied-files starts with the operation
+		if i == 0 && (line == "copy" || line == "cut") {
+			continue
+		}
+
+		u, err := url.Parse(line)
+		if err != nil || u.Scheme != "file" {
+			continue
+		}
+		path := u.Path
+		if runtime.GOOS == "windows" {
+			path = strings.TrimPrefix(path, "/")
+		}
+		paths = append(paths, filepath.FromSlash(path))
+	}
+	return paths
+}
+
+func encodeGnomeCopiedFiles(paths []string) []byte {
+	uris := make([]string, 0, len(paths))
+	for _, path := range paths {
+		uris = append(uris, pathToURI(path))
+	}
+	return []byte("copy\n" + strings.Join(uris, "\n"))
+}
+
+func pathToURI(path string) string {
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		// C:/dir/file becomes file:///C:/dir/file
+		path = "/" + path
+	}
+	u := url.URL{Scheme: "file", Path: path}
+	return u.String()
+}
+
+// preferredFileListFormat is used by backends that can offer only one
+// format: Nautilus pastes gnome-copied-files, other file managers uri-list
+func preferredFileListFormat() Format {
+	if strings.Contains(strings.ToLower(os.Getenv("XDG_CURRENT_DESKTOP")), "gnome") {
+		return FormatGnomeFiles
+	}
+	return FormatURIList
+}
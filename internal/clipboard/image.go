@@ -0,0 +1,231 @@
+package clipboard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"strings"
+
+	// Decoders for images received from peers
+	_ "image/gif"
+
+	"github.com/HugoSmits86/nativewebp"
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// ImageFormat is the encoding used for outgoing clipboard images
+type ImageFormat string
+
+const (
+	ImageFormatPNG  ImageFormat = "png"
+	ImageFormatJPEG ImageFormat = "jpeg"
+	ImageFormatWebP ImageFormat = "webp"
+)
+
+// ImageOptions controls how clipboard images are prepared before sending
+type ImageOptions struct {
+	Format ImageFormat
+	// Quality is 1-100. WebP is encoded losslessly; below 100 its colors
+	// are rounded first, see nearLossless.
+	Quality int
+
+	// MaxDimension downscales images whose width or height exceeds it.
+	// Zero keeps the original size.
+	MaxDimension int
+
+	// StripMetadata drops EXIF, text and timestamp chunks
+	StripMetadata bool
+
+	// SaveCopies keeps copied and received images in the download dir
+	SaveCopies bool
+}
+
+// DefaultImageOptions sends images as they are, minus their metadata
+func DefaultImageOptions() ImageOptions {
+	return ImageOptions{
+		Format:        ImageFormatPNG,
+		Quality:       85,
+		StripMetadata: true,
+		SaveCopies:    true,
+	}
+}
+
+// ParseImageFormat accepts the names used in the config file
+func ParseImageFormat(name string) (ImageFormat, error) {
+	switch strings.ToLower(name) {
+	case "", "png":
+		return ImageFormatPNG, nil
+	case "jpeg", "jpg":
+		return ImageFormatJPEG, nil
+	case "webp":
+		return ImageFormatWebP, nil
+	default:
+		return "", fmt.Errorf("unknown image format %q", name)
+	}
+}
+
+// Ext returns the file extension for images in this format
+func (f ImageFormat) Ext() string {
+	switch f {
+	case ImageFormatJPEG:
+		return ".jpg"
+	case ImageFormatWebP:
+		return ".webp"
+	}
+	return ".png"
+}
+
+// prepareImage transcodes and downscales a clipboard PNG for sending.
+// Untouched PNGs keep their original bytes apart from the metadata.
+func prepareImage(data []byte, opts ImageOptions) ([]byte, ImageFormat, error) {
+	format := opts.Format
+	if format == "" {
+		format = ImageFormatPNG
+	}
+
+	needsResize := false
+	if opts.MaxDimension > 0 {
+		cfg, err := png.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read image size: %w", err)
+		}
+		needsResize = cfg.Width > opts.MaxDimension || cfg.Height > opts.MaxDimension
+	}
+
+	if format == ImageFormatPNG && !needsResize {
+		if opts.StripMetadata {
+			return stripPNGMetadata(data), format, nil
+		}
+		return data, format, nil
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image: %w", err)
+	}
+	if needsResize {
+		img = downscale(img, opts.MaxDimension)
+	}
+
+	// Re-encoding never writes metadata
+	var buf bytes.Buffer
+	switch format {
+	case ImageFormatJPEG:
+		quality := opts.Quality
+		if quality < 1 || quality > 100 {
+			quality = jpeg.DefaultQuality
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	case ImageFormatWebP:
+		err = nativewebp.Encode(&buf, nearLossless(img, opts.Quality), nil)
+	default:
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode image: %w", err)
+	}
+	return buf.Bytes(), format, nil
+}
+
+// toPNG converts a received JPEG, WebP, GIF or BMP image to PNG, which is
+// what the image clipboard holds
+func toPNG(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, pngSignature) {
+		return data, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// downscale fits img into a maxDim x maxDim box, keeping its aspect ratio
+func downscale(img image.Image, maxDim int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w >= h {
+		h = max(1, h*maxDim/w)
+		w = maxDim
+	} else {
+		w = max(1, w*maxDim/h)
+		h = maxDim
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// nearLossless rounds colors to fewer bits the lower quality is, as
+// libwebp's near-lossless mode does, so the lossless encoder packs them
+// tighter. Alpha stays exact; quality 100 or out of range changes nothing.
+func nearLossless(img image.Image, quality int) image.Image {
+	if quality < 1 || quality >= 100 {
+		return img
+	}
+	step := 1 << (5 - quality/20)
+
+	b := img.Bounds()
+	dst := image.NewNRGBA(b)
+	draw.Draw(dst, b, img, b.Min, draw.Src)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		for c := range 3 {
+			v := (int(dst.Pix[i+c]) + step/2) &^ (step - 1)
+			dst.Pix[i+c] = uint8(min(v, 255))
+		}
+	}
+	return dst
+}
+
+// ---------- PNG METADATA ----------
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks can carry location, camera or editing details
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// stripPNGMetadata drops metadata chunks without re-encoding the image.
+// Data that isn't a well-formed PNG is returned unchanged.
+func stripPNGMetadata(data []byte) []byte {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return data
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+	for rest := data[len(pngSignature):]; len(rest) > 0; {
+		if len(rest) < 12 {
+			return data
+		}
+		// length, type, data, CRC. The length is checked before it becomes
+		// an int, which is 32 bits on some platforms.
+		length := uint64(binary.BigEndian.Uint32(rest))
+		if length > uint64(len(rest)-12) {
+			return data
+		}
+		size := int(length)
+		chunk := rest[:12+size]
+		if !pngMetadataChunks[string(chunk[4:8])] {
+			out = append(out, chunk...)
+		}
+		rest = rest[12+size:]
+	}
+	return out
+}
@@ -0,0 +1,92 @@
+package clipboard
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func gradientPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 7), G: uint8(y * 13), B: uint8(x + y), A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseImageFormat(t *testing.T) {
+	for name, want := range map[string]ImageFormat{"": ImageFormatPNG, "PNG": ImageFormatPNG, "jpg": ImageFormatJPEG, "webp": ImageFormatWebP} {
+		if got, err := ParseImageFormat(name); err != nil || got != want {
+			t.Errorf("%q: got %q, %v; want %q", name, got, err, want)
+		}
+	}
+	if _, err := ParseImageFormat("tiff"); err == nil {
+		t.Error("tiff accepted")
+	}
+}
+
+func TestPrepareWebP(t *testing.T) {
+	data := gradientPNG(t, 40, 30)
+	src, _ := png.Decode(bytes.NewReader(data))
+
+	// Quality 100 is lossless
+	out, format, err := prepareImage(data, ImageOptions{Format: ImageFormatWebP, Quality: 100})
+	if err != nil || format != ImageFormatWebP {
+		t.Fatalf("got %q, %v", format, err)
+	}
+	img, err := webp.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := range 30 {
+		for x := range 40 {
+			if got, want := color.NRGBAModel.Convert(img.At(x, y)), color.NRGBAModel.Convert(src.At(x, y)); got != want {
+				t.Fatalf("(%d, %d): got %v, want %v", x, y, got, want)
+			}
+		}
+	}
+
+	// Lower quality rounds colors, but stays close
+	out, _, err = prepareImage(data, ImageOptions{Format: ImageFormatWebP, Quality: 60, MaxDimension: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err = webp.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 15 {
+		t.Errorf("size %v, want 20x15", b.Size())
+	}
+
+	// Receivers put it on the clipboard as PNG
+	converted, err := toPNG(out)
+	if err != nil || !bytes.HasPrefix(converted, pngSignature) {
+		t.Errorf("toPNG: %v", err)
+	}
+}
+
+func TestNearLossless(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	img.Pix = []uint8{0x5b, 0xff, 0x02, 0x7f}
+
+	// Quality 60 keeps 6 bits per color
+	got := nearLossless(img, 60).(*image.NRGBA).Pix
+	if want := []uint8{0x5c, 0xff, 0x04, 0x7f}; !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+	if nearLossless(img, 100) != image.Image(img) {
+		t.Error("quality 100 changed the image")
+	}
+}
@@ -0,0 +1,32 @@
+package clipboard
+
+import "github.com/Krasnovvvvv/share-my-clipboard/internal/metrics"
+
+var (
+	copiedTotal = metrics.NewCounterVec("smc_clipboard_copied_total",
+		"Clipboard changes picked up on this device, by type", "type")
+	pastedTotal = metrics.NewCounterVec("smc_clipboard_pasted_total",
+		"Items from other devices put on the clipboard, by type", "type")
+)
+
+func (t ContentType) String() string {
+	switch t {
+	case ContentTypeText:
+		return "text"
+	case ContentTypeImage:
+		return "image"
+	case ContentTypeFile:
+		return "file"
+	default:
+		return "file_list"
+	}
+}
+
+// metricType labels content in the clipboard metrics; PRIMARY selections
+// are told apart from regular text
+func metricType(content ClipboardContent) string {
+	if content.Selection == SelectionPrimary {
+		return "primary"
+	}
+	return content.Type.String()
+}
@@ -0,0 +1,133 @@
+package clipboard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Selection tells which X11/Wayland selection a ClipboardContent belongs to
+type Selection int
+
+const (
+	SelectionClipboard Selection = iota
+	SelectionPrimary
+)
+
+// primaryDebounce waits for a mouse selection to settle before sending it,
+// since dragging over text changes PRIMARY continuously
+const primaryDebounce = 400 * time.Millisecond
+
+// EnablePrimary starts syncing the PRIMARY selection. Changes are emitted
+// on Watch with Selection set to SelectionPrimary.
+func (m *Manager) EnablePrimary() error {
+	provider, ok := m.backend.(PrimaryProvider)
+	if !ok {
+		return fmt.Errorf("%s backend has no PRIMARY selection: %w", m.backend.Name(), errors.ErrUnsupported)
+	}
+
+	m.primaryMu.Lock()
+	defer m.primaryMu.Unlock()
+
+	if m.primary != nil {
+		return nil
+	}
+
+	primary, err := provider.Primary()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.primary = primary
+	m.primaryCancel = cancel
+	go m.watchPrimary(ctx, primary)
+
+	fmt.Printf("[CLIPBOARD] PRIMARY selection sync enabled (%s)\n", primary.Name())
+	return nil
+}
+
+// DisablePrimary stops syncing the PRIMARY selection
+func (m *Manager) DisablePrimary() {
+	m.primaryMu.Lock()
+	defer m.primaryMu.Unlock()
+
+	if m.primary == nil {
+		return
+	}
+	m.primaryCancel()
+	m.primary = nil
+	m.primaryCancel = nil
+}
+
+// PrimaryEnabled reports whether the PRIMARY selection is being synced
+func (m *Manager) PrimaryEnabled() bool {
+	m.primaryMu.Lock()
+	defer m.primaryMu.Unlock()
+	return m.primary != nil
+}
+
+func (m *Manager) watchPrimary(ctx context.Context, primary Backend) {
+	changes := primary.Watch(ctx, FormatText)
+
+	debounce := time.NewTimer(primaryDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	var pending []byte
+	for {
+		select {
+		case data, ok := <-changes:
+			if !ok {
+				return
+			}
+			pending = data
+			debounce.Reset(primaryDebounce)
+
+		case <-debounce.C:
+			m.handlePrimary(pending)
+		}
+	}
+}
+
+func (m *Manager) handlePrimary(data []byte) {
+	text := string(data)
+	hash := computeHash(data)
+
+	m.primaryMu.Lock()
+	if hash == m.lastPrimaryHash || text == "" {
+		m.primaryMu.Unlock()
+		return
+	}
+	m.lastPrimaryHash = hash
+	m.primaryMu.Unlock()
+
+	clipContent := ClipboardContent{
+		Type:      ContentTypeText,
+		Selection: SelectionPrimary,
+		Text:      text,
+	}
+
+	select {
+	case m.watchChan <- clipContent:
+		copiedTotal.With(metricType(clipContent)).Inc()
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func (m *Manager) setPrimary(text string) error {
+	m.primaryMu.Lock()
+	primary := m.primary
+	if primary == nil {
+		m.primaryMu.Unlock()
+		return errors.New("PRIMARY selection sync is disabled")
+	}
+	m.lastPrimaryHash = computeHash([]byte(text))
+	m.primaryMu.Unlock()
+
+	if err := primary.Write(FormatText, []byte(text)); err != nil {
+		return fmt.Errorf("failed to write PRIMARY selection: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultMaxSize is the default send and receive limit
+const DefaultMaxSize = 100 * 1024 * 1024
+
+// Config holds the user's settings, stored as JSON in the user config dir
+type Config struct {
+	// SyncPrimary shares the X11/Wayland PRIMARY (middle-click) selection
+	// with other Linux peers
+	SyncPrimary bool `json:"sync_primary"`
+
+	// MapPrimaryToClipboard puts PRIMARY selections received from peers
+	// into the regular clipboard when we don't sync PRIMARY ourselves
+	MapPrimaryToClipboard bool `json:"map_primary_to_clipboard"`
+
+	// MaxSendSize and MaxReceiveSize cap clipboard items in bytes.
+	// Zero means no limit.
+	MaxSendSize    int64 `json:"max_send_size"`
+	MaxReceiveSize int64 `json:"max_receive_size"`
+
+	// Images controls how copied images are sent
+	Images ImageSettings `json:"images"`
+
+	// OfflineQueue keeps items for trusted devices that are offline
+	OfflineQueue QueueSettings `json:"offline_queue"`
+
+	// RelayHops is how often clipboard and file messages from other
+	// devices are forwarded to our peers, one by default. Zero disables
+	// relaying.
+	RelayHops int `json:"relay_hops"`
+
+	// Groups are the sync groups this device joined. Clipboard items only
+	// go to peers sharing a group; none means the "default" group.
+	Groups []string `json:"groups"`
+
+	// GroupSecrets maps group names to the passphrase members share.
+	// Only members of a group with a secret connect without asking.
+	GroupSecrets map[string]string `json:"group_secrets,omitempty"`
+
+	// Discovery lists the discovery backends to use: "multicast"
+	// (compatible with all versions) and "mdns" (DNS-SD)
+	Discovery []string `json:"discovery"`
+
+	// StaticPeers are "host" or "host:port" addresses probed on every
+	// scan, for networks where discovery finds nothing
+	StaticPeers []string `json:"static_peers"`
+
+	// Network sets the ports and interfaces the app uses. Environment
+	// variables and command-line flags override it, see EffectiveNetwork.
+	Network NetworkSettings `json:"network"`
+
+	mu sync.Mutex
+}
+
+// ImageSettings holds the options for outgoing clipboard images
+type ImageSettings struct {
+	// Format is "png", "jpeg" or "webp"
+	Format string `json:"format"`
+
+	// Quality is the JPEG or WebP quality, 1-100
+	Quality int `json:"quality"`
+
+	// MaxDimension downscales larger images; 0 keeps the original size
+	MaxDimension int `json:"max_dimension"`
+
+	// StripMetadata removes EXIF and location data
+	StripMetadata bool `json:"strip_metadata"`
+
+	// SaveCopies keeps copied and received images in the download folder
+	SaveCopies bool `json:"save_copies"`
+}
+
+// NetworkSettings says where the app listens. Zero values mean the
+// defaults: the standard ports on all interfaces.
+type NetworkSettings struct {
+	// Port accepts connections from other devices
+	Port int `json:"port"`
+
+	// IPCPort is the local control port on Windows. Elsewhere it only
+	// separates the socket of a second instance from the first one's.
+	IPCPort int `json:"ipc_port"`
+
+	// BindAddress accepts connections on this address only
+	BindAddress string `json:"bind_address"`
+
+	// Interfaces limits the app to these network interfaces
+	Interfaces []string `json:"interfaces"`
+
+	// MetricsAddress serves Prometheus metrics over HTTP on this
+	// host:port. Empty leaves the endpoint off.
+	MetricsAddress string `json:"metrics_address"`
+}
+
+// QueueSettings caps the offline queue. Zero means no cap.
+type QueueSettings struct {
+	// Enabled turns the queue on. Queued items are stored unencrypted
+	// in the config dir until delivered or expired.
+	Enabled       bool  `json:"enabled"`
+	MaxItems      int   `json:"max_items"`
+	MaxBytes      int64 `json:"max_bytes"`
+	ExpiryMinutes int   `json:"expiry_minutes"`
+}
+
+// Default returns the settings used when no config file exists
+func Default() *Config {
+	return &Config{
+		MaxSendSize:    DefaultMaxSize,
+		MaxReceiveSize: DefaultMaxSize,
+		RelayHops:      1,
+		Images: ImageSettings{
+			Format:        "png",
+			Quality:       85,
+			StripMetadata: true,
+			SaveCopies:    true,
+		},
+		OfflineQueue: QueueSettings{
+			MaxItems:      50,
+			MaxBytes:      256 * 1024 * 1024,
+			ExpiryMinutes: 24 * 60,
+		},
+		Discovery: []string{"multicast", "mdns"},
+	}
+}
+
+// dirOverride replaces the config dir for this run, see SetDir
+var dirOverride string
+
+// SetDir moves the config file and app state to dir for this run, so a
+// second instance can keep its own device ID and queue
+func SetDir(dir string) {
+	dirOverride = dir
+}
+
+// Dir returns the directory holding the config file and other app state.
+// SMC_CONFIG_DIR or SetDir change it.
+func Dir() string {
+	if dirOverride != "" {
+		return dirOverride
+	}
+	if dir := os.Getenv("SMC_CONFIG_DIR"); dir != "" {
+		return dir
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "share-my-clipboard")
+}
+
+// Path returns the location of the config file
+func Path() string {
+	return filepath.Join(Dir(), "config.json")
+}
+
+// DeviceID returns the persistent ID of this installation, creating it
+// on first use
+func DeviceID() (string, error) {
+	path := filepath.Join(Dir(), "device-id")
+	if data, err := os.ReadFile(path); err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(buf)
+
+	if err := os.MkdirAll(Dir(), 0700); err != nil {
+		return id, err
+	}
+	return id, os.WriteFile(path, []byte(id+"\n"), 0600)
+}
+
+// DeviceKey returns the persistent key pair of this installation,
+// creating it on first use. Only its seed is stored, next to the device ID.
+func DeviceKey() (ed25519.PrivateKey, error) {
+	path := filepath.Join(Dir(), "device-key")
+	if data, err := os.ReadFile(path); err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err == nil && len(seed) == ed25519.SeedSize {
+			return ed25519.NewKeyFromSeed(seed), nil
+		}
+		fmt.Printf("Warning: %s is damaged, creating a new device key\n", path)
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(Dir(), 0700); err != nil {
+		return key, err
+	}
+	return key, os.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600)
+}
+
+// networkOverride holds the command-line flags, which are never saved
+var networkOverride NetworkSettings
+
+// OverrideNetwork sets the network settings given on the command line.
+// Zero fields keep the value from the environment or config file.
+func OverrideNetwork(settings NetworkSettings) {
+	networkOverride = settings
+}
+
+// EffectiveNetwork returns the network settings in effect: the config
+// file, overridden by SMC_PORT, SMC_IPC_PORT, SMC_BIND_ADDRESS,
+// SMC_INTERFACES and SMC_METRICS_ADDRESS, overridden by the command-line
+// flags
+func (c *Config) EffectiveNetwork() (NetworkSettings, error) {
+	c.mu.Lock()
+	settings := c.Network
+	settings.Interfaces = slices.Clone(c.Network.Interfaces)
+	c.mu.Unlock()
+
+	for _, env := range []struct {
+		name string
+		port *int
+	}{
+		{"SMC_PORT", &settings.Port},
+		{"SMC_IPC_PORT", &settings.IPCPort},
+	} {
+		value := os.Getenv(env.name)
+		if value == "" {
+			continue
+		}
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return settings, fmt.Errorf("invalid %s %q", env.name, value)
+		}
+		*env.port = port
+	}
+	if value := os.Getenv("SMC_BIND_ADDRESS"); value != "" {
+		settings.BindAddress = value
+	}
+	if value := os.Getenv("SMC_INTERFACES"); value != "" {
+		settings.Interfaces = SplitList(value)
+	}
+	if value := os.Getenv("SMC_METRICS_ADDRESS"); value != "" {
+		settings.MetricsAddress = value
+	}
+
+	if networkOverride.Port != 0 {
+		settings.Port = networkOverride.Port
+	}
+	if networkOverride.IPCPort != 0 {
+		settings.IPCPort = networkOverride.IPCPort
+	}
+	if networkOverride.BindAddress != "" {
+		settings.BindAddress = networkOverride.BindAddress
+	}
+	if len(networkOverride.Interfaces) > 0 {
+		settings.Interfaces = networkOverride.Interfaces
+	}
+	if networkOverride.MetricsAddress != "" {
+		settings.MetricsAddress = networkOverride.MetricsAddress
+	}
+
+	for _, port := range []int{settings.Port, settings.IPCPort} {
+		if port < 0 || port > 65535 {
+			return settings, fmt.Errorf("invalid port %d", port)
+		}
+	}
+	if settings.BindAddress != "" && net.ParseIP(settings.BindAddress) == nil {
+		return settings, fmt.Errorf("bind address %q is not an IP address", settings.BindAddress)
+	}
+	if settings.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(settings.MetricsAddress); err != nil {
+			return settings, fmt.Errorf("invalid metrics address %q: %w", settings.MetricsAddress, err)
+		}
+	}
+	return settings, nil
+}
+
+// SplitList splits a comma-separated list, dropping empty entries
+func SplitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Load reads the config file. A missing file yields the defaults.
+func Load() (*Config, error) {
+	cfg := Default()
+
+	data, err := os.ReadFile(Path())
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return Default(), fmt.Errorf("failed to parse %s: %w", Path(), err)
+	}
+	return cfg, nil
+}
+
+// Update applies fn to the config under its lock and saves the result
+func (c *Config) Update(fn func(c *Config)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fn(c)
+	return c.save()
+}
+
+func (c *Config) save() error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(Dir(), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(Path(), data, 0600)
+}
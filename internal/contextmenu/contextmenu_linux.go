@@ -0,0 +1,343 @@
+package contextmenu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	menuName = "ShareMyClipboard"
+	menuText = "Send to Connected Devices"
+	menuIcon = "document-send"
+
+	// thunarActionID identifies our entry inside Thunar's shared uca.xml
+	thunarActionID = "share-my-clipboard-send"
+)
+
+// integration is one file-manager specific way of offering "Send to"
+type integration struct {
+	name      string
+	desktops  []string // XDG_CURRENT_DESKTOP values that use this file manager
+	binary    string   // file manager executable, used when the desktop is unknown
+	install   func(exePath string) error
+	uninstall func() error
+	installed func() bool
+}
+
+var integrations = []integration{
+	{
+		name:      "Nautilus",
+		desktops:  []string{"gnome", "unity", "budgie", "pop"},
+		binary:    "nautilus",
+		install:   installNautilusScript,
+		uninstall: func() error { return removeFile(nautilusScriptPath()) },
+		installed: func() bool { return fileExists(nautilusScriptPath()) },
+	},
+	{
+		name:      "Dolphin",
+		desktops:  []string{"kde"},
+		binary:    "dolphin",
+		install:   installDolphinServiceMenu,
+		uninstall: func() error { return removeFile(dolphinServiceMenuPath()) },
+		installed: func() bool { return fileExists(dolphinServiceMenuPath()) },
+	},
+	{
+		name:      "Thunar",
+		desktops:  []string{"xfce"},
+		binary:    "thunar",
+		install:   installThunarAction,
+		uninstall: removeThunarAction,
+		installed: thunarActionInstalled,
+	},
+}
+
+// Register installs the "Send to" entry for the file managers of the
+// current desktop environment, plus a generic .desktop entry that shows
+// up under "Open With" everywhere else.
+func Register() error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %w", err)
+	}
+	exePath = filepath.Clean(exePath)
+
+	if err := installSendToEntry(exePath); err != nil {
+		return fmt.Errorf("failed to install desktop entry: %w", err)
+	}
+
+	for _, in := range activeIntegrations() {
+		if err := in.install(exePath); err != nil {
+			return fmt.Errorf("failed to register for %s: %w", in.name, err)
+		}
+		fmt.Printf("[ContextMenu] Registered for %s\n", in.name)
+	}
+
+	fmt.Println("[ContextMenu] Successfully registered")
+	return nil
+}
+
+// Unregister removes every integration, regardless of the current desktop
+func Unregister() error {
+	var errs []error
+	if err := removeFile(sendToEntryPath()); err != nil {
+		errs = append(errs, err)
+	}
+	for _, in := range integrations {
+		if err := in.uninstall(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", in.name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	fmt.Println("[ContextMenu] Successfully unregistered")
+	return nil
+}
+
+// IsRegistered checks if the entries for the current desktop are installed
+func IsRegistered() bool {
+	if !fileExists(sendToEntryPath()) {
+		return false
+	}
+	for _, in := range activeIntegrations() {
+		if !in.installed() {
+			return false
+		}
+	}
+	return true
+}
+
+// activeIntegrations picks the file managers of the current desktop
+// environment. When the desktop is unknown, every installed file manager
+// we know of is used instead.
+func activeIntegrations() []integration {
+	desktop := strings.ToLower(os.Getenv("XDG_CURRENT_DESKTOP"))
+
+	var active []integration
+	for _, in := range integrations {
+		for _, name := range in.desktops {
+			if strings.Contains(desktop, name) {
+				active = append(active, in)
+				break
+			}
+		}
+	}
+	if len(active) > 0 {
+		return active
+	}
+
+	for _, in := range integrations {
+		if _, err := exec.LookPath(in.binary); err == nil {
+			active = append(active, in)
+		}
+	}
+	return active
+}
+
+// ---------- GENERIC DESKTOP ENTRY ----------
+
+func sendToEntryPath() string {
+	return filepath.Join(dataHome(), "applications", "share-my-clipboard-send.desktop")
+}
+
+func installSendToEntry(exePath string) error {
+	content := fmt.Sprintf(`[Desktop Entry]
+Type=Application
+Name=%s
+Icon=%s
+Exec=%s --send %%F
+MimeType=application/octet-stream;text/plain;image/png;image/jpeg;application/pdf;application/zip;
+NoDisplay=true
+Terminal=false
+`, menuText, menuIcon, desktopExecQuote(exePath))
+
+	return writeFile(sendToEntryPath(), content, 0644)
+}
+
+// ---------- NAUTILUS ----------
+
+func nautilusScriptPath() string {
+	return filepath.Join(dataHome(), "nautilus", "scripts", menuText)
+}
+
+func installNautilusScript(exePath string) error {
+	content := fmt.Sprintf(`#!/bin/sh
+# Installed by Share My Clipboard
+IFS='
+'
+set -- $NAUTILUS_SCRIPT_SELECTED_FILE_PATHS
+[ $# -gt 0 ] || exit 0
+exec %s --send "$@"
+`, shellQuote(exePath))
+
+	return writeFile(nautilusScriptPath(), content, 0755)
+}
+
+// ---------- DOLPHIN ----------
+
+func dolphinServiceMenuPath() string {
+	return filepath.Join(dataHome(), "kio", "servicemenus", strings.ToLower(menuName)+".desktop")
+}
+
+func installDolphinServiceMenu(exePath string) error {
+	content := fmt.Sprintf(`[Desktop Entry]
+Type=Service
+MimeType=application/octet-stream;
+X-KDE-ServiceTypes=KonqPopupMenu/Plugin
+Actions=send
+X-KDE-Priority=TopLevel
+
+[Desktop Action send]
+Name=%s
+Icon=%s
+Exec=%s --send %%F
+`, menuText, menuIcon, desktopExecQuote(exePath))
+
+	// Plasma 6 ignores service menus that are not executable
+	return writeFile(dolphinServiceMenuPath(), content, 0755)
+}
+
+// ---------- THUNAR ----------
+
+func thunarConfigPath() string {
+	return filepath.Join(configHome(), "Thunar", "uca.xml")
+}
+
+func installThunarAction(exePath string) error {
+	config, err := os.ReadFile(thunarConfigPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	actions := removeThunarBlock(string(config))
+	if !strings.Contains(actions, "</actions>") {
+		actions = "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<actions>\n</actions>\n"
+	}
+
+	action := fmt.Sprintf(`<action>
+	<icon>%s</icon>
+	<name>%s</name>
+	<unique-id>%s</unique-id>
+	<command>%s --send %%F</command>
+	<description>Send the selected files to connected devices</description>
+	<patterns>*</patterns>
+	<audio-files/>
+	<image-files/>
+	<other-files/>
+	<text-files/>
+	<video-files/>
+</action>
+`, menuIcon, menuText, thunarActionID, xmlEscape(shellQuote(exePath)))
+
+	idx := strings.LastIndex(actions, "</actions>")
+	actions = actions[:idx] + action + actions[idx:]
+
+	return writeFile(thunarConfigPath(), actions, 0644)
+}
+
+func removeThunarAction() error {
+	config, err := os.ReadFile(thunarConfigPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	cleaned := removeThunarBlock(string(config))
+	if cleaned == string(config) {
+		return nil
+	}
+	return writeFile(thunarConfigPath(), cleaned, 0644)
+}
+
+func thunarActionInstalled() bool {
+	config, err := os.ReadFile(thunarConfigPath())
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(config), "<unique-id>"+thunarActionID+"</unique-id>")
+}
+
+// removeThunarBlock cuts our <action> element out of uca.xml, leaving the
+// user's own custom actions untouched
+func removeThunarBlock(config string) string {
+	id := strings.Index(config, "<unique-id>"+thunarActionID+"</unique-id>")
+	if id < 0 {
+		return config
+	}
+
+	start := strings.LastIndex(config[:id], "<action>")
+	end := strings.Index(config[id:], "</action>")
+	if start < 0 || end < 0 {
+		return config
+	}
+	end = id + end + len("</action>")
+	if end < len(config) && config[end] == '\n' {
+		end++
+	}
+
+	return config[:start] + config[end:]
+}
+
+// ---------- HELPERS ----------
+
+func dataHome() string {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return dir
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".local", "share")
+}
+
+func configHome() string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		return dir
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config")
+}
+
+func writeFile(path, content string, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(content), perm); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of an existing file, so set it explicitly
+	return os.Chmod(path, perm)
+}
+
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// shellQuote quotes s for POSIX sh
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// desktopExecQuote quotes an argument for the Exec key of a .desktop file
+func desktopExecQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\\\`, `"`, `\\"`, "`", "\\\\`", `$`, `\\$`)
+	return `"` + r.Replace(s) + `"`
+}
+
+func xmlEscape(s string) string {
+	r := strings.NewReplacer(`&`, "&amp;", `<`, "&lt;", `>`, "&gt;", `"`, "&quot;", `'`, "&apos;")
+	return r.Replace(s)
+}
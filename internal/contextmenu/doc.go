@@ -0,0 +1,5 @@
+// Package contextmenu installs the "Send to Connected Devices" entry in the
+// file manager: Explorer on Windows, and Nautilus, Dolphin, Thunar or a
+// generic desktop entry on Linux. Other platforms have no implementation;
+// use the platform package, which falls back to a no-op.
+package contextmenu
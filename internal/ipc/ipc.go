@@ -1,60 +1,125 @@
 package ipc
 
-/*
-#define WIN32_LEAN_AND_MEAN
-#include <windows.h>
-#include <stdlib.h>
-*/
-import "C"
-
-import (
-	"path/filepath"
-)
-
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
-)
 
-const (
-	ipcPort    = 54323
-	ipcTimeout = 5 * time.Second
+	"github.com/Krasnovvvvv/share-my-clipboard/internal/metrics"
+	"github.com/Krasnovvvvv/share-my-clipboard/internal/platform"
 )
 
+// DefaultPort is the local TCP port used for IPC on Windows
+const DefaultPort = 54323
+
+const ipcTimeout = 5 * time.Second
+
+var ipcPort = DefaultPort
+
+// ipcRequests counts requests for the metrics endpoint. Types nobody
+// registered are counted as "unknown".
+var ipcRequests = metrics.NewCounterVec("smc_ipc_requests_total",
+	"Local control requests, by type and result", "type", "result")
+
+// SetPort changes the IPC port. Any other port than DefaultPort also gets
+// its own socket, lock and token, so a second instance can run next to
+// the first.
+func SetPort(port int) {
+	if port > 0 {
+		ipcPort = port
+	}
+}
+
+// instanceDir separates the IPC files of instances on other ports
+func instanceDir(dir string) string {
+	if ipcPort == DefaultPort {
+		return dir
+	}
+	return fmt.Sprintf("%s-%d", dir, ipcPort)
+}
+
 type IPCServer struct {
 	listener net.Listener
-	handlers map[string]func(data []byte) error
+	handlers map[string]func(data []byte) (interface{}, error)
+	token    string
 	mu       sync.RWMutex
-	running  bool
+	running  atomic.Bool
 }
 
 type IPCMessage struct {
-	Type string          `json:"type"`
-	Data json.RawMessage `json:"data"`
+	Type  string          `json:"type"`
+	Token string          `json:"token,omitempty"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// ipcResponse answers every request. Data is only set by queries.
+type ipcResponse struct {
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
 }
 
 type SendFilesRequest struct {
 	FilePaths []string `json:"file_paths"`
 }
 
-// NewIPCServer creates IPC server for inter-process communication
+// ActivateRequest carries the arguments of a second launch to the running instance
+type ActivateRequest struct {
+	Args    []string `json:"args"`
+	WorkDir string   `json:"work_dir"`
+}
+
+// QueueCancelRequest names a queued item to drop
+type QueueCancelRequest struct {
+	ID string `json:"id"`
+}
+
+// ConnectRequest names a device to connect to, by IP or "host:port"
+type ConnectRequest struct {
+	Address string `json:"address"`
+}
+
+var errNotRunning = errors.New("application is not running")
+
+// NewIPCServer creates IPC server for inter-process communication.
+// The listener is platform specific (see transport_*.go): a Unix domain
+// socket readable only by the current user, or a loopback TCP port
+// protected by a per-session token.
 func NewIPCServer() (*IPCServer, error) {
-	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ipcPort))
+	listener, err := listenIPC()
 	if err != nil {
 		return nil, fmt.Errorf("failed to start IPC server: %w", err)
 	}
 
 	server := &IPCServer{
 		listener: listener,
-		handlers: make(map[string]func(data []byte) error),
-		running:  true,
+		handlers: make(map[string]func(data []byte) (interface{}, error)),
+	}
+	server.running.Store(true)
+
+	if transportNeedsToken {
+		token, err := newSessionToken()
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to create session token: %w", err)
+		}
+		if err := writeTokenFile(token); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to store session token: %w", err)
+		}
+		server.token = token
 	}
 
-	fmt.Printf("[IPC] Server started on port %d\n", ipcPort)
+	fmt.Printf("[IPC] Server started on %s\n", listener.Addr())
 	go server.acceptConnections()
 
 	return server, nil
@@ -62,16 +127,23 @@ func NewIPCServer() (*IPCServer, error) {
 
 // RegisterHandler registers handler for specific message type
 func (s *IPCServer) RegisterHandler(msgType string, handler func(data []byte) error) {
+	s.RegisterQuery(msgType, func(data []byte) (interface{}, error) {
+		return nil, handler(data)
+	})
+}
+
+// RegisterQuery registers a handler whose result is sent back to the client
+func (s *IPCServer) RegisterQuery(msgType string, handler func(data []byte) (interface{}, error)) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.handlers[msgType] = handler
 }
 
 func (s *IPCServer) acceptConnections() {
-	for s.running {
+	for s.running.Load() {
 		conn, err := s.listener.Accept()
 		if err != nil {
-			if s.running {
+			if s.running.Load() {
 				fmt.Printf("[IPC] Accept error: %v\n", err)
 			}
 			continue
@@ -85,11 +157,25 @@ func (s *IPCServer) handleConnection(conn net.Conn) {
 	defer conn.Close()
 	conn.SetDeadline(time.Now().Add(ipcTimeout))
 
+	if err := verifyPeer(conn); err != nil {
+		fmt.Printf("[IPC] Rejected connection: %v\n", err)
+		ipcRequests.With("unknown", "unauthorized").Inc()
+		return
+	}
+
 	decoder := json.NewDecoder(conn)
 	var msg IPCMessage
 
 	if err := decoder.Decode(&msg); err != nil {
 		fmt.Printf("[IPC] Failed to decode message: %v\n", err)
+		ipcRequests.With("unknown", "invalid").Inc()
+		return
+	}
+
+	if s.token != "" && subtle.ConstantTimeCompare([]byte(msg.Token), []byte(s.token)) != 1 {
+		fmt.Println("[IPC] Rejected message with invalid session token")
+		ipcRequests.With("unknown", "unauthorized").Inc()
+		sendResponse(conn, ipcResponse{Message: "unauthorized"})
 		return
 	}
 
@@ -99,33 +185,41 @@ func (s *IPCServer) handleConnection(conn net.Conn) {
 
 	if !exists {
 		fmt.Printf("[IPC] Unknown message type: %s\n", msg.Type)
-		sendResponse(conn, false, "unknown message type")
+		ipcRequests.With("unknown", "error").Inc()
+		sendResponse(conn, ipcResponse{Message: "unknown message type"})
 		return
 	}
 
-	if err := handler(msg.Data); err != nil {
+	result, err := handler(msg.Data)
+	if err != nil {
 		fmt.Printf("[IPC] Handler error: %v\n", err)
-		sendResponse(conn, false, err.Error())
+		ipcRequests.With(msg.Type, "error").Inc()
+		sendResponse(conn, ipcResponse{Message: err.Error()})
 		return
 	}
 
-	sendResponse(conn, true, "success")
+	ipcRequests.With(msg.Type, "ok").Inc()
+	response := ipcResponse{Success: true, Message: "success"}
+	if result != nil {
+		if response.Data, err = json.Marshal(result); err != nil {
+			sendResponse(conn, ipcResponse{Message: fmt.Sprintf("failed to encode result: %v", err)})
+			return
+		}
+	}
+	sendResponse(conn, response)
 }
 
-func sendResponse(conn net.Conn, success bool, message string) {
-	response := map[string]interface{}{
-		"success": success,
-		"message": message,
-	}
+func sendResponse(conn net.Conn, response ipcResponse) {
 	json.NewEncoder(conn).Encode(response)
 }
 
 // Stop stops IPC server
 func (s *IPCServer) Stop() {
-	s.running = false
+	s.running.Store(false)
 	if s.listener != nil {
 		s.listener.Close()
 	}
+	cleanupIPC()
 	fmt.Println("[IPC] Server stopped")
 }
 
@@ -139,38 +233,83 @@ func NewIPCClient() *IPCClient {
 
 // SendFiles sends file paths to running GUI application
 func (c *IPCClient) SendFiles(filePaths []string) error {
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", ipcPort), 3*time.Second)
+	err := c.send("send_files", SendFilesRequest{FilePaths: filePaths})
+	if errors.Is(err, errNotRunning) {
+		platform.Current().ShowMessage("Share My Clipboard is not running.\nLaunch the application to send the files.")
+	}
+	return err
+}
+
+// Activate asks the running instance to bring its window to the front and
+// handle the command-line arguments of a second launch
+func (c *IPCClient) Activate(args []string) error {
+	workDir, _ := os.Getwd()
+	return c.send("activate", ActivateRequest{Args: args, WorkDir: workDir})
+}
+
+// Query sends a request to the running instance and decodes its answer
+// into result
+func (c *IPCClient) Query(msgType string, request, result interface{}) error {
+	data, err := c.exchange(msgType, request)
 	if err != nil {
-		showUserMessage("Share My Clipboard is not running.\nLaunch the application to send the files.")
-		return fmt.Errorf("application is not running")
+		return err
+	}
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("failed to decode result: %w", err)
+	}
+	return nil
+}
+
+// send delivers a single request and waits for the server's response
+func (c *IPCClient) send(msgType string, request interface{}) error {
+	_, err := c.exchange(msgType, request)
+	return err
+}
+
+// exchange performs one request and returns the response data
+func (c *IPCClient) exchange(msgType string, request interface{}) (json.RawMessage, error) {
+	conn, err := dialIPC(3 * time.Second)
+	if err != nil {
+		return nil, errNotRunning
 	}
 	defer conn.Close()
 
-	request := SendFilesRequest{FilePaths: filePaths}
-	msg := IPCMessage{Type: "send_files"}
+	msg := IPCMessage{Type: msgType}
 	msg.Data, _ = json.Marshal(request)
 
+	if transportNeedsToken {
+		token, err := readTokenFile()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read session token: %w", err)
+		}
+		msg.Token = token
+	}
+
 	conn.SetDeadline(time.Now().Add(ipcTimeout))
 
 	if err := json.NewEncoder(conn).Encode(&msg); err != nil {
-		return fmt.Errorf("failed to send message: %w", err)
+		return nil, fmt.Errorf("failed to send message: %w", err)
 	}
 
-	var response map[string]interface{}
+	var response ipcResponse
 	if err := json.NewDecoder(conn).Decode(&response); err != nil {
-		return fmt.Errorf("failed to read response: %w", err)
+		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
 
-	if success, ok := response["success"].(bool); !ok || !success {
-		return fmt.Errorf("request failed: %v", response["message"])
+	if !response.Success {
+		return nil, fmt.Errorf("request failed: %s", response.Message)
 	}
 
-	return nil
+	return response.Data, nil
 }
 
-// IsRunning checks if GUI application is already running
+// IsRunning checks whether the IPC endpoint of a running instance answers.
+// Use AcquireInstanceLock to decide whether this process may start the GUI.
 func IsRunning() bool {
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", ipcPort), 1*time.Second)
+	conn, err := dialIPC(1 * time.Second)
 	if err != nil {
 		return false
 	}
@@ -178,29 +317,36 @@ func IsRunning() bool {
 	return true
 }
 
-// CheckSingleInstance checks if another instance is running
-func CheckSingleInstance() error {
-	if IsRunning() {
-		return fmt.Errorf("application is already running")
+// GetLockFile returns path to lock file
+func GetLockFile() string {
+	return filepath.Join(ipcDir(), "instance.lock")
+}
+
+// newSessionToken generates a random token that TCP clients must present
+func newSessionToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
 	}
-	return nil
+	return hex.EncodeToString(buf), nil
 }
 
-// GetLockFile returns path to lock file
-func GetLockFile() string {
-	tmpDir := os.TempDir()
-	return fmt.Sprintf("%s/share-my-clipboard.lock", tmpDir)
+func tokenFilePath() string {
+	return filepath.Join(ipcDir(), "ipc.token")
 }
 
-func showUserMessage(msg string) {
-	// Log to file instead of showing MessageBox
-	logFile := filepath.Join(os.TempDir(), "share-my-clipboard.log")
-	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return
+// writeTokenFile stores the session token where only the current user can read it
+func writeTokenFile(token string) error {
+	if err := os.MkdirAll(ipcDir(), 0700); err != nil {
+		return err
 	}
-	defer f.Close()
+	return os.WriteFile(tokenFilePath(), []byte(token), 0600)
+}
 
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	fmt.Fprintf(f, "[%s] %s\n", timestamp, msg)
+func readTokenFile() (string, error) {
+	data, err := os.ReadFile(tokenFilePath())
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
 }
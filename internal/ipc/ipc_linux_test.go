@@ -0,0 +1,170 @@
+package ipc
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// nobody is a uid other than ours for the tests that need root
+const nobody = 65534
+
+func needRoot(t *testing.T) {
+	t.Helper()
+	if os.Getuid() != 0 {
+		t.Skip("needs root to act as another user")
+	}
+}
+
+func TestServerAcceptsOwnUser(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	server, err := NewIPCServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	server.RegisterHandler("ping", func([]byte) error { return nil })
+
+	if err := NewIPCClient().send("ping", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]os.FileMode{ipcDir(): 0700, socketPath(): 0600} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != want {
+			t.Errorf("%s has mode %o, want %o", path, mode, want)
+		}
+	}
+}
+
+func TestIPCDirPermissions(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	// A directory others can read is closed up
+	if err := os.MkdirAll(ipcDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(ipcDir(), 0755)
+	if err := ensureIPCDir(); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(ipcDir()); info.Mode().Perm() != 0700 {
+		t.Errorf("mode %o, want 700", info.Mode().Perm())
+	}
+
+	// One another user owns is refused
+	needRoot(t)
+	if err := os.Chown(ipcDir(), nobody, nobody); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureIPCDir(); err == nil || !strings.Contains(err.Error(), "owned by uid") {
+		t.Errorf("got %v, want an owner error", err)
+	}
+	if _, err := NewIPCServer(); err == nil {
+		t.Error("server started in a directory of another user")
+	}
+}
+
+// dialAs connects to path with the effective uid set to uid. Only the
+// dialing thread changes user, and it is never handed back to the runtime.
+func dialAs(path string, uid int) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		if _, _, errno := unix.RawSyscall(unix.SYS_SETRESUID, ^uintptr(0), uintptr(uid), ^uintptr(0)); errno != 0 {
+			done <- result{err: errno}
+			return
+		}
+		conn, err := net.Dial("unix", path)
+		done <- result{conn, err}
+	}()
+	r := <-done
+	return r.conn, r.err
+}
+
+func TestVerifyPeer(t *testing.T) {
+	needRoot(t)
+
+	// Open to everyone, so only the peer credentials keep others out.
+	// t.TempDir nests in a directory only we can enter.
+	dir, err := os.MkdirTemp("", "ipc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Chmod(dir, 0777)
+	path := filepath.Join(dir, socketName)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	os.Chmod(path, 0777)
+
+	for _, uid := range []int{0, nobody} {
+		conn, err := dialAs(path, uid)
+		if err != nil {
+			t.Fatalf("dial as %d: %v", uid, err)
+		}
+		accepted, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = verifyPeer(accepted)
+		if uid == 0 && err != nil {
+			t.Errorf("own user rejected: %v", err)
+		}
+		if uid == nobody && err == nil {
+			t.Error("uid 65534 accepted")
+		}
+		conn.Close()
+		accepted.Close()
+	}
+}
+
+func TestSessionToken(t *testing.T) {
+	// The check Windows relies on, run over a Unix socket
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), socketName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &IPCServer{
+		listener: listener,
+		handlers: make(map[string]func(data []byte) (interface{}, error)),
+		token:    "right",
+	}
+	server.running.Store(true)
+	defer server.Stop()
+	server.RegisterHandler("ping", func([]byte) error { return nil })
+	go server.acceptConnections()
+
+	for token, want := range map[string]bool{"right": true, "wrong": false, "": false} {
+		conn, err := net.Dial("unix", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewEncoder(conn).Encode(IPCMessage{Type: "ping", Token: token})
+		var response ipcResponse
+		if err := json.NewDecoder(conn).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if response.Success != want {
+			t.Errorf("token %q: got %+v", token, response)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package ipc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrAlreadyRunning is returned by AcquireInstanceLock when another
+// instance holds the lock
+var ErrAlreadyRunning = errors.New("application is already running")
+
+// InstanceLock is an exclusive, OS-level lock on the lock file. The OS
+// drops it when the process exits, so a crashed instance never leaves a
+// lock behind that blocks the next launch.
+type InstanceLock struct {
+	file *os.File
+}
+
+// AcquireInstanceLock takes the single-instance lock and records our PID
+// in it. If another live instance holds the lock, the returned error wraps
+// ErrAlreadyRunning and mentions that instance's PID.
+func AcquireInstanceLock() (*InstanceLock, error) {
+	path := GetLockFile()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if pid, perr := ReadLockPID(); perr == nil {
+			return nil, fmt.Errorf("%w (PID %d)", ErrAlreadyRunning, pid)
+		}
+		return nil, ErrAlreadyRunning
+	}
+
+	// The lock was free, so any PID still recorded belongs to a dead process
+	if pid, err := ReadLockPID(); err == nil && pid != os.Getpid() {
+		fmt.Printf("[IPC] Replacing stale lock left by PID %d\n", pid)
+	}
+
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+		f.Sync()
+	}
+
+	return &InstanceLock{file: f}, nil
+}
+
+// Release clears our PID and unlocks the lock file. The file itself stays:
+// removing it would let a process still waiting on the old file and one
+// creating a new file at the same path both get a lock.
+func (l *InstanceLock) Release() {
+	if l == nil || l.file == nil {
+		return
+	}
+	l.file.Truncate(0)
+	unlockFile(l.file)
+	l.file.Close()
+	l.file = nil
+}
+
+// ReadLockPID returns the PID recorded in the lock file
+func ReadLockPID() (int, error) {
+	data, err := os.ReadFile(GetLockFile())
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
@@ -0,0 +1,84 @@
+//go:build !windows
+
+package ipc
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The Unix socket is protected by file permissions and peer credentials,
+// so clients don't need to present a session token.
+const transportNeedsToken = false
+
+const socketName = "ipc.sock"
+
+// ipcDir returns a per-user directory for the IPC socket, preferring
+// $XDG_RUNTIME_DIR which is already private to the user on Linux.
+func ipcDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return instanceDir(filepath.Join(dir, "share-my-clipboard"))
+	}
+	return instanceDir(filepath.Join(os.TempDir(), fmt.Sprintf("share-my-clipboard-%d", os.Getuid())))
+}
+
+func socketPath() string {
+	return filepath.Join(ipcDir(), socketName)
+}
+
+// ensureIPCDir creates the IPC directory with 0700 permissions and refuses
+// to use a directory owned by another user.
+func ensureIPCDir() error {
+	dir := ipcDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if owner, ok := fileOwner(info); ok && owner != os.Getuid() {
+		return fmt.Errorf("%s is owned by uid %d", dir, owner)
+	}
+	return os.Chmod(dir, 0700)
+}
+
+func listenIPC() (net.Listener, error) {
+	if err := ensureIPCDir(); err != nil {
+		return nil, err
+	}
+
+	path := socketPath()
+	if _, err := os.Stat(path); err == nil {
+		// A socket nobody answers on is left over from a crashed instance
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another instance is listening on %s", path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+func dialIPC(timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("unix", socketPath(), timeout)
+}
+
+func cleanupIPC() {
+	os.Remove(socketPath())
+}
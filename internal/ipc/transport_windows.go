@@ -0,0 +1,38 @@
+package ipc
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Windows uses a loopback TCP port, which any local process can reach,
+// so every message must carry the session token.
+const transportNeedsToken = true
+
+// ipcDir returns a directory inside the user's profile for the token file
+func ipcDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return instanceDir(filepath.Join(dir, "share-my-clipboard"))
+	}
+	return instanceDir(filepath.Join(os.TempDir(), "share-my-clipboard"))
+}
+
+func listenIPC() (net.Listener, error) {
+	return net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ipcPort))
+}
+
+func dialIPC(timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", ipcPort), timeout)
+}
+
+// verifyPeer is a no-op on Windows; the session token authenticates clients
+func verifyPeer(conn net.Conn) error {
+	return nil
+}
+
+func cleanupIPC() {
+	os.Remove(tokenFilePath())
+}
@@ -0,0 +1,355 @@
+// Package metrics keeps counters for monitoring and serves them in the
+// Prometheus text format. The packages that count own their metrics;
+// this one only registers and writes them. Registering a name twice or
+// passing the wrong number of label values is a programming error and
+// panics, as metrics are declared once at package level.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultAddress is the usual address for the endpoint, reachable from
+// this machine only
+const DefaultAddress = "127.0.0.1:9464"
+
+// DurationBuckets are the histogram bounds for durations, in seconds
+var DurationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// metric is anything the registry can write
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]metric{}
+)
+
+func register(name string, m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, exists := registry[name]; exists {
+		panic("metrics: " + name + " registered twice")
+	}
+	registry[name] = m
+}
+
+// WriteTo writes every metric, ordered by name
+func WriteTo(w io.Writer) {
+	registryMu.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	registryMu.Unlock()
+
+	slices.Sort(names)
+	for _, name := range names {
+		registryMu.Lock()
+		m := registry[name]
+		registryMu.Unlock()
+		m.write(w)
+	}
+}
+
+// ---------- COUNTERS AND GAUGES ----------
+
+// Counter only goes up
+type Counter struct {
+	value atomic.Int64
+}
+
+// Gauge goes up and down
+type Gauge struct {
+	value atomic.Int64
+}
+
+func (c *Counter) Inc()           { c.value.Add(1) }
+func (c *Counter) Add(n int64)    { c.value.Add(n) }
+func (c *Counter) Value() int64   { return c.value.Load() }
+func (g *Gauge) Set(n int64)      { g.value.Store(n) }
+func (g *Gauge) Add(n int64)      { g.value.Add(n) }
+func (g *Gauge) Value() int64     { return g.value.Load() }
+func (c *Counter) sample() string { return strconv.FormatInt(c.value.Load(), 10) }
+func (g *Gauge) sample() string   { return strconv.FormatInt(g.value.Load(), 10) }
+
+// family is a metric name with one series per label combination
+type family[T any] struct {
+	name, help, kind string
+	labels           []string
+
+	mu     sync.Mutex
+	series map[string]*T
+	keys   map[string][]string
+}
+
+func newFamily[T any](name, help, kind string, labels []string) *family[T] {
+	return &family[T]{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: map[string]*T{},
+		keys:   map[string][]string{},
+	}
+}
+
+// with returns the series for the label values, creating it on first use
+func (f *family[T]) with(values []string) *T {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d labels, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = new(T)
+		f.series[key] = s
+		f.keys[key] = slices.Clone(values)
+	}
+	return s
+}
+
+// each calls fn for every series, ordered by label values
+func (f *family[T]) each(fn func(labels string, s *T)) {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	type entry struct {
+		labels string
+		s      *T
+	}
+	entries := make([]entry, len(keys))
+	for i, key := range keys {
+		entries[i] = entry{formatLabels(f.labels, f.keys[key]), f.series[key]}
+	}
+	f.mu.Unlock()
+
+	for _, e := range entries {
+		fn(e.labels, e.s)
+	}
+}
+
+func (f *family[T]) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, helpEscaper.Replace(f.help), f.name, f.kind)
+}
+
+// CounterVec is a counter per label combination
+type CounterVec struct{ f *family[Counter] }
+
+// GaugeVec is a gauge per label combination
+type GaugeVec struct{ f *family[Gauge] }
+
+// NewCounter registers a counter without labels
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help).With()
+}
+
+// NewCounterVec registers a counter with the given label names
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{newFamily[Counter](name, help, "counter", labels)}
+	if len(labels) == 0 {
+		v.With()
+	}
+	register(name, v)
+	return v
+}
+
+// NewGauge registers a gauge without labels
+func NewGauge(name, help string) *Gauge {
+	return NewGaugeVec(name, help).With()
+}
+
+// NewGaugeVec registers a gauge with the given label names
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{newFamily[Gauge](name, help, "gauge", labels)}
+	if len(labels) == 0 {
+		v.With()
+	}
+	register(name, v)
+	return v
+}
+
+// With returns the counter for the label values
+func (v *CounterVec) With(values ...string) *Counter { return v.f.with(values) }
+
+// With returns the gauge for the label values
+func (v *GaugeVec) With(values ...string) *Gauge { return v.f.with(values) }
+
+func (v *CounterVec) write(w io.Writer) {
+	v.f.header(w)
+	v.f.each(func(labels string, c *Counter) {
+		fmt.Fprintf(w, "%s%s %s\n", v.f.name, labels, c.sample())
+	})
+}
+
+func (v *GaugeVec) write(w io.Writer) {
+	v.f.header(w)
+	v.f.each(func(labels string, g *Gauge) {
+		fmt.Fprintf(w, "%s%s %s\n", v.f.name, labels, g.sample())
+	})
+}
+
+// ---------- HISTOGRAMS ----------
+
+// Histogram counts observations into buckets
+type Histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// Observe records one value
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(h.bounds))
+	}
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// ObserveDuration records a duration in seconds
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// HistogramVec is a histogram per label combination
+type HistogramVec struct {
+	f      *family[Histogram]
+	bounds []float64
+}
+
+// NewHistogramVec registers a histogram with the given bucket bounds
+// and label names
+func NewHistogramVec(name, help string, bounds []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{newFamily[Histogram](name, help, "histogram", labels), slices.Sorted(slices.Values(bounds))}
+	if len(labels) == 0 {
+		v.With()
+	}
+	register(name, v)
+	return v
+}
+
+// With returns the histogram for the label values
+func (v *HistogramVec) With(values ...string) *Histogram {
+	h := v.f.with(values)
+	h.mu.Lock()
+	if h.bounds == nil {
+		h.bounds = v.bounds
+	}
+	h.mu.Unlock()
+	return h
+}
+
+func (v *HistogramVec) write(w io.Writer) {
+	v.f.header(w)
+	v.f.each(func(labels string, h *Histogram) {
+		h.mu.Lock()
+		buckets := slices.Clone(h.buckets)
+		count, sum := h.count, h.sum
+		h.mu.Unlock()
+
+		for i, bound := range v.bounds {
+			var n uint64
+			if i < len(buckets) {
+				n = buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.f.name, withLabel(labels, "le", formatFloat(bound)), n)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.f.name, withLabel(labels, "le", "+Inf"), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.f.name, labels, formatFloat(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.f.name, labels, count)
+	})
+}
+
+// ---------- TEXT FORMAT ----------
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel appends one more label to formatted labels
+func withLabel(labels, name, value string) string {
+	pair := name + `="` + labelEscaper.Replace(value) + `"`
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// ---------- ENDPOINT ----------
+
+// Handler serves the metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	})
+}
+
+// Serve starts the endpoint on addr in the background. The returned
+// server is shut down with Close.
+func Serve(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for metrics on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("[METRICS] Server stopped: %v\n", err)
+		}
+	}()
+	fmt.Printf("[METRICS] Serving metrics on http://%s/metrics\n", listener.Addr())
+	return server, nil
+}
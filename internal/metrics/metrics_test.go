@@ -0,0 +1,129 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func output(m metric) string {
+	var b strings.Builder
+	m.write(&b)
+	return b.String()
+}
+
+func TestCounterVecOutput(t *testing.T) {
+	v := NewCounterVec("test_requests_total", "Requests by type\nand result, with a \\ in it", "type", "result")
+	v.With("send", "ok").Add(3)
+	v.With("queue", "error").Inc()
+	v.With("send", "error").Inc()
+	v.With(`quote " back\slash`+"\nnewline", "ok").Inc()
+
+	want := `# HELP test_requests_total Requests by type\nand result, with a \\ in it
+# TYPE test_requests_total counter
+test_requests_total{type="queue",result="error"} 1
+test_requests_total{type="quote \" back\\slash\nnewline",result="ok"} 1
+test_requests_total{type="send",result="error"} 1
+test_requests_total{type="send",result="ok"} 3
+`
+	if got := output(v); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestUnlabeledOutput(t *testing.T) {
+	counter := NewCounterVec("test_mismatches_total", "Mismatches")
+	gauge := NewGaugeVec("test_peers", "Peers")
+	gauge.With().Set(4)
+	gauge.With().Add(-1)
+
+	if got, want := output(counter), "# HELP test_mismatches_total Mismatches\n# TYPE test_mismatches_total counter\ntest_mismatches_total 0\n"; got != want {
+		t.Errorf("counter: got %q, want %q", got, want)
+	}
+	if got, want := output(gauge), "# HELP test_peers Peers\n# TYPE test_peers gauge\ntest_peers 3\n"; got != want {
+		t.Errorf("gauge: got %q, want %q", got, want)
+	}
+}
+
+func TestHistogramOutput(t *testing.T) {
+	v := NewHistogramVec("test_duration_seconds", "Durations", []float64{1, 0.5, 10}, "direction")
+	v.With("sent").ObserveDuration(700 * time.Millisecond)
+	v.With("sent").Observe(0.5)
+	v.With("sent").Observe(100)
+	v.With("received")
+
+	want := `# HELP test_duration_seconds Durations
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{direction="received",le="0.5"} 0
+test_duration_seconds_bucket{direction="received",le="1"} 0
+test_duration_seconds_bucket{direction="received",le="10"} 0
+test_duration_seconds_bucket{direction="received",le="+Inf"} 0
+test_duration_seconds_sum{direction="received"} 0
+test_duration_seconds_count{direction="received"} 0
+test_duration_seconds_bucket{direction="sent",le="0.5"} 1
+test_duration_seconds_bucket{direction="sent",le="1"} 2
+test_duration_seconds_bucket{direction="sent",le="10"} 2
+test_duration_seconds_bucket{direction="sent",le="+Inf"} 3
+test_duration_seconds_sum{direction="sent"} 101.2
+test_duration_seconds_count{direction="sent"} 3
+`
+	if got := output(v); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestUnlabeledHistogramOutput(t *testing.T) {
+	v := NewHistogramVec("test_wait_seconds", "Waits", []float64{0.1})
+	v.With().Observe(0.05)
+
+	want := `# HELP test_wait_seconds Waits
+# TYPE test_wait_seconds histogram
+test_wait_seconds_bucket{le="0.1"} 1
+test_wait_seconds_bucket{le="+Inf"} 1
+test_wait_seconds_sum 0.05
+test_wait_seconds_count 1
+`
+	if got := output(v); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHandlerWritesRegistryByName(t *testing.T) {
+	NewCounter("test_zz_last_total", "Last").Inc()
+	NewGauge("test_aa_first", "First").Set(1)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("content type %q", ct)
+	}
+	body := rec.Body.String()
+	first, last := strings.Index(body, "# HELP test_aa_first"), strings.Index(body, "# HELP test_zz_last_total")
+	if first < 0 || last < 0 || first > last {
+		t.Errorf("metrics missing or out of order:\n%s", body)
+	}
+	if !strings.Contains(body, "\ntest_zz_last_total 1\n") {
+		t.Errorf("missing sample:\n%s", body)
+	}
+}
+
+func TestMisuse(t *testing.T) {
+	for name, misuse := range map[string]func(){
+		"wrong label count": func() { NewCounterVec("test_misuse_total", "Misuse", "a").With("x", "y") },
+		"registered twice": func() {
+			NewGauge("test_twice", "Twice")
+			NewGauge("test_twice", "Twice")
+		},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: no panic", name)
+				}
+			}()
+			misuse()
+		}()
+	}
+}
@@ -0,0 +1,208 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"slices"
+)
+
+// AppVersion is set at build time with
+// -ldflags "-X github.com/Krasnovvvvv/share-my-clipboard/internal/network.AppVersion=1.2.3"
+var AppVersion = "dev"
+
+const (
+	// ProtocolVersion is bumped when the wire protocol changes. Version 1
+	// is the original protocol that announced a bare hostname.
+	ProtocolVersion = 2
+
+	// discoveryVersion is the version of the discovery payload layout
+	discoveryVersion = 1
+)
+
+// Capabilities announced in discovery
+const (
+	CapRichText     = "rich-text"
+	CapFileList     = "file-list"
+	CapChunkedText  = "chunked-text"
+	CapRelay        = "relay"
+	CapGroups       = "groups"
+	CapOfflineQueue = "offline-queue"
+	CapPrimary      = "primary-selection"
+)
+
+// DeviceInfo describes a device as announced in discovery
+type DeviceInfo struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	OS           string   `json:"os"`
+	AppVersion   string   `json:"app_version"`
+	Protocol     int      `json:"protocol"`
+	Port         int      `json:"port"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Groups       []string `json:"groups,omitempty"` // tags, see groupTag
+
+	// Fingerprint identifies the device key, see KeyFingerprint
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// discoveryPayload is the versioned announcement sent with peerdiscovery.
+// The mDNS backend carries the same fields in TXT records.
+type discoveryPayload struct {
+	Version int `json:"v"`
+	DeviceInfo
+}
+
+// SetDeviceID sets the persistent ID this device announces
+func (c *ConnectionManager) SetDeviceID(id string) {
+	c.mu.Lock()
+	c.deviceID = id
+	c.mu.Unlock()
+}
+
+// SetDeviceKey sets the public key whose fingerprint this device announces
+func (c *ConnectionManager) SetDeviceKey(key ed25519.PublicKey) {
+	c.mu.Lock()
+	c.fingerprint = KeyFingerprint(key)
+	c.mu.Unlock()
+}
+
+// KeyFingerprint is the hex SHA-256 of a device's public key
+func KeyFingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
+
+// SetCapabilities sets the optional features this device announces in
+// addition to the ones every current version has
+func (c *ConnectionManager) SetCapabilities(capabilities ...string) {
+	c.mu.Lock()
+	c.capabilities = capabilities
+	c.mu.Unlock()
+}
+
+// DeviceInfo returns what this device announces about itself
+func (c *ConnectionManager) DeviceInfo() DeviceInfo {
+	groups := c.groupTags()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	capabilities := []string{CapRichText, CapFileList, CapChunkedText, CapRelay, CapGroups}
+	if c.queue != nil {
+		capabilities = append(capabilities, CapOfflineQueue)
+	}
+	capabilities = append(capabilities, c.capabilities...)
+
+	return DeviceInfo{
+		ID:           c.deviceID,
+		Name:         c.hostname,
+		OS:           runtime.GOOS,
+		AppVersion:   AppVersion,
+		Protocol:     ProtocolVersion,
+		Port:         c.listen.Port,
+		Capabilities: capabilities,
+		Groups:       groups,
+		Fingerprint:  c.fingerprint,
+	}
+}
+
+func encodeDiscoveryPayload(info DeviceInfo) []byte {
+	data, _ := json.Marshal(discoveryPayload{Version: discoveryVersion, DeviceInfo: info})
+	return data
+}
+
+// parseDiscoveryPayload decodes an announcement. Old versions sent the
+// bare hostname, which becomes a protocol 1 device with only a name.
+func parseDiscoveryPayload(data []byte) DeviceInfo {
+	var payload discoveryPayload
+	if err := json.Unmarshal(data, &payload); err != nil || payload.Name == "" {
+		return DeviceInfo{Name: string(data), Protocol: 1, Port: DefaultPort}
+	}
+	if payload.Port == 0 {
+		payload.Port = DefaultPort
+	}
+	return payload.DeviceInfo
+}
+
+// HasCapability reports whether the device announced a feature
+func (d Device) HasCapability(capability string) bool {
+	return slices.Contains(d.Capabilities, capability)
+}
+
+// Summary is a one-line description of the device's platform and version
+func (d Device) Summary() string {
+	if d.Protocol < 2 {
+		return "older version"
+	}
+	return fmt.Sprintf("%s · v%s · protocol %d", d.OS, d.AppVersion, d.Protocol)
+}
+
+// ConnectedAddress returns the address we are connected to the device on,
+// which need not be the one it was listed with. Empty when not connected.
+func (c *ConnectionManager) ConnectedAddress(d Device) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if state, ok := c.connections[d.Key()]; ok {
+		return state.ip
+	}
+	if d.ID != "" {
+		return ""
+	}
+
+	// Peers too old to announce an ID are filed under the address they
+	// connected from. Another device on one of them is not this one.
+	for _, peer := range d.Addresses {
+		if state, ok := c.connections[peer]; ok {
+			return state.ip
+		}
+	}
+	return ""
+}
+
+// addressRank orders addresses by how widely they work: IPv4, then
+// routable IPv6, then link-local IPv6
+func addressRank(addr string) int {
+	ip := parseIP(addr)
+	switch {
+	case ip == nil:
+		return 3
+	case ip.To4() != nil:
+		return 0
+	case ip.IsLinkLocalUnicast():
+		return 2
+	default:
+		return 1
+	}
+}
+
+// bestAddress returns the address of addrs to list a device with
+func bestAddress(addrs []string) string {
+	best := ""
+	for _, addr := range addrs {
+		if best == "" || addressRank(addr) < addressRank(best) {
+			best = addr
+		}
+	}
+	return best
+}
+
+// sameAs compares everything a scan can change
+func (d Device) sameAs(other Device) bool {
+	return d.IP == other.IP &&
+		slices.Equal(d.Addresses, other.Addresses) &&
+		d.Name == other.Name &&
+		d.MAC == other.MAC &&
+		d.ID == other.ID &&
+		d.OS == other.OS &&
+		d.AppVersion == other.AppVersion &&
+		d.Protocol == other.Protocol &&
+		d.Port == other.Port &&
+		d.Fingerprint == other.Fingerprint &&
+		slices.Equal(d.Capabilities, other.Capabilities) &&
+		slices.Equal(d.Groups, other.Groups)
+}
@@ -0,0 +1,361 @@
+package network
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/peerdiscovery"
+)
+
+// Discovery backends, as named in the config file
+const (
+	BackendMulticast = "multicast"
+	BackendMDNS      = "mdns"
+)
+
+const (
+	// scanTimeout is how long a scan waits for devices to answer
+	scanTimeout = 3 * time.Second
+
+	// scanInterval is the pause between two scans of a backend
+	scanInterval = 4 * time.Second
+
+	// DefaultLostAfter is how long a device may go unseen before it is
+	// removed. It spans a few scans, so one missed answer doesn't drop it.
+	DefaultLostAfter = 15 * time.Second
+)
+
+// DiscoveryEventType says what happened to a device
+type DiscoveryEventType int
+
+const (
+	DeviceAdded DiscoveryEventType = iota
+	DeviceUpdated
+	DeviceLost
+)
+
+func (t DiscoveryEventType) String() string {
+	switch t {
+	case DeviceAdded:
+		return "added"
+	case DeviceUpdated:
+		return "updated"
+	default:
+		return "lost"
+	}
+}
+
+// DiscoveryEvent reports a change to DeviceStore.Devices
+type DiscoveryEvent struct {
+	Type   DiscoveryEventType
+	Device Device
+}
+
+// Discovered is a device found by one backend
+type Discovered struct {
+	IP   string
+	Info DeviceInfo
+}
+
+// Discoverer finds devices on the local network
+type Discoverer interface {
+	// Name is the backend name used in the config file
+	Name() string
+
+	// Discover announces self and returns the devices that answered
+	// within timeout
+	Discover(self DeviceInfo, timeout time.Duration) ([]Discovered, error)
+
+	// Close withdraws announcements that outlive a scan
+	Close() error
+}
+
+// NewDiscoverers returns the named backends. No names means all of them.
+// With an interface allowlist, mDNS runs on the allowed interfaces and
+// multicast is left out, as peerdiscovery sends on every interface.
+func NewDiscoverers(names, interfaces []string) ([]Discoverer, error) {
+	if len(names) == 0 {
+		names = []string{BackendMulticast, BackendMDNS}
+	}
+	if len(interfaces) > 0 && len(allowedInterfaces(interfaces)) == 0 {
+		return nil, fmt.Errorf("none of the interfaces %v is up", interfaces)
+	}
+
+	backends := []Discoverer{}
+	for _, name := range names {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case BackendMulticast:
+			if len(interfaces) > 0 {
+				fmt.Println("[NET] Multicast discovery can't be limited to interfaces, leaving it off")
+				continue
+			}
+			backends = append(backends, multicastDiscoverer{})
+		case BackendMDNS:
+			backends = append(backends, &mdnsDiscoverer{interfaces: interfaces})
+		default:
+			return nil, fmt.Errorf("unknown discovery backend %q", name)
+		}
+	}
+	return backends, nil
+}
+
+// multicastDiscoverer uses the peerdiscovery UDP multicast protocol that
+// all versions of the app speak. IPv4 and IPv6 are scanned side by side.
+type multicastDiscoverer struct{}
+
+func (multicastDiscoverer) Name() string { return BackendMulticast }
+
+func (multicastDiscoverer) Discover(self DeviceInfo, timeout time.Duration) ([]Discovered, error) {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		found   []Discovered
+		ipv4Err error
+	)
+	for _, version := range []peerdiscovery.IPVersion{peerdiscovery.IPv4, peerdiscovery.IPv6} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			discoveries, err := peerdiscovery.Discover(peerdiscovery.Settings{
+				Limit:     -1,
+				Payload:   encodeDiscoveryPayload(self),
+				Port:      fmt.Sprintf("%d", DefaultPort),
+				TimeLimit: timeout,
+				IPVersion: version,
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			// Many networks have no IPv6; that alone isn't worth reporting
+			if err != nil && version == peerdiscovery.IPv4 {
+				ipv4Err = err
+			}
+			for _, d := range discoveries {
+				found = append(found, Discovered{IP: d.Address, Info: parseDiscoveryPayload(d.Payload)})
+			}
+		}()
+	}
+	wg.Wait()
+	return found, ipv4Err
+}
+
+func (multicastDiscoverer) Close() error { return nil }
+
+// ---------- BACKGROUND DISCOVERY ----------
+
+// Start runs every backend in the background until Close. Each backend
+// scans on its own schedule, so a slow one doesn't hold up the others.
+// self is asked for the current announcement before every scan.
+func (s *DeviceStore) Start(self func() DeviceInfo) <-chan DiscoveryEvent {
+	backends := s.backends()
+
+	s.DevicesMu.Lock()
+	s.lastSeen = make(map[string]map[string]time.Time)
+	s.events = make(chan DiscoveryEvent, 64)
+	s.stop = make(chan struct{})
+	s.refresh = make([]chan struct{}, len(backends))
+	for i := range s.refresh {
+		s.refresh[i] = make(chan struct{}, 1)
+	}
+	stop := s.stop
+	s.DevicesMu.Unlock()
+
+	for i, backend := range backends {
+		go s.runBackend(backend, self, s.refresh[i], stop)
+	}
+	go s.expire(stop)
+	return s.events
+}
+
+// Refresh makes every backend scan right away
+func (s *DeviceStore) Refresh() {
+	for _, refresh := range s.refresh {
+		select {
+		case refresh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close stops discovery and the backends
+func (s *DeviceStore) Close() {
+	s.DevicesMu.Lock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	s.DevicesMu.Unlock()
+
+	for _, backend := range s.backends() {
+		if err := backend.Close(); err != nil {
+			fmt.Printf("[NET] Failed to stop %s discovery: %v\n", backend.Name(), err)
+		}
+	}
+}
+
+func (s *DeviceStore) backends() []Discoverer {
+	if s.Backends == nil {
+		return []Discoverer{multicastDiscoverer{}}
+	}
+	return s.Backends
+}
+
+func (s *DeviceStore) runBackend(backend Discoverer, self func() DeviceInfo, refresh, stop chan struct{}) {
+	lastErr := ""
+	for {
+		info := self()
+		found, err := backend.Discover(info, scanTimeout)
+
+		// Failing backends retry every round; only log what changed
+		if errText := fmt.Sprint(err); err != nil && errText != lastErr {
+			fmt.Printf("[NET] %s discovery failed: %v\n", backend.Name(), err)
+			lastErr = errText
+		} else if err == nil {
+			lastErr = ""
+		}
+		s.observe(info.ID, found, stop)
+
+		select {
+		case <-stop:
+			return
+		case <-refresh:
+		case <-time.After(scanInterval):
+		}
+	}
+}
+
+// observe records the devices one backend found
+func (s *DeviceStore) observe(selfID string, found []Discovered, stop chan struct{}) {
+	now := time.Now()
+	var events []DiscoveryEvent
+
+	s.DevicesMu.Lock()
+	for _, d := range found {
+		if isIgnoredIP(d.IP) || (selfID != "" && d.Info.ID == selfID) {
+			continue
+		}
+
+		// Devices are told apart by ID, so one with Ethernet and Wi-Fi or
+		// IPv4 and IPv6 addresses is listed once, and two instances on one
+		// host twice. Old versions without an ID are told apart by address.
+		i := slices.IndexFunc(s.Devices, func(existing Device) bool {
+			if d.Info.ID != "" {
+				return existing.ID == d.Info.ID
+			}
+			return existing.ID == "" && existing.IP == d.IP && existing.Port == d.Info.Port
+		})
+		if i < 0 {
+			dev := Device{
+				DeviceInfo: d.Info,
+				IP:         d.IP,
+				MAC:        getMACForIP(d.IP),
+				Addresses:  []string{d.IP},
+			}
+			s.seenLocked(dev.Key(), d.IP, now)
+			s.Devices = append(s.Devices, dev)
+			events = append(events, DiscoveryEvent{Type: DeviceAdded, Device: dev})
+			continue
+		}
+
+		dev := s.Devices[i]
+		s.seenLocked(dev.Key(), d.IP, now)
+		// A bare hostname from an old-style answer doesn't replace the
+		// details another backend found
+		if d.Info.Protocol >= dev.Protocol {
+			dev.DeviceInfo = d.Info
+		}
+		if !slices.Contains(dev.Addresses, d.IP) {
+			dev.Addresses = append(slices.Clone(dev.Addresses), d.IP)
+			if best := bestAddress(dev.Addresses); best != dev.IP {
+				dev.IP = best
+				dev.MAC = getMACForIP(best)
+			}
+		}
+		if !s.Devices[i].sameAs(dev) {
+			s.Devices[i] = dev
+			events = append(events, DiscoveryEvent{Type: DeviceUpdated, Device: dev})
+		}
+	}
+	discoveredDevices.Set(int64(len(s.Devices)))
+	s.DevicesMu.Unlock()
+
+	s.emit(events, stop)
+}
+
+// seenLocked records that a device answered on an address
+func (s *DeviceStore) seenLocked(key, ip string, now time.Time) {
+	if s.lastSeen[key] == nil {
+		s.lastSeen[key] = make(map[string]time.Time)
+	}
+	s.lastSeen[key][ip] = now
+}
+
+// expire removes addresses and devices no backend has seen for LostAfter
+func (s *DeviceStore) expire(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		s.emit(s.sweep(), stop)
+	}
+}
+
+// sweep drops what went unseen for LostAfter and returns the changes
+func (s *DeviceStore) sweep() []DiscoveryEvent {
+	lostAfter := s.LostAfter
+	if lostAfter <= 0 {
+		lostAfter = DefaultLostAfter
+	}
+
+	var events []DiscoveryEvent
+	s.DevicesMu.Lock()
+	kept := make([]Device, 0, len(s.Devices))
+	for _, dev := range s.Devices {
+		// Addresses expire one by one; the device goes with the last
+		seen := s.lastSeen[dev.Key()]
+		fresh := slices.DeleteFunc(slices.Clone(dev.Addresses), func(ip string) bool {
+			if time.Since(seen[ip]) < lostAfter {
+				return false
+			}
+			delete(seen, ip)
+			return true
+		})
+		switch {
+		case len(fresh) == 0:
+			delete(s.lastSeen, dev.Key())
+			events = append(events, DiscoveryEvent{Type: DeviceLost, Device: dev})
+			continue
+		case len(fresh) < len(dev.Addresses):
+			dev.Addresses = fresh
+			if !slices.Contains(fresh, dev.IP) {
+				dev.IP = bestAddress(fresh)
+				dev.MAC = getMACForIP(dev.IP)
+			}
+			events = append(events, DiscoveryEvent{Type: DeviceUpdated, Device: dev})
+		}
+		kept = append(kept, dev)
+	}
+	s.Devices = kept
+	discoveredDevices.Set(int64(len(kept)))
+	s.DevicesMu.Unlock()
+	return events
+}
+
+func (s *DeviceStore) emit(events []DiscoveryEvent, stop chan struct{}) {
+	for _, event := range events {
+		discoveryEvents.With(event.Type.String()).Inc()
+		select {
+		case s.events <- event:
+		case <-stop:
+			return
+		}
+	}
+}
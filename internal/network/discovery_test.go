@@ -0,0 +1,89 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestStore returns a store that takes observations without running
+// any backend
+func newTestStore() *DeviceStore {
+	return &DeviceStore{
+		lastSeen: make(map[string]map[string]time.Time),
+		events:   make(chan DiscoveryEvent, 64),
+		stop:     make(chan struct{}),
+	}
+}
+
+func found(ip, id string, port int) Discovered {
+	return Discovered{IP: ip, Info: DeviceInfo{ID: id, Name: "host", Protocol: 2, Port: port}}
+}
+
+func TestTwoInstancesOnOneHost(t *testing.T) {
+	s := newTestStore()
+	s.observe("", []Discovered{found("192.0.2.1", "", 54322), found("192.0.2.1", "", 54422)}, s.stop)
+	if len(s.Devices) != 2 {
+		t.Fatalf("%d devices without IDs on two ports, want 2", len(s.Devices))
+	}
+
+	// One device answering on two addresses is listed once
+	s = newTestStore()
+	s.observe("", []Discovered{found("192.0.2.1", "a", 54322), found("2001:db8::1", "a", 54322)}, s.stop)
+	if len(s.Devices) != 1 || len(s.Devices[0].Addresses) != 2 {
+		t.Fatalf("got %+v", s.Devices)
+	}
+	if seen := s.lastSeen["a"]; len(seen) != 2 {
+		t.Errorf("last seen %v, want both addresses", seen)
+	}
+}
+
+func drain(s *DeviceStore) (events []string) {
+	for {
+		select {
+		case e := <-s.events:
+			events = append(events, e.Type.String()+" "+e.Device.Key())
+		default:
+			return events
+		}
+	}
+}
+
+func TestTwoIDsOnOneAddress(t *testing.T) {
+	s := newTestStore()
+	both := []Discovered{found("192.0.2.1", "a", 54322), found("192.0.2.1", "b", 54422)}
+
+	s.observe("", both, s.stop)
+	if got := drain(s); len(got) != 2 || got[0] != "added a" || got[1] != "added b" {
+		t.Fatalf("events %v", got)
+	}
+
+	// Answers from both on the shared address change nothing
+	s.observe("", both, s.stop)
+	s.observe("", both[1:], s.stop)
+	if got := drain(s); len(got) != 0 {
+		t.Fatalf("events %v", got)
+	}
+
+	// b going quiet loses b, even though a still answers on its address
+	s.LostAfter = time.Minute
+	s.lastSeen["b"]["192.0.2.1"] = time.Now().Add(-2 * time.Minute)
+	s.emit(s.sweep(), s.stop)
+	if got := drain(s); len(got) != 1 || got[0] != "lost b" {
+		t.Fatalf("events %v", got)
+	}
+	if len(s.Devices) != 1 || s.Devices[0].ID != "a" {
+		t.Fatalf("devices %+v", s.Devices)
+	}
+
+	// b's name and connection don't rub off on a
+	s.observe("", both[1:], s.stop)
+	s.Devices[1].Name = "other"
+	if name := s.FindName("b"); name != "other" {
+		t.Errorf("name of b: %q", name)
+	}
+	c := newBareManager()
+	c.connections["b"] = &ConnectionState{key: "b", ip: "192.0.2.1"}
+	if addr := c.ConnectedAddress(s.Devices[0]); addr != "" {
+		t.Errorf("a counts as connected on %s", addr)
+	}
+}
@@ -0,0 +1,380 @@
+package network
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultGroup holds devices that joined no group, and peers too old to
+// announce their groups. It keeps ungrouped setups sharing as before.
+const DefaultGroup = "default"
+
+// HelloMessage is sent by both sides of a new connection, and again when
+// the local groups change
+type HelloMessage struct {
+	FromIP string `json:"from_ip"`
+	Name   string `json:"name"`
+
+	// Port is where the sender accepts connections. With FromIP it
+	// settles simultaneous connects between devices without IDs, see
+	// winsTieLocked.
+	Port int `json:"port,omitempty"`
+
+	// Groups holds the tags of the sender's groups, see groupTag
+	Groups []string `json:"groups"`
+
+	// Nonce is fresh for every connection. Proofs show the sender knows
+	// the secrets of its groups, bound to the peer's nonce; see
+	// helloProofs. Answer marks the dialer's reply to the accepting side's
+	// hello, which completes the handshake.
+	Nonce  string   `json:"nonce,omitempty"`
+	Proofs []string `json:"proofs,omitempty"`
+	Answer bool     `json:"answer,omitempty"`
+
+	// Peers lists the device IDs the sender is connected to, so relays
+	// skip them; see relay.go
+	Peers []string `json:"peers,omitempty"`
+
+	// DeviceID ties the connection to the device, whichever of its
+	// addresses it came from
+	DeviceID string `json:"device_id,omitempty"`
+
+	// Reject answers a dialer whose connection lost to one we already
+	// have; the socket is closed right after. See handshake.go.
+	Reject bool `json:"reject,omitempty"`
+}
+
+// NormalizeGroups trims, lowercases and dedups group names. No groups at
+// all means DefaultGroup.
+func NormalizeGroups(groups []string) []string {
+	var normalized []string
+	for _, group := range groups {
+		group = strings.ToLower(strings.TrimSpace(group))
+		if group != "" && !slices.Contains(normalized, group) {
+			normalized = append(normalized, group)
+		}
+	}
+	if len(normalized) == 0 {
+		return []string{DefaultGroup}
+	}
+	slices.Sort(normalized)
+	return normalized
+}
+
+// SharedGroups returns the groups found in both a and b
+func SharedGroups(a, b []string) []string {
+	a, b = NormalizeGroups(a), NormalizeGroups(b)
+	var shared []string
+	for _, group := range a {
+		if slices.Contains(b, group) {
+			shared = append(shared, group)
+		}
+	}
+	return shared
+}
+
+// SetGroups changes the groups this device belongs to, with the secrets
+// of those that have one, and tells all connected peers
+func (c *ConnectionManager) SetGroups(groups []string, secrets map[string]string) {
+	byName := make(map[string]string, len(secrets))
+	for name, secret := range secrets {
+		byName[NormalizeGroups([]string{name})[0]] = strings.TrimSpace(secret)
+	}
+
+	c.mu.Lock()
+	c.groups = NormalizeGroups(groups)
+	c.joinedGroups = nil
+	for _, name := range c.groups {
+		secret := byName[name]
+		if name == DefaultGroup {
+			secret = ""
+		}
+		c.joinedGroups = append(c.joinedGroups, joinedGroup{name, secret, groupTag(name, secret)})
+	}
+	states := make([]*ConnectionState, 0, len(c.connections))
+	for _, state := range c.connections {
+		states = append(states, state)
+	}
+	c.mu.Unlock()
+
+	for _, state := range states {
+		c.sendHello(state, false)
+	}
+}
+
+// Groups returns the names of the groups this device belongs to
+func (c *ConnectionManager) Groups() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return NormalizeGroups(c.groups)
+}
+
+// PeerGroups returns the names of our groups a connected peer is in
+func (c *ConnectionManager) PeerGroups(peer string) []string {
+	c.mu.RLock()
+	state, exists := c.connections[peer]
+	c.mu.RUnlock()
+	if !exists {
+		return nil
+	}
+	return c.GroupNames(c.peerGroups(state))
+}
+
+// peerGroups returns the tags of the groups a peer is counted in
+func (c *ConnectionManager) peerGroups(state *ConnectionState) []string {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	return NormalizeGroups(state.groups)
+}
+
+// scopeFor returns the groups a message to this peer is scoped to; empty
+// when the peer shares none of ours
+func (c *ConnectionManager) scopeFor(state *ConnectionState) []string {
+	return SharedGroups(c.groupTags(), c.peerGroups(state))
+}
+
+func (c *ConnectionManager) sendHello(state *ConnectionState, answer bool) {
+	state.mu.RLock()
+	nonce, peerNonce := state.nonce, state.peerNonce
+	state.mu.RUnlock()
+
+	hello := HelloMessage{
+		FromIP: c.LocalIP,
+		Port:   c.listen.Port,
+		Name:   c.hostname,
+		Groups: c.groupTags(),
+		Nonce:  nonce,
+		Proofs: c.helloProofs(nonce, peerNonce),
+		Answer: answer,
+		Peers:  c.connectedIDs(),
+	}
+	c.mu.RLock()
+	hello.DeviceID = c.deviceID
+	c.mu.RUnlock()
+
+	msg := Message{Type: MsgTypeHello}
+	msg.Data, _ = json.Marshal(hello)
+
+	select {
+	case state.writeChan <- msg:
+	case <-state.closeChan:
+	case <-time.After(1 * time.Second):
+	}
+}
+
+func (c *ConnectionManager) handleHello(state *ConnectionState, hello HelloMessage) {
+	if hello.Reject {
+		fmt.Printf("[NET] %s kept its own connection to us\n", state.ip)
+		state.markReplaced()
+		state.shutdown()
+		state.conn.Close()
+		return
+	}
+	if hello.DeviceID != "" && !c.rekey(state, hello.DeviceID) {
+		return
+	}
+
+	state.mu.Lock()
+	first := state.peerNonce == "" && hello.Nonce != ""
+	if first {
+		state.peerNonce = hello.Nonce
+	}
+	nonce, peerNonce := state.nonce, state.peerNonce
+	state.mu.Unlock()
+
+	groups := c.provenGroups(NormalizeGroups(hello.Groups), hello.Proofs, nonce, peerNonce)
+
+	state.mu.Lock()
+	state.groups = groups
+	state.deviceID = hello.DeviceID
+	state.peerName = hello.Name
+	state.peers = hello.Peers
+	state.mu.Unlock()
+
+	// The accepting side's hello confirms a connection we dialed, and our
+	// answer proves our groups in turn. The answer confirms it for the
+	// accepting side.
+	if state.isHub {
+		if first {
+			c.sendHello(state, true)
+		}
+		c.confirm(state)
+	} else if hello.Answer {
+		c.confirm(state)
+	}
+
+	if c.OnPeerGroups != nil {
+		c.OnPeerGroups(state.peer(), c.GroupNames(groups))
+	}
+}
+
+// ---------- GROUP SECRETS ----------
+
+// Group names never leave the device. Discovery, requests and messages
+// carry a tag per group instead, and members prove to each other that
+// they know a group's secret without sending it. Only a proven group lets
+// a device in without asking. DefaultGroup keeps its name, so ungrouped
+// setups still match older versions.
+
+// requestProofWindow is how far a connection request's time may be off
+const requestProofWindow = 2 * time.Minute
+
+// joinedGroup is a group this device belongs to
+type joinedGroup struct {
+	name, secret, tag string
+}
+
+// groupMAC authenticates the joined parts with a group's secret
+func groupMAC(secret string, parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(parts, "|")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// containsMAC compares in constant time, so a peer can't guess a proof
+// byte by byte
+func containsMAC(macs []string, want string) bool {
+	found := false
+	for _, mac := range macs {
+		if hmac.Equal([]byte(mac), []byte(want)) {
+			found = true
+		}
+	}
+	return found
+}
+
+// groupTag is how a group appears to other devices. With a secret only
+// members can compute it; without one, anyone who guesses the name can.
+func groupTag(name, secret string) string {
+	if name == DefaultGroup {
+		return DefaultGroup
+	}
+	return groupMAC(secret, "smc-group", name)[:16]
+}
+
+func (c *ConnectionManager) joined() []joinedGroup {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.joinedGroups == nil {
+		return []joinedGroup{{DefaultGroup, "", DefaultGroup}}
+	}
+	return c.joinedGroups
+}
+
+// groupTags returns the tags of the groups this device belongs to
+func (c *ConnectionManager) groupTags() []string {
+	var tags []string
+	for _, g := range c.joined() {
+		tags = append(tags, g.tag)
+	}
+	return NormalizeGroups(tags)
+}
+
+// GroupNames returns the names of our groups among the given tags, e.g.
+// those a discovered device announced
+func (c *ConnectionManager) GroupNames(tags []string) []string {
+	var names []string
+	for _, g := range c.joined() {
+		if slices.Contains(tags, g.tag) {
+			names = append(names, g.name)
+		}
+	}
+	return names
+}
+
+// SharesSecretGroup reports whether tags name one of our groups that has
+// a secret. Only a hint for whom to ask; membership is proven later.
+func (c *ConnectionManager) SharesSecretGroup(tags []string) bool {
+	for _, g := range c.joined() {
+		if g.secret != "" && slices.Contains(tags, g.tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// helloProofs proves membership of our groups with a secret to the peer
+// that sent peerNonce
+func (c *ConnectionManager) helloProofs(nonce, peerNonce string) []string {
+	if peerNonce == "" {
+		return nil
+	}
+	var proofs []string
+	for _, g := range c.joined() {
+		if g.secret != "" {
+			proofs = append(proofs, groupMAC(g.secret, "smc-hello", g.tag, peerNonce, nonce))
+		}
+	}
+	return proofs
+}
+
+// provenGroups returns the claimed tags a peer counts as a member of. Our
+// groups with a secret need a proof bound to our nonce; other tags are
+// taken on the peer's word, as they grant nothing a stranger can't get.
+func (c *ConnectionManager) provenGroups(claimed, proofs []string, nonce, peerNonce string) []string {
+	secrets := make(map[string]string)
+	for _, g := range c.joined() {
+		if g.secret != "" {
+			secrets[g.tag] = g.secret
+		}
+	}
+
+	var groups []string
+	for _, tag := range claimed {
+		if secret, ok := secrets[tag]; ok {
+			if peerNonce == "" || !containsMAC(proofs, groupMAC(secret, "smc-hello", tag, nonce, peerNonce)) {
+				continue
+			}
+		}
+		groups = append(groups, tag)
+	}
+	return groups
+}
+
+// requestProofs proves membership of our groups with a secret to the
+// device a request goes to. The proofs are bound to both device IDs and
+// the time, so they can't be replayed elsewhere or much later.
+func (c *ConnectionManager) requestProofs(req ConnectionRequest) []string {
+	if req.FromID == "" || req.ToID == "" {
+		return nil
+	}
+	var proofs []string
+	for _, g := range c.joined() {
+		if g.secret != "" {
+			proofs = append(proofs, groupMAC(g.secret, "smc-request", g.tag, req.FromID, req.ToID, strconv.FormatInt(req.Time, 10)))
+		}
+	}
+	return proofs
+}
+
+// ProvesGroup reports whether a connection request proves that its sender
+// knows the secret of a group we share. Such requests may be accepted
+// without asking.
+func (c *ConnectionManager) ProvesGroup(req ConnectionRequest) bool {
+	c.mu.RLock()
+	id := c.deviceID
+	c.mu.RUnlock()
+	if id == "" || req.FromID == "" || req.ToID != id {
+		return false
+	}
+	if age := time.Since(time.Unix(req.Time, 0)); age > requestProofWindow || age < -requestProofWindow {
+		return false
+	}
+
+	for _, g := range c.joined() {
+		if g.secret == "" || !slices.Contains(req.Groups, g.tag) {
+			continue
+		}
+		if containsMAC(req.Proofs, groupMAC(g.secret, "smc-request", g.tag, req.FromID, req.ToID, strconv.FormatInt(req.Time, 10))) {
+			return true
+		}
+	}
+	return false
+}
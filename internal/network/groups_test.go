@@ -0,0 +1,110 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+// groupMember returns a manager in the team group with the given secret
+func groupMember(id, secret string) *ConnectionManager {
+	c := newBareManager()
+	c.SetDeviceID(id)
+	c.SetGroups([]string{"team"}, map[string]string{"team": secret})
+	return c
+}
+
+// request builds what SendRequest sends from c to the device toID
+func request(c *ConnectionManager, toID string) ConnectionRequest {
+	req := ConnectionRequest{FromID: c.deviceID, ToID: toID, Groups: c.groupTags(), Time: time.Now().Unix()}
+	req.Proofs = c.requestProofs(req)
+	return req
+}
+
+func TestSharesSecretGroup(t *testing.T) {
+	us := groupMember("us", "s3cret")
+
+	for name, tags := range map[string][]string{
+		"right secret": groupMember("them", "s3cret").groupTags(),
+		"wrong secret": groupMember("them", "guess").groupTags(),
+		"no secret":    groupMember("them", "").groupTags(),
+	} {
+		if got, want := us.SharesSecretGroup(tags), name == "right secret"; got != want {
+			t.Errorf("%s: got %v", name, got)
+		}
+	}
+
+	// The default group has no secret to share
+	if groupMember("us", "").SharesSecretGroup(groupMember("them", "").groupTags()) {
+		t.Error("shares a group without a secret")
+	}
+}
+
+func TestProvesGroup(t *testing.T) {
+	us := groupMember("us", "s3cret")
+
+	for name, from := range map[string]*ConnectionManager{
+		"right secret": groupMember("them", "s3cret"),
+		"wrong secret": groupMember("them", "guess"),
+		"no secret":    groupMember("them", ""),
+	} {
+		if got, want := us.ProvesGroup(request(from, "us")), name == "right secret"; got != want {
+			t.Errorf("%s: got %v", name, got)
+		}
+	}
+
+	// Claiming the group without a proof proves nothing
+	req := request(groupMember("them", "s3cret"), "us")
+	req.Proofs = nil
+	if us.ProvesGroup(req) {
+		t.Error("accepted a request without proofs")
+	}
+}
+
+func TestProvesGroupReplay(t *testing.T) {
+	us := groupMember("us", "s3cret")
+	req := request(groupMember("them", "s3cret"), "us")
+
+	// Sent to another device
+	if groupMember("other", "s3cret").ProvesGroup(req) {
+		t.Error("accepted a proof meant for another device")
+	}
+
+	// Passed off as coming from another device
+	forged := req
+	forged.FromID = "mallory"
+	if us.ProvesGroup(forged) {
+		t.Error("accepted a proof of another sender")
+	}
+
+	// Replayed once the window is over, with or without a new time
+	stale := req
+	stale.Time -= int64((requestProofWindow + time.Minute) / time.Second)
+	stale.Proofs = groupMember("them", "s3cret").requestProofs(stale)
+	if us.ProvesGroup(stale) {
+		t.Error("accepted a stale proof")
+	}
+	stale.Time = req.Time + 1
+	if us.ProvesGroup(stale) {
+		t.Error("accepted a proof for another time")
+	}
+}
+
+func TestProvenGroupsHello(t *testing.T) {
+	us := groupMember("us", "s3cret")
+	them := groupMember("them", "s3cret")
+	tags := them.groupTags()
+
+	ours, theirs := newMessageID(), newMessageID()
+	if got := us.provenGroups(tags, them.helloProofs(theirs, ours), ours, theirs); len(got) != 1 {
+		t.Errorf("right secret: proven %v", got)
+	}
+	if got := us.provenGroups(tags, groupMember("them", "guess").helloProofs(theirs, ours), ours, theirs); len(got) != 0 {
+		t.Errorf("wrong secret: proven %v", got)
+	}
+
+	// A proof for an earlier connection doesn't carry over
+	old := them.helloProofs(theirs, newMessageID())
+	if got := us.provenGroups(tags, old, ours, theirs); len(got) != 0 {
+		t.Errorf("replayed proof: proven %v", got)
+	}
+}
@@ -0,0 +1,119 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Settling on one connection when two devices connect to each other at
+// the same moment. The dialer's first message is its hello. The accepting
+// side answers with its own hello, which confirms the connection, or with
+// a rejecting one when it keeps a connection it already has. Both sides
+// apply the same rule, so they end up with the same socket: the device
+// with the lower ID keeps the connection it dialed, or the one with the
+// lower address from the hellos when either side has no ID.
+
+// handshakeTimeout bounds waiting for the peer's hello. Versions before
+// groups never send one, so the connection is taken as confirmed then.
+const handshakeTimeout = 5 * time.Second
+
+// admit decides whether an incoming connection from a peer that sent
+// hello first may replace one we already have. A replaced connection is
+// closed without counting as a drop.
+func (c *ConnectionManager) admit(peer, remoteIP string, hello HelloMessage) bool {
+	c.mu.Lock()
+	existing := c.connections[peer]
+	if existing == nil {
+		c.mu.Unlock()
+		return true
+	}
+
+	// Our own connection wins if we have the lower ID. Both sides must
+	// agree on the winner, so without IDs on both the addresses decide.
+	if existing.isHub && c.winsTieLocked(hello) {
+		c.mu.Unlock()
+		fmt.Printf("[NET] Keeping our connection to %s, rejecting theirs\n", existing.ip)
+		return false
+	}
+
+	// The peer dialed again: its connection wins the tie, or it lost the
+	// one we have
+	delete(c.connections, peer)
+	c.mu.Unlock()
+
+	fmt.Printf("[NET] Replacing connection to %s with the one from %s\n", existing.ip, remoteIP)
+	existing.markReplaced()
+	existing.shutdown()
+	existing.conn.Close()
+	return true
+}
+
+// winsTieLocked tells whether the connection we dialed beats the one the
+// peer opened with hello. Both sides compare what the hellos carry, not
+// what their sockets show, so exactly one side wins.
+func (c *ConnectionManager) winsTieLocked(hello HelloMessage) bool {
+	if c.deviceID != "" && hello.DeviceID != "" {
+		return c.deviceID < hello.DeviceID
+	}
+	own := net.JoinHostPort(c.LocalIP, strconv.Itoa(c.listen.Port))
+	return own < net.JoinHostPort(hello.FromIP, strconv.Itoa(hello.Port))
+}
+
+// reject tells the dialer that we keep another connection, then closes
+// its socket
+func (c *ConnectionManager) reject(conn net.Conn) {
+	defer conn.Close()
+
+	c.mu.RLock()
+	hello := HelloMessage{FromIP: c.LocalIP, Port: c.listen.Port, Name: c.hostname, DeviceID: c.deviceID, Reject: true}
+	c.mu.RUnlock()
+
+	msg := Message{Type: MsgTypeHello}
+	msg.Data, _ = json.Marshal(hello)
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	json.NewEncoder(conn).Encode(msg)
+}
+
+// confirm makes a connection live once both sides agree on it
+func (c *ConnectionManager) confirm(state *ConnectionState) {
+	first := false
+	state.confirmOnce.Do(func() {
+		close(state.confirmed)
+		first = true
+	})
+	if first {
+		c.connectionLive(state)
+	}
+}
+
+// awaitConfirm waits until the peer confirms a connection we dialed. A
+// rejected connection is fine as long as the peer's own one took over.
+func (c *ConnectionManager) awaitConfirm(state *ConnectionState) error {
+	deadline := time.After(handshakeTimeout)
+	select {
+	case <-state.confirmed:
+		return nil
+	case <-state.closeChan:
+		// A connection that lost the tie closes before the winner is
+		// set up, so give it until the handshake would time out
+		for {
+			if c.IsConnected(state.peer()) {
+				return nil
+			}
+			if !state.isReplaced() {
+				return fmt.Errorf("connection to %s closed during handshake", state.ip)
+			}
+			select {
+			case <-deadline:
+				return fmt.Errorf("connection to %s was replaced, but no other connection came up", state.ip)
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	case <-deadline:
+		c.confirm(state)
+		return nil
+	}
+}
@@ -0,0 +1,142 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// freePort returns a loopback port nothing listens on right now
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("no loopback TCP: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// newLoopbackManager runs a ConnectionManager on 127.0.0.1
+func newLoopbackManager(t *testing.T, id string) *ConnectionManager {
+	t.Helper()
+	c := NewConnectionManager("test-"+id, ListenConfig{BindAddress: "127.0.0.1", Port: freePort(t)})
+	c.SetDeviceID(id)
+
+	// Wait for the listener, so dials don't race it
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c.mu.RLock()
+		listening := len(c.listeners) > 0
+		c.mu.RUnlock()
+		if listening {
+			return c
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("listener never came up")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// knows tells c where to dial other
+func knows(c, other *ConnectionManager) {
+	c.UpdatePeer(Device{DeviceInfo: DeviceInfo{ID: other.deviceID, Port: other.listen.Port}, IP: other.LocalIP})
+}
+
+func connectionCount(c *ConnectionManager) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.connections)
+}
+
+// onlyConnection returns the single connection c has, once it is live
+func onlyConnection(c *ConnectionManager) *ConnectionState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.connections) != 1 {
+		return nil
+	}
+	for _, state := range c.connections {
+		if state.isConfirmed() {
+			return state
+		}
+	}
+	return nil
+}
+
+// connectBothWays has a and b dial each other at the same moment and
+// checks they settle on one socket
+func connectBothWays(t *testing.T, a, b *ConnectionManager) {
+	t.Helper()
+	knows(a, b)
+	knows(b, a)
+
+	start := make(chan struct{})
+	errs := make(chan error, 2)
+	go func() {
+		<-start
+		errs <- a.Connect(b.deviceID, b.LocalIP)
+	}()
+	go func() {
+		<-start
+		errs <- b.Connect(a.deviceID, a.LocalIP)
+	}()
+	close(start)
+
+	for range 2 {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Errorf("connect: %v", err)
+			}
+		case <-time.After(2 * handshakeTimeout):
+			t.Fatal("connect never returned")
+		}
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		sa, sb := onlyConnection(a), onlyConnection(b)
+		if sa != nil && sb != nil && sa.conn.LocalAddr().String() == sb.conn.RemoteAddr().String() {
+			// Exactly one side dialed the socket both kept
+			if sa.isHub == sb.isHub {
+				t.Errorf("both sides have isHub=%v", sa.isHub)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no single shared connection: a has %d, b has %d", connectionCount(a), connectionCount(b))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSimultaneousConnect(t *testing.T) {
+	for range 3 {
+		connectBothWays(t, newLoopbackManager(t, "aaaa-device"), newLoopbackManager(t, "bbbb-device"))
+	}
+}
+
+func TestSimultaneousConnectWithoutIDs(t *testing.T) {
+	// Both sides have the same address, so the ports from the hellos
+	// decide
+	for range 3 {
+		connectBothWays(t, newLoopbackManager(t, ""), newLoopbackManager(t, ""))
+	}
+}
+
+func TestWinsTieIsAsymmetric(t *testing.T) {
+	a := &ConnectionManager{LocalIP: "10.0.0.1", listen: ListenConfig{Port: 54322}}
+	b := &ConnectionManager{LocalIP: "10.0.0.1", listen: ListenConfig{Port: 54323}}
+	helloFrom := func(c *ConnectionManager) HelloMessage {
+		return HelloMessage{FromIP: c.LocalIP, Port: c.listen.Port, DeviceID: c.deviceID}
+	}
+
+	for _, ids := range [][2]string{{"", ""}, {"x", ""}, {"x", "y"}, {"y", "x"}} {
+		a.deviceID, b.deviceID = ids[0], ids[1]
+		if a.winsTieLocked(helloFrom(b)) == b.winsTieLocked(helloFrom(a)) {
+			t.Errorf("IDs %q: both sides decide the same", ids)
+		}
+	}
+}
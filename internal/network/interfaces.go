@@ -0,0 +1,155 @@
+package network
+
+import (
+	"net"
+	"slices"
+	"strings"
+)
+
+// virtualInterfaces are name prefixes of container and VM bridges. Their
+// addresses never lead to another device running the app.
+var virtualInterfaces = []string{"docker", "br-", "veth", "virbr", "vboxnet", "vmnet", "podman", "cni"}
+
+func isVirtualInterface(name string) bool {
+	name = strings.ToLower(name)
+	return slices.ContainsFunc(virtualInterfaces, func(prefix string) bool {
+		return strings.HasPrefix(name, prefix)
+	})
+}
+
+// allowedInterfaces returns the interfaces named in allowed that are up
+func allowedInterfaces(allowed []string) []net.Interface {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	return slices.DeleteFunc(interfaces, func(iface net.Interface) bool {
+		return iface.Flags&net.FlagUp == 0 || !slices.Contains(allowed, iface.Name)
+	})
+}
+
+// usableInterfaces returns the interfaces to discover and connect on: the
+// allowlist if there is one, otherwise every interface that is up, isn't
+// loopback and isn't a container or VM bridge
+func usableInterfaces(allowed []string) []net.Interface {
+	if len(allowed) > 0 {
+		return allowedInterfaces(allowed)
+	}
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	return slices.DeleteFunc(interfaces, func(iface net.Interface) bool {
+		return iface.Flags&net.FlagUp == 0 ||
+			iface.Flags&net.FlagLoopback != 0 ||
+			isVirtualInterface(iface.Name)
+	})
+}
+
+// interfaceIPs returns the unicast addresses of an interface as strings,
+// IPv6 link-local ones with their zone
+func interfaceIPs(iface net.Interface) []string {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	var ips []string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsMulticast() {
+			continue
+		}
+		ips = append(ips, ipString(ipnet.IP, iface.Name))
+	}
+	return ips
+}
+
+// ipString formats ip for use as a peer address. Link-local IPv6
+// addresses only make sense together with the interface they are on.
+func ipString(ip net.IP, zone string) string {
+	if ip.To4() == nil && ip.IsLinkLocalUnicast() && zone != "" {
+		return ip.String() + "%" + zone
+	}
+	return ip.String()
+}
+
+// parseIP parses a peer address, which may carry an IPv6 zone
+func parseIP(addr string) net.IP {
+	host, _, _ := strings.Cut(addr, "%")
+	return net.ParseIP(host)
+}
+
+// getPreferredLocalIP picks the address we put in messages: IPv4 first,
+// then global IPv6, then link-local IPv6. Peers answer to the address a
+// connection comes from, so this only matters for logs and older peers.
+func getPreferredLocalIP(allowed []string) string {
+	var ipv4, global, linkLocal string
+	for _, iface := range usableInterfaces(allowed) {
+		for _, addr := range interfaceIPs(iface) {
+			ip := parseIP(addr)
+			switch {
+			case ip.To4() != nil && !ip.IsLinkLocalUnicast():
+				if ipv4 == "" {
+					ipv4 = addr
+				}
+			case ip.To4() == nil && ip.IsGlobalUnicast():
+				if global == "" {
+					global = addr
+				}
+			case ip.To4() == nil && ip.IsLinkLocalUnicast():
+				if linkLocal == "" {
+					linkLocal = addr
+				}
+			}
+		}
+	}
+
+	for _, ip := range []string{ipv4, global, linkLocal} {
+		if ip != "" {
+			return ip
+		}
+	}
+	return "127.0.0.1"
+}
+
+// isIgnoredIP reports addresses that can't be another device: this
+// machine, and the subnets of our own container and VM bridges. Other
+// loopback addresses are kept for instances bound to them for testing.
+func isIgnoredIP(addr string) bool {
+	ip := parseIP(addr)
+	if ip == nil || ip.Equal(net.IPv4(127, 0, 0, 1)) || ip.Equal(net.IPv6loopback) ||
+		ip.IsUnspecified() || ip.IsMulticast() {
+		return true
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return false
+	}
+	for _, iface := range interfaces {
+		if !isVirtualInterface(iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// localIPFor returns the address we use to reach addr, which may carry
+// an IPv6 zone. No packet is sent.
+func localIPFor(addr string) net.IP {
+	conn, err := net.Dial("udp", net.JoinHostPort(addr, "9"))
+	if err != nil {
+		return parseIP(getPreferredLocalIP(nil))
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
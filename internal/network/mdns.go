@@ -0,0 +1,690 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// mDNS/DNS-SD advertisement and browsing (RFC 6762, RFC 6763), so the app
+// is found on networks that drop peerdiscovery's multicast and shows up
+// in tools like dns-sd and avahi-browse
+
+const (
+	mdnsService  = "_sharemyclipboard._tcp.local."
+	mdnsServices = "_services._dns-sd._udp.local."
+	mdnsTTL      = 120
+
+	// legacyUnicastTTL caps the TTL of answers to one-shot queries
+	legacyUnicastTTL = 10
+
+	// cacheFlush marks records only this device answers for
+	cacheFlush = 1 << 15
+
+	// unicastResponse is the top class bit of a question asking for the
+	// answer to be sent back unicast (the QU bit)
+	unicastResponse = 1 << 15
+)
+
+var (
+	mdnsGroup4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	mdnsGroup6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+)
+
+// mdnsDiscoverer answers queries for this device once the first scan ran,
+// and browses for other devices on each scan. Both run over IPv4 and IPv6
+// on every usable interface.
+type mdnsDiscoverer struct {
+	interfaces []string // allowlist; empty for all usable interfaces
+
+	mu     sync.Mutex
+	self   DeviceInfo
+	conns  []*mdnsConn // responders; nil when not running
+	failed bool        // the responder could not bind port 5353
+	closed bool
+}
+
+func (m *mdnsDiscoverer) Name() string { return BackendMDNS }
+
+func (m *mdnsDiscoverer) Discover(self DeviceInfo, timeout time.Duration) ([]Discovered, error) {
+	m.advertise(self)
+	return m.browse(timeout)
+}
+
+// Close sends a goodbye so other devices drop us right away
+func (m *mdnsDiscoverer) Close() error {
+	m.mu.Lock()
+	conns := m.conns
+	self := m.self
+	m.conns = nil
+	m.closed = true
+	m.mu.Unlock()
+
+	var errs []error
+	for _, conn := range conns {
+		conn.multicast(m.ifaces(), func(ips []net.IP) ([]byte, error) {
+			return mdnsAnnouncement(self, 0, ips)
+		})
+		errs = append(errs, conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// ifaces returns the interfaces to send on. nil stands for the system
+// default when there is none, as on a machine with only loopback.
+func (m *mdnsDiscoverer) ifaces() []*net.Interface {
+	var ifaces []*net.Interface
+	for _, iface := range usableInterfaces(m.interfaces) {
+		if iface.Flags&net.FlagMulticast != 0 {
+			ifaces = append(ifaces, &iface)
+		}
+	}
+	if len(ifaces) == 0 && len(m.interfaces) == 0 {
+		ifaces = []*net.Interface{nil}
+	}
+	return ifaces
+}
+
+// advertise updates what the responder announces, starting it on first use
+func (m *mdnsDiscoverer) advertise(self DeviceInfo) {
+	m.mu.Lock()
+	changed := !slices.Equal(mdnsTXT(m.self), mdnsTXT(self))
+	m.self = self
+	if m.conns == nil && !m.failed && !m.closed {
+		// IPv6 is often missing; the responder runs on what binds
+		var errs []error
+		for _, group := range []*net.UDPAddr{mdnsGroup4, mdnsGroup6} {
+			conn, err := listenMDNS(group, m.ifaces())
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			m.conns = append(m.conns, conn)
+			go m.respond(conn)
+		}
+		if m.conns == nil {
+			fmt.Printf("[NET] mDNS responder unavailable, browsing only: %v\n", errors.Join(errs...))
+			m.failed = true
+		}
+		changed = true
+	}
+	conns := m.conns
+	m.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	// Announce our records unsolicited, as done on startup and changes
+	for _, conn := range conns {
+		err := conn.multicast(m.ifaces(), func(ips []net.IP) ([]byte, error) {
+			return mdnsAnnouncement(self, mdnsTTL, ips)
+		})
+		if err != nil {
+			fmt.Printf("[NET] Failed to send mDNS announcement: %v\n", err)
+		}
+	}
+}
+
+// respond answers queries until the connection is closed
+func (m *mdnsDiscoverer) respond(conn *mdnsConn) {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Printf("[NET] mDNS responder stopped: %v\n", err)
+			}
+			return
+		}
+
+		var p dnsmessage.Parser
+		header, err := p.Start(buf[:n])
+		if err != nil || header.Response {
+			continue
+		}
+		questions, err := p.AllQuestions()
+		if err != nil {
+			continue
+		}
+
+		m.mu.Lock()
+		self := m.self
+		m.mu.Unlock()
+
+		// Answer with the addresses of the interface the query came in on
+		iface := interfaceFor(src, m.ifaces())
+		for _, q := range questions {
+			if !mdnsAnswers(self, q) {
+				continue
+			}
+
+			// Queries from a port other than 5353 are one-shot resolvers
+			// expecting a plain DNS reply; the QU bit asks for a unicast
+			// one
+			legacy := src.Port != conn.group.Port
+			if legacy || q.Class&unicastResponse != 0 {
+				ttl := uint32(mdnsTTL)
+				var question *dnsmessage.Question
+				if legacy {
+					ttl = legacyUnicastTTL
+					question = &q
+				}
+				if msg, err := mdnsResponse(self, ttl, header.ID, question, mdnsIPs(iface, src)); err == nil {
+					conn.WriteToUDP(msg, src)
+				}
+			} else {
+				conn.multicast([]*net.Interface{iface}, func(ips []net.IP) ([]byte, error) {
+					return mdnsAnnouncement(self, mdnsTTL, ips)
+				})
+			}
+			break
+		}
+	}
+}
+
+// browse asks for the service and collects the answers. The query comes
+// from a random port, so responders answer us directly and port 5353
+// may stay with the system's own mDNS service.
+func (m *mdnsDiscoverer) browse(timeout time.Duration) ([]Discovered, error) {
+	query, err := mdnsQuery()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		records = newMDNSRecords()
+		errs    []error
+	)
+	deadline := time.Now().Add(timeout)
+	for _, group := range []*net.UDPAddr{mdnsGroup4, mdnsGroup6} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := browseMDNS(group, m.ifaces(), query, deadline, func(packet []byte, src *net.UDPAddr) {
+				mu.Lock()
+				records.add(packet, src)
+				mu.Unlock()
+			})
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// One working family is enough
+	if len(errs) == 2 {
+		return nil, errors.Join(errs...)
+	}
+	return records.devices(), nil
+}
+
+func browseMDNS(group *net.UDPAddr, ifaces []*net.Interface, query []byte, deadline time.Time, add func([]byte, *net.UDPAddr)) error {
+	network := mdnsNetwork(group)
+	udp, err := net.ListenUDP(network, &net.UDPAddr{})
+	if err != nil {
+		return fmt.Errorf("failed to open %s mDNS socket: %w", network, err)
+	}
+	conn := newMDNSConn(udp, group)
+	defer conn.Close()
+
+	if err := conn.multicast(ifaces, func([]net.IP) ([]byte, error) { return query, nil }); err != nil {
+		return fmt.Errorf("failed to send %s mDNS query: %w", network, err)
+	}
+
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil
+		}
+		add(buf[:n], src)
+	}
+}
+
+// ---------- TRANSPORT ----------
+
+// mdnsConn is a UDP socket for one address family that sends to the mDNS
+// group on a chosen interface
+type mdnsConn struct {
+	*net.UDPConn
+	group *net.UDPAddr
+
+	// mu keeps the multicast interface from changing between setting it
+	// and sending
+	mu       sync.Mutex
+	setIface func(*net.Interface) error
+}
+
+func mdnsNetwork(group *net.UDPAddr) string {
+	if group.IP.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+func newMDNSConn(udp *net.UDPConn, group *net.UDPAddr) *mdnsConn {
+	conn := &mdnsConn{UDPConn: udp, group: group}
+	if group.IP.To4() != nil {
+		conn.setIface = ipv4.NewPacketConn(udp).SetMulticastInterface
+	} else {
+		conn.setIface = ipv6.NewPacketConn(udp).SetMulticastInterface
+	}
+	return conn
+}
+
+// listenMDNS binds port 5353 and joins the group on every interface
+func listenMDNS(group *net.UDPAddr, ifaces []*net.Interface) (*mdnsConn, error) {
+	network := mdnsNetwork(group)
+	var first *net.Interface
+	if len(ifaces) > 0 {
+		first = ifaces[0]
+	}
+	udp, err := net.ListenMulticastUDP(network, first, group)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", network, err)
+	}
+
+	for _, iface := range ifaces {
+		if iface == nil || iface == first {
+			continue
+		}
+		// Interfaces without this family refuse to join; that's fine
+		if network == "udp4" {
+			ipv4.NewPacketConn(udp).JoinGroup(iface, group)
+		} else {
+			ipv6.NewPacketConn(udp).JoinGroup(iface, group)
+		}
+	}
+	return newMDNSConn(udp, group), nil
+}
+
+// multicast sends a message to the group on each interface. build gets
+// the addresses to put in it, which differ from one interface to the next.
+func (c *mdnsConn) multicast(ifaces []*net.Interface, build func(ips []net.IP) ([]byte, error)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	sent := false
+	for _, iface := range ifaces {
+		msg, err := build(mdnsIPs(iface, nil))
+		if err != nil {
+			return err
+		}
+		if iface != nil {
+			if err := c.setIface(iface); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", iface.Name, err))
+				continue
+			}
+		}
+		if _, err := c.WriteToUDP(msg, c.group); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		sent = true
+	}
+	if sent {
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// interfaceFor finds which of ifaces a packet from src arrived on. It
+// returns nil when that can't be told, e.g. for the system default.
+func interfaceFor(src *net.UDPAddr, ifaces []*net.Interface) *net.Interface {
+	for _, iface := range ifaces {
+		if iface == nil {
+			continue
+		}
+		if src.Zone != "" {
+			if src.Zone == iface.Name || src.Zone == strconv.Itoa(iface.Index) {
+				return iface
+			}
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.Contains(src.IP) {
+				return iface
+			}
+		}
+	}
+	return nil
+}
+
+// mdnsIPs returns the addresses we announce on iface. Without an
+// interface they are the ones used to reach src, or the preferred one.
+func mdnsIPs(iface *net.Interface, src *net.UDPAddr) []net.IP {
+	var ips []net.IP
+	if iface != nil {
+		for _, addr := range interfaceIPs(*iface) {
+			ips = append(ips, parseIP(addr))
+		}
+	}
+	if len(ips) == 0 {
+		if src != nil {
+			ips = append(ips, localIPFor(ipString(src.IP, src.Zone)))
+		} else {
+			ips = append(ips, parseIP(getPreferredLocalIP(nil)))
+		}
+	}
+	return ips
+}
+
+// ---------- RECORDS ----------
+
+// mdnsInstance is the DNS-SD instance name, unique through the device ID
+func mdnsInstance(self DeviceInfo) string {
+	label := strings.ReplaceAll(self.Name, ".", "-")
+	suffix := ""
+	if len(self.ID) >= 6 {
+		suffix = " (" + self.ID[:6] + ")"
+	}
+	if len(label)+len(suffix) > 63 {
+		label = label[:63-len(suffix)]
+	}
+	return label + suffix + "." + mdnsService
+}
+
+// mdnsHost is the host name our SRV record points at. It differs from
+// the OS host name so we never clash with the system's own records.
+func mdnsHost(self DeviceInfo) string {
+	id := self.ID
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	if id == "" {
+		id = strings.Map(func(r rune) rune {
+			if r < 128 && (r == '-' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+				return r
+			}
+			return '-'
+		}, self.Name)
+	}
+	return "smc-" + id + ".local."
+}
+
+// mdnsTXT holds the discovery payload fields as DNS-SD key=value pairs
+func mdnsTXT(self DeviceInfo) []string {
+	if self.Name == "" {
+		return nil
+	}
+	pairs := []string{
+		"v=" + strconv.Itoa(discoveryVersion),
+		"id=" + self.ID,
+		"name=" + self.Name,
+		"os=" + self.OS,
+		"ver=" + self.AppVersion,
+		"proto=" + strconv.Itoa(self.Protocol),
+		"caps=" + strings.Join(self.Capabilities, ","),
+		"groups=" + strings.Join(self.Groups, ","),
+	}
+	if self.Fingerprint != "" {
+		pairs = append(pairs, "fp="+self.Fingerprint)
+	}
+	// A TXT string holds at most 255 bytes
+	return slices.DeleteFunc(pairs, func(pair string) bool { return len(pair) > 255 })
+}
+
+func parseMDNSTXT(txt []string, port int) DeviceInfo {
+	info := DeviceInfo{Port: port}
+	for _, pair := range txt {
+		key, value, _ := strings.Cut(pair, "=")
+		switch strings.ToLower(key) {
+		case "id":
+			info.ID = value
+		case "name":
+			info.Name = value
+		case "os":
+			info.OS = value
+		case "ver":
+			info.AppVersion = value
+		case "proto":
+			info.Protocol, _ = strconv.Atoi(value)
+		case "caps":
+			info.Capabilities = splitList(value)
+		case "groups":
+			info.Groups = splitList(value)
+		case "fp":
+			info.Fingerprint = value
+		}
+	}
+	if info.Port == 0 {
+		info.Port = DefaultPort
+	}
+	return info
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// mdnsAnswers reports whether a question asks for one of our records
+func mdnsAnswers(self DeviceInfo, q dnsmessage.Question) bool {
+	if self.Name == "" {
+		return false
+	}
+	name := q.Name.String()
+	switch q.Type {
+	case dnsmessage.TypePTR, dnsmessage.TypeALL:
+		if strings.EqualFold(name, mdnsService) || strings.EqualFold(name, mdnsServices) {
+			return true
+		}
+	}
+	switch q.Type {
+	case dnsmessage.TypeSRV, dnsmessage.TypeTXT, dnsmessage.TypeALL:
+		if strings.EqualFold(name, mdnsInstance(self)) {
+			return true
+		}
+	}
+	switch q.Type {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypeALL:
+		return strings.EqualFold(name, mdnsHost(self))
+	}
+	return false
+}
+
+func mdnsQuery() ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(mdnsService),
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// mdnsAnnouncement is a multicast response carrying all our records. A
+// zero TTL withdraws them.
+func mdnsAnnouncement(self DeviceInfo, ttl uint32, ips []net.IP) ([]byte, error) {
+	return mdnsResponse(self, ttl, 0, nil, ips)
+}
+
+// mdnsResponse builds the PTR answer with SRV, TXT, A and AAAA records as
+// additionals. Legacy unicast replies echo the query ID and question.
+func mdnsResponse(self DeviceInfo, ttl uint32, id uint16, question *dnsmessage.Question, ips []net.IP) ([]byte, error) {
+	instance, err := dnsmessage.NewName(mdnsInstance(self))
+	if err != nil {
+		return nil, err
+	}
+	host, err := dnsmessage.NewName(mdnsHost(self))
+	if err != nil {
+		return nil, err
+	}
+	service := dnsmessage.MustNewName(mdnsService)
+
+	// Cache-flush only applies to multicast answers
+	unique := dnsmessage.ClassINET
+	if question == nil {
+		unique |= cacheFlush
+	}
+	header := func(name dnsmessage.Name, class dnsmessage.Class) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Class: class, TTL: ttl}
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, Authoritative: true})
+	b.EnableCompression()
+	if question != nil {
+		b.StartQuestions()
+		if err := b.Question(*question); err != nil {
+			return nil, err
+		}
+	}
+
+	// The service type itself is listed for browsers enumerating all
+	// services on the network
+	b.StartAnswers()
+	if err := b.PTRResource(header(service, dnsmessage.ClassINET), dnsmessage.PTRResource{PTR: instance}); err != nil {
+		return nil, err
+	}
+	if err := b.PTRResource(header(dnsmessage.MustNewName(mdnsServices), dnsmessage.ClassINET), dnsmessage.PTRResource{PTR: service}); err != nil {
+		return nil, err
+	}
+
+	b.StartAdditionals()
+	if err := b.SRVResource(header(instance, unique), dnsmessage.SRVResource{Target: host, Port: uint16(self.Port)}); err != nil {
+		return nil, err
+	}
+	if err := b.TXTResource(header(instance, unique), dnsmessage.TXTResource{TXT: mdnsTXT(self)}); err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			err = b.AResource(header(host, unique), dnsmessage.AResource{A: [4]byte(ip4)})
+		} else if ip16 := ip.To16(); ip16 != nil {
+			err = b.AAAAResource(header(host, unique), dnsmessage.AAAAResource{AAAA: [16]byte(ip16)})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// ---------- BROWSING ----------
+
+// mdnsRecords gathers records across responses, since a responder may
+// split them over several packets
+type mdnsRecords struct {
+	instances []string
+	srv       map[string]dnsmessage.SRVResource
+	txt       map[string][]string
+	hosts     map[string][]net.IP
+	sources   map[string][]string
+}
+
+func newMDNSRecords() *mdnsRecords {
+	return &mdnsRecords{
+		srv:     make(map[string]dnsmessage.SRVResource),
+		txt:     make(map[string][]string),
+		hosts:   make(map[string][]net.IP),
+		sources: make(map[string][]string),
+	}
+}
+
+func (r *mdnsRecords) add(packet []byte, src *net.UDPAddr) {
+	var p dnsmessage.Parser
+	header, err := p.Start(packet)
+	if err != nil || !header.Response {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return
+	}
+	additionals, _ := p.AllAdditionals()
+
+	for _, res := range append(answers, additionals...) {
+		name := strings.ToLower(res.Header.Name.String())
+		switch body := res.Body.(type) {
+		case *dnsmessage.PTRResource:
+			instance := strings.ToLower(body.PTR.String())
+			if name != mdnsService {
+				continue
+			}
+			if !slices.Contains(r.instances, instance) {
+				r.instances = append(r.instances, instance)
+			}
+			if addr := ipString(src.IP, src.Zone); !slices.Contains(r.sources[instance], addr) {
+				r.sources[instance] = append(r.sources[instance], addr)
+			}
+		case *dnsmessage.SRVResource:
+			r.srv[name] = *body
+		case *dnsmessage.TXTResource:
+			r.txt[name] = body.TXT
+		case *dnsmessage.AResource:
+			r.addHost(name, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			r.addHost(name, net.IP(body.AAAA[:]))
+		}
+	}
+}
+
+func (r *mdnsRecords) addHost(name string, ip net.IP) {
+	if !slices.ContainsFunc(r.hosts[name], ip.Equal) {
+		r.hosts[name] = append(r.hosts[name], ip)
+	}
+}
+
+// devices returns the instances whose records are complete, once for
+// each address they can be reached at
+func (r *mdnsRecords) devices() []Discovered {
+	var found []Discovered
+	for _, instance := range r.instances {
+		txt, hasTXT := r.txt[instance]
+		srv, hasSRV := r.srv[instance]
+		if !hasTXT || !hasSRV {
+			continue
+		}
+		info := parseMDNSTXT(txt, int(srv.Port))
+		if info.Name == "" {
+			continue
+		}
+
+		// Announced link-local addresses lack the zone to use them with;
+		// the ones answers came from have it
+		addrs := slices.Clone(r.sources[instance])
+		for _, ip := range r.hosts[strings.ToLower(srv.Target.String())] {
+			if addr := ip.String(); !ip.IsLinkLocalUnicast() && !slices.Contains(addrs, addr) {
+				addrs = append(addrs, addr)
+			}
+		}
+		for _, addr := range addrs {
+			found = append(found, Discovered{IP: addr, Info: info})
+		}
+	}
+	return found
+}
@@ -0,0 +1,335 @@
+package network
+
+import (
+	"net"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var testDevice = DeviceInfo{
+	ID:           "0123456789abcdef",
+	Name:         "Work Laptop",
+	OS:           "linux",
+	AppVersion:   "1.4.0",
+	Protocol:     2,
+	Port:         9999,
+	Capabilities: []string{"files", "images"},
+	Groups:       []string{"default", "0a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d"},
+	Fingerprint:  KeyFingerprint(make([]byte, 32)),
+}
+
+func parseResponse(t *testing.T, packet []byte) (dnsmessage.Header, []dnsmessage.Question, []dnsmessage.Resource) {
+	t.Helper()
+	var p dnsmessage.Parser
+	header, err := p.Start(packet)
+	if err != nil {
+		t.Fatalf("parse header: %v", err)
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		t.Fatalf("parse questions: %v", err)
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		t.Fatalf("parse answers: %v", err)
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		t.Fatalf("skip authorities: %v", err)
+	}
+	additionals, err := p.AllAdditionals()
+	if err != nil {
+		t.Fatalf("parse additionals: %v", err)
+	}
+	return header, questions, append(answers, additionals...)
+}
+
+func TestMDNSRoundTrip(t *testing.T) {
+	ips := []net.IP{net.ParseIP("192.168.1.20"), net.ParseIP("fe80::1"), net.ParseIP("2001:db8::20")}
+	packet, err := mdnsAnnouncement(testDevice, mdnsTTL, ips)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := newMDNSRecords()
+	records.add(packet, &net.UDPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0", Port: 5353})
+	found := records.devices()
+
+	// The link-local address is only usable with the zone it came from
+	var addrs []string
+	for _, d := range found {
+		addrs = append(addrs, d.IP)
+		if !reflect.DeepEqual(d.Info, testDevice) {
+			t.Errorf("%s: got %+v, want %+v", d.IP, d.Info, testDevice)
+		}
+	}
+	want := []string{"fe80::1%eth0", "192.168.1.20", "2001:db8::20"}
+	if !slices.Equal(addrs, want) {
+		t.Errorf("addresses: got %v, want %v", addrs, want)
+	}
+}
+
+func TestMDNSRecordsAcrossPackets(t *testing.T) {
+	full, err := mdnsAnnouncement(testDevice, mdnsTTL, []net.IP{net.ParseIP("10.0.0.5")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, resources := parseResponse(t, full)
+
+	// One packet with the PTR answers, one with the rest
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	b.StartAnswers()
+	for _, res := range resources {
+		if ptr, ok := res.Body.(*dnsmessage.PTRResource); ok {
+			b.PTRResource(res.Header, *ptr)
+		}
+	}
+	first, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	b.StartAnswers()
+	for _, res := range resources {
+		switch body := res.Body.(type) {
+		case *dnsmessage.SRVResource:
+			b.SRVResource(res.Header, *body)
+		case *dnsmessage.TXTResource:
+			b.TXTResource(res.Header, *body)
+		case *dnsmessage.AResource:
+			b.AResource(res.Header, *body)
+		}
+	}
+	second, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 5353}
+	records := newMDNSRecords()
+	records.add(first, src)
+	if found := records.devices(); len(found) != 0 {
+		t.Fatalf("incomplete records gave %+v", found)
+	}
+	records.add(second, src)
+	found := records.devices()
+	if len(found) != 1 || found[0].IP != "10.0.0.5" || found[0].Info.Name != testDevice.Name {
+		t.Errorf("got %+v", found)
+	}
+}
+
+func TestMDNSRecordsIgnoreQueries(t *testing.T) {
+	query, err := mdnsQuery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := newMDNSRecords()
+	records.add(query, &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 5353})
+	records.add([]byte{1, 2, 3}, &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 5353})
+	if len(records.instances) != 0 {
+		t.Errorf("got instances %v", records.instances)
+	}
+}
+
+func TestMDNSResponseClasses(t *testing.T) {
+	ips := []net.IP{net.ParseIP("10.0.0.5")}
+
+	// Multicast answers flush caches for our own records
+	multicast, err := mdnsResponse(testDevice, mdnsTTL, 0, nil, ips)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, questions, resources := parseResponse(t, multicast)
+	if len(questions) != 0 {
+		t.Errorf("multicast answer has questions %v", questions)
+	}
+	for _, res := range resources {
+		_, shared := res.Body.(*dnsmessage.PTRResource)
+		if flush := res.Header.Class&cacheFlush != 0; flush == shared {
+			t.Errorf("%s %s: cache-flush %v", res.Header.Name, res.Header.Type, flush)
+		}
+		if res.Header.TTL != mdnsTTL {
+			t.Errorf("%s %s: TTL %d", res.Header.Name, res.Header.Type, res.Header.TTL)
+		}
+	}
+
+	// Legacy unicast replies echo the query and never set cache-flush
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName(mdnsService), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}
+	legacy, err := mdnsResponse(testDevice, legacyUnicastTTL, 0x1234, &q, ips)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, questions, resources := parseResponse(t, legacy)
+	if header.ID != 0x1234 || !header.Response || !header.Authoritative {
+		t.Errorf("header %+v", header)
+	}
+	if len(questions) != 1 || questions[0] != q {
+		t.Errorf("questions %v, want %v", questions, q)
+	}
+	for _, res := range resources {
+		if res.Header.Class != dnsmessage.ClassINET || res.Header.TTL != legacyUnicastTTL {
+			t.Errorf("%s %s: class %v, TTL %d", res.Header.Name, res.Header.Type, res.Header.Class, res.Header.TTL)
+		}
+	}
+}
+
+func TestMDNSAnswers(t *testing.T) {
+	question := func(name string, typ dnsmessage.Type) dnsmessage.Question {
+		return dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}
+	}
+	instance := mdnsInstance(testDevice)
+	host := mdnsHost(testDevice)
+
+	tests := []struct {
+		q    dnsmessage.Question
+		want bool
+	}{
+		{question(mdnsService, dnsmessage.TypePTR), true},
+		{question(strings.ToUpper(mdnsService), dnsmessage.TypePTR), true},
+		{question(mdnsServices, dnsmessage.TypePTR), true},
+		{question(mdnsService, dnsmessage.TypeALL), true},
+		{question(mdnsService, dnsmessage.TypeSRV), false},
+		{question("_other._tcp.local.", dnsmessage.TypePTR), false},
+		{question(instance, dnsmessage.TypeSRV), true},
+		{question(instance, dnsmessage.TypeTXT), true},
+		{question(instance, dnsmessage.TypeA), false},
+		{question(host, dnsmessage.TypeA), true},
+		{question(host, dnsmessage.TypeAAAA), true},
+		{question(host, dnsmessage.TypeALL), true},
+		{question(host, dnsmessage.TypePTR), false},
+		{question("smc-other.local.", dnsmessage.TypeA), false},
+	}
+	for _, tt := range tests {
+		if got := mdnsAnswers(testDevice, tt.q); got != tt.want {
+			t.Errorf("%s %s: got %v, want %v", tt.q.Name, tt.q.Type, got, tt.want)
+		}
+	}
+
+	// Nothing is answered before we know who we are
+	if mdnsAnswers(DeviceInfo{}, question(mdnsService, dnsmessage.TypePTR)) {
+		t.Error("answered without a device")
+	}
+}
+
+func TestParseMDNSTXT(t *testing.T) {
+	info := parseMDNSTXT(mdnsTXT(testDevice), testDevice.Port)
+	if !reflect.DeepEqual(info, testDevice) {
+		t.Errorf("got %+v, want %+v", info, testDevice)
+	}
+
+	// Unknown keys are skipped, keys are case-insensitive and a missing
+	// port falls back to the default
+	info = parseMDNSTXT([]string{"NAME=Desk", "future=1", "caps=", "novalue"}, 0)
+	want := DeviceInfo{Name: "Desk", Port: DefaultPort}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("got %+v, want %+v", info, want)
+	}
+
+	// A TXT string holds at most 255 bytes
+	long := testDevice
+	long.Groups = []string{strings.Repeat("g", 300)}
+	if txt := mdnsTXT(long); slices.ContainsFunc(txt, func(pair string) bool { return strings.HasPrefix(pair, "groups=") }) {
+		t.Errorf("oversized pair kept: %v", txt)
+	}
+}
+
+// startResponder runs the responder on a loopback socket. Queries sent
+// from groupPort count as coming from mDNS peers, others as one-shot.
+func startResponder(t *testing.T, groupPort int) *net.UDPAddr {
+	t.Helper()
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("no loopback UDP: %v", err)
+	}
+	conn := newMDNSConn(udp, &net.UDPAddr{IP: mdnsGroup4.IP, Port: groupPort})
+	m := &mdnsDiscoverer{self: testDevice}
+	go m.respond(conn)
+	t.Cleanup(func() { conn.Close() })
+	return udp.LocalAddr().(*net.UDPAddr)
+}
+
+func ask(t *testing.T, client *net.UDPConn, responder *net.UDPAddr, id uint16, q dnsmessage.Question) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id})
+	b.StartQuestions()
+	b.Question(q)
+	query, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WriteToUDP(query, responder); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 9000)
+	n, _, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no answer: %v", err)
+	}
+	return buf[:n]
+}
+
+func TestMDNSRespondLegacyUnicast(t *testing.T) {
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("no loopback UDP: %v", err)
+	}
+	defer client.Close()
+	responder := startResponder(t, 5353)
+
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName(mdnsService), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}
+	header, questions, resources := parseResponse(t, ask(t, client, responder, 42, q))
+	if header.ID != 42 || len(questions) != 1 || questions[0] != q {
+		t.Errorf("header %+v, questions %v", header, questions)
+	}
+	for _, res := range resources {
+		if res.Header.TTL != legacyUnicastTTL {
+			t.Errorf("%s %s: TTL %d, want %d", res.Header.Name, res.Header.Type, res.Header.TTL, legacyUnicastTTL)
+		}
+	}
+
+	records := newMDNSRecords()
+	records.add(ask(t, client, responder, 43, q), responder)
+	found := records.devices()
+	if len(found) == 0 || found[0].Info.ID != testDevice.ID {
+		t.Errorf("got %+v", found)
+	}
+}
+
+func TestMDNSRespondUnicastQuestion(t *testing.T) {
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("no loopback UDP: %v", err)
+	}
+	defer client.Close()
+
+	// The client sends from the group port, so it is an mDNS peer that
+	// asks for a unicast answer with the QU bit
+	responder := startResponder(t, client.LocalAddr().(*net.UDPAddr).Port)
+	q := dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(mdnsInstance(testDevice)),
+		Type:  dnsmessage.TypeSRV,
+		Class: dnsmessage.ClassINET | unicastResponse,
+	}
+	// Unicast replies carry the query ID, even to mDNS peers
+	header, questions, resources := parseResponse(t, ask(t, client, responder, 7, q))
+	if header.ID != 7 || len(questions) != 0 {
+		t.Errorf("header %+v, questions %v", header, questions)
+	}
+	var srv *dnsmessage.SRVResource
+	for _, res := range resources {
+		if body, ok := res.Body.(*dnsmessage.SRVResource); ok {
+			srv = body
+			if res.Header.TTL != mdnsTTL || res.Header.Class&cacheFlush == 0 {
+				t.Errorf("SRV: TTL %d, class %v", res.Header.TTL, res.Header.Class)
+			}
+		}
+	}
+	if srv == nil || srv.Port != uint16(testDevice.Port) || srv.Target.String() != mdnsHost(testDevice) {
+		t.Errorf("SRV %+v", srv)
+	}
+}
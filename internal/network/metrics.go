@@ -0,0 +1,45 @@
+package network
+
+import "github.com/Krasnovvvvv/share-my-clipboard/internal/metrics"
+
+// Counters for the metrics endpoint. Clipboard items are counted once per
+// broadcast, not per peer; transfers once per peer.
+var (
+	connectedPeers = metrics.NewGauge("smc_connected_peers",
+		"Peers with a confirmed connection")
+	discoveredDevices = metrics.NewGauge("smc_discovered_devices",
+		"Devices currently found by discovery")
+	discoveryEvents = metrics.NewCounterVec("smc_discovery_events_total",
+		"Devices added, updated and lost by discovery", "event")
+
+	clipboardSent = metrics.NewCounterVec("smc_clipboard_events_sent_total",
+		"Clipboard items sent to peers, by type", "type")
+	clipboardReceived = metrics.NewCounterVec("smc_clipboard_events_received_total",
+		"Clipboard items received from peers, by type", "type")
+
+	transferBytes = metrics.NewCounterVec("smc_transfer_bytes_total",
+		"File and large text chunk bytes sent and received", "direction")
+	transferDuration = metrics.NewHistogramVec("smc_transfer_duration_seconds",
+		"Time from the start to the end of completed transfers", metrics.DurationBuckets, "direction")
+	transferFailures = metrics.NewCounterVec("smc_transfer_failures_total",
+		"Transfers that didn't complete, by direction and reason", "direction", "reason")
+	checksumMismatches = metrics.NewCounter("smc_checksum_mismatches_total",
+		"Received files and large texts whose checksum didn't match")
+)
+
+const (
+	directionSent     = "sent"
+	directionReceived = "received"
+)
+
+// clipboardType labels a message in the clipboard metrics
+func clipboardType(msgType MessageType) string {
+	switch msgType {
+	case MsgTypeClipboard:
+		return "text"
+	case MsgTypePrimary:
+		return "primary"
+	default:
+		return "file"
+	}
+}
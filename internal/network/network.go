@@ -1,23 +1,58 @@
 package network
 
 import (
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
-	"strings"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
-
-	"github.com/schollz/peerdiscovery"
 )
 
+// DefaultPort is where devices accept connections unless configured
+// otherwise. Multicast discovery always uses it, so that devices on other
+// ports still find each other.
+const DefaultPort = 54322
+
 const (
-	connectionPort    = 54322
 	heartbeatInterval = 5 * time.Second
 	connectionTimeout = 15 * time.Second
 	FileChunkSize     = 512 * 1024 // 512KB chunks
+
+	// TextChunkThreshold is the size above which text goes over the
+	// chunked file-transfer path instead of a single clipboard message
+	TextChunkThreshold = 256 * 1024
+
+	// maxHandshakeSize bounds the first message of an incoming connection
+	maxHandshakeSize = 64 * 1024
+
+	// maxFrameSize bounds a single message on a persistent connection.
+	// Large items arrive in chunks, so only old peers sending big text
+	// inline get close to it.
+	maxFrameSize = 16 * 1024 * 1024
+
+	// transferTimeout drops incoming transfers that stopped making progress
+	transferTimeout = 2 * time.Minute
+
+	// textFileName is what peers without chunked text support save
+	// chunked text as
+	textFileName = "clipboard.txt"
 )
 
+// ErrTooLarge is returned when an item exceeds the configured size limit
+var ErrTooLarge = errors.New("item exceeds size limit")
+
+// Limits caps the size of clipboard items. Zero means no limit.
+type Limits struct {
+	MaxSendSize    int64
+	MaxReceiveSize int64
+}
+
 // ---------- MESSAGE TYPES ----------
 type MessageType string
 
@@ -29,6 +64,15 @@ const (
 	MsgTypeClipboard    MessageType = "clipboard"
 	MsgTypeDisconnect   MessageType = "disconnect"
 	MsgTypeShutdown     MessageType = "shutdown"
+	MsgTypeHello        MessageType = "hello"
+
+	// MsgTypeProbe asks a manually added peer for its DeviceInfo, which it
+	// sends back in a probe message before closing the connection
+	MsgTypeProbe MessageType = "probe"
+
+	// MsgTypePrimary carries the X11/Wayland PRIMARY selection. It is a
+	// separate type so that peers without PRIMARY can ignore it.
+	MsgTypePrimary MessageType = "primary_selection"
 
 	MsgTypeFileChunkStart    MessageType = "file_chunk_start"
 	MsgTypeFileChunkData     MessageType = "file_chunk_data"
@@ -37,21 +81,55 @@ const (
 
 // ---------- DEVICE MODEL ----------
 type Device struct {
-	Name        string
+	DeviceInfo
 	IP          string
 	MAC         string
 	IsConnected bool
+
+	// Addresses holds every address the device answered on. A device
+	// that announces an ID is listed once, however many it has.
+	Addresses []string
 }
 
 type DeviceStore struct {
 	Devices   []Device
 	DevicesMu sync.RWMutex
+
+	// Backends used by Start; peerdiscovery multicast when nil
+	Backends []Discoverer
+
+	// LostAfter is how long a device may go unseen before it is removed;
+	// DefaultLostAfter when zero
+	LostAfter time.Duration
+
+	// Background discovery, see discovery.go
+	lastSeen map[string]map[string]time.Time // by Device.Key, then address
+	events   chan DiscoveryEvent
+	refresh  []chan struct{}
+	stop     chan struct{}
 }
 
 // ---------- MESSAGE STRUCTURES ----------
 type Message struct {
 	Type MessageType     `json:"type"`
 	Data json.RawMessage `json:"data,omitempty"`
+
+	// ID and Hops are set on clipboard and file messages, which peers
+	// relay to each other (see relay.go)
+	ID   string `json:"id,omitempty"`
+	Hops int    `json:"hops,omitempty"`
+
+	// Groups scopes the message to the groups shared with the peer it is
+	// sent to. Empty means DefaultGroup.
+	Groups []string `json:"groups,omitempty"`
+
+	// Origin is the device ID of the sender, so relays can skip peers it
+	// reaches directly
+	Origin string `json:"origin,omitempty"`
+
+	// written, when set, is closed once the write loop wrote the message
+	// to the socket; see sendWritten
+	written chan struct{}
 }
 
 type ConnectionRequest struct {
@@ -59,6 +137,21 @@ type ConnectionRequest struct {
 	FromIP   string `json:"from_ip"`
 	FromMAC  string `json:"from_mac"`
 	ToIP     string `json:"to_ip"`
+
+	// FromID is the sender's device ID; filled in by SendRequest. ToID is
+	// the device ID of the receiver, when known.
+	FromID string `json:"from_id,omitempty"`
+	ToID   string `json:"to_id,omitempty"`
+
+	// Groups holds the tags of the sender's groups, and Proofs shows it
+	// knows their secrets, so that the receiver can accept members of its
+	// own groups without asking. Filled in by SendRequest; see groups.go.
+	Groups []string `json:"groups,omitempty"`
+	Proofs []string `json:"proofs,omitempty"`
+	Time   int64    `json:"time,omitempty"`
+
+	// FromPort is the port the sender listens on
+	FromPort int `json:"from_port,omitempty"`
 }
 
 type ConnectionResponse struct {
@@ -66,6 +159,10 @@ type ConnectionResponse struct {
 	FromMAC string `json:"from_mac"`
 	ToIP    string `json:"to_ip"`
 	Accept  bool   `json:"accept"`
+
+	// FromID is the responder's device ID, which the connection is
+	// tracked by; filled in by SendResponse
+	FromID string `json:"from_id,omitempty"`
 }
 
 type HeartbeatMessage struct {
@@ -77,11 +174,25 @@ type ClipboardData struct {
 	FromIP    string `json:"from_ip"`
 	Content   string `json:"content"`
 	Timestamp int64  `json:"timestamp"`
+
+	// Representations are richer versions of Content (HTML, RTF). Older
+	// peers ignore them and use the plain text.
+	Representations []Representation `json:"representations,omitempty"`
+}
+
+// Representation is one MIME-typed version of a clipboard item
+type Representation struct {
+	MimeType string `json:"mime_type"`
+	Data     []byte `json:"data"`
 }
 
 type DisconnectMessage struct {
 	FromIP string `json:"from_ip"`
 	Reason string `json:"reason"`
+
+	// Forget is set when the user ended the connection on purpose, so
+	// the peer stops queueing items for us
+	Forget bool `json:"forget,omitempty"`
 }
 
 type FileChunkStart struct {
@@ -91,6 +202,23 @@ type FileChunkStart struct {
 	TotalChunks int    `json:"total_chunks"`
 	Checksum    string `json:"checksum"`
 	FromIP      string `json:"from_ip"`
+
+	// Files copied together share a batch, so the receiver can put them
+	// back on the clipboard as one file list
+	BatchID    string `json:"batch_id,omitempty"`
+	BatchTotal int    `json:"batch_total,omitempty"`
+
+	// TextType is set when the transfer carries clipboard text that was
+	// too large for one message. It holds the message type the text
+	// stands for; older peers ignore it and receive a text file.
+	TextType MessageType `json:"text_type,omitempty"`
+}
+
+// OutgoingFile is one file of a BroadcastFiles batch
+type OutgoingFile struct {
+	Name     string
+	Data     []byte
+	Checksum string
 }
 
 type FileChunkData struct {
@@ -107,6 +235,8 @@ type FileChunkComplete struct {
 // ---------- CONNECTION STATE ----------
 type ConnectionState struct {
 	conn          net.Conn
+	reader        io.Reader
+	key           string // in connections, see peers.go
 	ip            string
 	name          string
 	isHub         bool
@@ -114,93 +244,220 @@ type ConnectionState struct {
 	readChan      chan Message
 	writeChan     chan Message
 	closeChan     chan struct{}
+	groups        []string // tags the peer is counted in, see groups.go
+	deviceID      string   // from the peer's hello
+	nonce         string   // ours and the peer's, for proving groups
+	peerNonce     string
+	peers         []string     // device IDs the peer is connected to
+	relayQueue    chan Message // see relay.go
 	mu            sync.RWMutex
+
+	// closing is set when either side ends the connection on purpose,
+	// and forget when it also stops trusting the other; see reconnect.go
+	closing   bool
+	forget    bool
+	closeOnce sync.Once
+
+	// confirmed is closed once both sides agreed on this connection;
+	// replaced is set when another connection to the peer took its
+	// place. See handshake.go.
+	confirmed   chan struct{}
+	confirmOnce sync.Once
+	replaced    bool
+
+	// peerName is the name from the peer's hello; see stats.go
+	peerName string
+	stats    connStats
+}
+
+// shutdown stops the loops of a connection
+func (s *ConnectionState) shutdown() {
+	s.closeOnce.Do(func() { close(s.closeChan) })
+}
+
+// peer returns the key the connection is filed under
+func (s *ConnectionState) peer() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.key
+}
+
+func (s *ConnectionState) isConfirmed() bool {
+	select {
+	case <-s.confirmed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *ConnectionState) markReplaced() {
+	s.mu.Lock()
+	s.replaced = true
+	s.mu.Unlock()
+}
+
+func (s *ConnectionState) isReplaced() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.replaced
+}
+
+func (s *ConnectionState) markClosing(forget bool) {
+	s.mu.Lock()
+	s.closing = true
+	s.forget = s.forget || forget
+	s.mu.Unlock()
+}
+
+// incomingTransfer is a chunked transfer being received. Relayed chunks
+// may arrive over different connections, so transfers are tracked per
+// manager rather than per connection.
+type incomingTransfer struct {
+	start     FileChunkStart
+	remaining int64
+	received  map[int]bool
+	text      map[int][]byte
+	started   time.Time
+	updated   time.Time
+}
+
+// frameLimitReader fails once more than limit bytes were read past the
+// end of the last message dec decoded, so one oversized message can't
+// exhaust memory. Whatever the decoder read ahead counts towards the next
+// message, which is where it belongs.
+type frameLimitReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+	dec   *json.Decoder
+}
+
+func (f *frameLimitReader) Read(p []byte) (int, error) {
+	pending := f.read - f.dec.InputOffset()
+	if pending >= f.limit {
+		return 0, ErrTooLarge
+	}
+	if int64(len(p)) > f.limit-pending {
+		p = p[:f.limit-pending]
+	}
+	n, err := f.r.Read(p)
+	f.read += int64(n)
+	return n, err
 }
 
 // ---------- CONNECTION MANAGER ----------
+// ListenConfig says where peer connections are accepted. Zero values
+// mean DefaultPort on all interfaces.
+type ListenConfig struct {
+	Port        int
+	BindAddress string
+
+	// Interfaces limits listening and discovery to these interfaces
+	Interfaces []string
+}
+
 type ConnectionManager struct {
-	connections map[string]*ConnectionState
-	listener    net.Listener
-	LocalIP     string
-	hostname    string
-	mu          sync.RWMutex
+	connections  map[string]*ConnectionState
+	listeners    []net.Listener
+	listen       ListenConfig
+	LocalIP      string
+	hostname     string
+	limits       Limits
+	queue        *OutboundQueue
+	approved     map[string]bool // see Approve
+	groups       []string
+	joinedGroups []joinedGroup // with secrets and tags, see groups.go
+
+	// Announced in discovery, see device.go
+	deviceID     string
+	fingerprint  string // of the device key, see SetDeviceKey
+	capabilities []string
+	mu           sync.RWMutex
+
+	// Relaying, see relay.go
+	relayHops int
+	seen      *seenSet
+
+	transfers   map[string]*incomingTransfer
+	transfersMu sync.Mutex
+
+	// Where peers are dialed, see peers.go
+	peers map[string]*peerAddrs
+
+	// Reconnecting and resuming, see reconnect.go
+	links         map[string]*link
+	pending       map[string][]*pendingTransfer
+	resumeReplies map[string]chan FileResume
+	resumeMu      sync.Mutex
 
 	OnRequest           func(req ConnectionRequest)
 	OnResult            func(resp ConnectionResponse)
-	OnDisconnect        func(ip string, reason string)
+	OnDisconnect        func(peer string, reason string)
 	OnClipboard         func(data ClipboardData)
+	OnPrimary           func(data ClipboardData)
 	OnFileChunkStart    func(start FileChunkStart)
 	OnFileChunkData     func(chunk FileChunkData)
 	OnFileChunkComplete func(complete FileChunkComplete)
-	onConnEstablished   func(ip string)
+	OnTooLarge          func(fromIP, name string, size int64)
+	OnPeerGroups        func(peer string, groups []string)
+	OnLinkState         func(peer string, state LinkState)
+	onConnEstablished   func(peer string)
 }
 
-func NewConnectionManager(hostname string) *ConnectionManager {
+func NewConnectionManager(hostname string, listen ListenConfig) *ConnectionManager {
+	if listen.Port == 0 {
+		listen.Port = DefaultPort
+	}
 	c := &ConnectionManager{
+		listen:      listen,
 		connections: make(map[string]*ConnectionState),
+		approved:    make(map[string]bool),
 		hostname:    hostname,
+		relayHops:   DefaultRelayHops,
+		seen:        newSeenSet(),
+		transfers:   make(map[string]*incomingTransfer),
+		peers:       make(map[string]*peerAddrs),
+
+		links:         make(map[string]*link),
+		pending:       make(map[string][]*pendingTransfer),
+		resumeReplies: make(map[string]chan FileResume),
+	}
+	if ip := net.ParseIP(listen.BindAddress); ip != nil && !ip.IsUnspecified() {
+		c.LocalIP = ip.String()
+	} else {
+		c.LocalIP = getPreferredLocalIP(listen.Interfaces)
 	}
-	c.LocalIP = getPreferredLocalIP()
+	fmt.Printf("Selected local IP: %s\n", c.LocalIP)
 	go c.listenTCP()
 	return c
 }
 
-// ---------- DISCOVERY ----------
-func (s *DeviceStore) Scan(hostname string) bool {
-	discoveries, _ := peerdiscovery.Discover(peerdiscovery.Settings{
-		Limit:     -1,
-		Payload:   []byte(hostname),
-		Port:      fmt.Sprintf("%d", connectionPort),
-		TimeLimit: 3 * time.Second,
-	})
-
-	s.DevicesMu.Lock()
-	defer s.DevicesMu.Unlock()
-
-	seen := make(map[string]bool)
-	changed := false
-
-	for _, d := range discoveries {
-		ip := d.Address
-		name := string(d.Payload)
-
-		if isIgnoredIP(ip) {
-			continue
-		}
-
-		mac := getMACForIP(ip)
-		seen[ip] = true
-
-		found := false
-		for i := range s.Devices {
-			if s.Devices[i].IP == ip {
-				if s.Devices[i].Name != name || s.Devices[i].MAC != mac {
-					s.Devices[i].Name = name
-					s.Devices[i].MAC = mac
-					changed = true
-				}
-				found = true
-				break
-			}
-		}
+// SetLimits sets the size limits for sent and received items
+func (c *ConnectionManager) SetLimits(limits Limits) {
+	c.mu.Lock()
+	c.limits = limits
+	c.mu.Unlock()
+}
 
-		if !found {
-			s.Devices = append(s.Devices, Device{Name: name, IP: ip, MAC: mac})
-			changed = true
-		}
-	}
+// SetQueue enables queueing items for trusted peers that are offline
+func (c *ConnectionManager) SetQueue(queue *OutboundQueue) {
+	c.mu.Lock()
+	c.queue = queue
+	c.mu.Unlock()
+}
 
-	filtered := s.Devices[:0]
-	for _, dev := range s.Devices {
-		if seen[dev.IP] {
-			filtered = append(filtered, dev)
-		} else {
-			changed = true
-		}
-	}
-	s.Devices = filtered
+func (c *ConnectionManager) outboundQueue() *OutboundQueue {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.queue
+}
 
-	return changed
+// Limits returns the current size limits
+func (c *ConnectionManager) Limits() Limits {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.limits
 }
 
 func (s *DeviceStore) GetPage(page, size int) []Device {
@@ -216,22 +473,53 @@ func (s *DeviceStore) GetPage(page, size int) []Device {
 		return []Device{}
 	}
 
-	return s.Devices[start:end]
+	// Discovery keeps changing Devices in the background
+	return slices.Clone(s.Devices[start:end])
 }
 
 // ---------- TCP LISTENER ----------
 func (c *ConnectionManager) listenTCP() {
-	var err error
-	c.listener, err = net.Listen("tcp", fmt.Sprintf(":%d", connectionPort))
-	if err != nil {
-		fmt.Printf("listenTCP error: %v\n", err)
-		return
+	for _, addr := range c.listenAddresses() {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			fmt.Printf("listenTCP error: %v\n", err)
+			continue
+		}
+		fmt.Printf("TCP listener started on %s\n", listener.Addr())
+
+		c.mu.Lock()
+		c.listeners = append(c.listeners, listener)
+		c.mu.Unlock()
+		go c.acceptTCP(listener)
+	}
+}
+
+// listenAddresses returns the bind address, the addresses of the allowed
+// interfaces, or all interfaces
+func (c *ConnectionManager) listenAddresses() []string {
+	port := strconv.Itoa(c.listen.Port)
+	if c.listen.BindAddress != "" {
+		return []string{net.JoinHostPort(c.listen.BindAddress, port)}
+	}
+	if len(c.listen.Interfaces) == 0 {
+		return []string{":" + port}
 	}
 
-	fmt.Printf("TCP listener started on %s\n", c.listener.Addr())
+	var addrs []string
+	for _, iface := range allowedInterfaces(c.listen.Interfaces) {
+		for _, ip := range interfaceIPs(iface) {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+	}
+	if len(addrs) == 0 {
+		fmt.Printf("[NET] None of the interfaces %v has an address\n", c.listen.Interfaces)
+	}
+	return addrs
+}
 
+func (c *ConnectionManager) acceptTCP(listener net.Listener) {
 	for {
-		conn, err := c.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			continue
 		}
@@ -246,25 +534,29 @@ func (c *ConnectionManager) listenTCP() {
 }
 
 func (c *ConnectionManager) handleIncomingConnection(conn net.Conn) {
-	buf := make([]byte, 4096)
+	// Decode exactly one message; whatever the decoder read past it
+	// belongs to the persistent stream
+	dec := json.NewDecoder(io.LimitReader(conn, maxHandshakeSize))
 	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
-	n, err := conn.Read(buf)
-	if err != nil {
+	var msg Message
+	if err := dec.Decode(&msg); err != nil {
 		conn.Close()
 		return
 	}
 	conn.SetReadDeadline(time.Time{})
 
-	var msg Message
-	if err := json.Unmarshal(buf[:n], &msg); err != nil {
-		conn.Close()
-		return
-	}
+	// Reply to the address the peer reached us from. Over a VPN it differs
+	// from the LAN address the peer announces.
+	remoteIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 
 	switch msg.Type {
 	case MsgTypeRequest:
 		var req ConnectionRequest
 		json.Unmarshal(msg.Data, &req)
+		req.FromIP = remoteIP
+		if req.FromPort != 0 {
+			c.SetPeerPort(remoteIP, req.FromPort)
+		}
 		if c.OnRequest != nil {
 			c.OnRequest(req)
 		}
@@ -273,26 +565,60 @@ func (c *ConnectionManager) handleIncomingConnection(conn net.Conn) {
 	case MsgTypeResponse:
 		var resp ConnectionResponse
 		json.Unmarshal(msg.Data, &resp)
+		resp.FromIP = remoteIP
 		if c.OnResult != nil {
 			c.OnResult(resp)
 		}
 		conn.Close()
 
+	case MsgTypeProbe:
+		c.answerProbe(conn)
+
 	default:
-		remoteIP := strings.Split(conn.RemoteAddr().String(), ":")[0]
 		fmt.Printf("[DEBUG] Accepting persistent connection from %s\n", remoteIP)
-		c.establishConnection(remoteIP, "", conn, false)
+
+		// A dialer that opens with its hello may be racing our own
+		// connection to it, see handshake.go
+		peer := remoteIP
+		var opening *HelloMessage
+		if msg.Type == MsgTypeHello {
+			var hello HelloMessage
+			json.Unmarshal(msg.Data, &hello)
+			peer = peerKey(hello.DeviceID, remoteIP)
+			if !c.admit(peer, remoteIP, hello) {
+				c.reject(conn)
+				return
+			}
+			opening = &hello
+		}
+
+		reader := io.MultiReader(dec.Buffered(), conn)
+		state, err := c.establishConnection(peer, remoteIP, "", conn, reader, opening, false)
+		if err != nil || opening != nil {
+			return
+		}
+		c.handleMessage(state, msg)
 	}
 }
 
 // ---------- CONNECTION ESTABLISHMENT ----------
 func (c *ConnectionManager) SendRequest(req ConnectionRequest) error {
+	req.FromPort = c.listen.Port
+	c.mu.RLock()
+	req.FromID = c.deviceID
+	c.mu.RUnlock()
+	req.Groups = c.groupTags()
+	req.Time = time.Now().Unix()
+	req.Proofs = c.requestProofs(req)
 	msg := Message{Type: MsgTypeRequest}
 	msg.Data, _ = json.Marshal(req)
 	return c.sendOneTimeMessage(req.ToIP, msg)
 }
 
 func (c *ConnectionManager) SendResponse(resp ConnectionResponse) error {
+	c.mu.RLock()
+	resp.FromID = c.deviceID
+	c.mu.RUnlock()
 	msg := Message{Type: MsgTypeResponse}
 	msg.Data, _ = json.Marshal(resp)
 	return c.sendOneTimeMessage(resp.ToIP, msg)
@@ -310,7 +636,24 @@ func (c *ConnectionManager) sendOneTimeMessage(ip string, msg Message) error {
 	return err
 }
 
-func (c *ConnectionManager) Connect(ip, name string) error {
+// Connect opens the persistent connection to a device that accepted our
+// request. id is the device ID it answered with; older peers have none
+// and are tracked by address.
+func (c *ConnectionManager) Connect(id, ip string) error {
+	peer := peerKey(id, ip)
+	if c.IsConnected(peer) {
+		return nil
+	}
+	c.rememberAddress(peer, ip)
+	c.setLinkState(peer, LinkConnecting)
+	if err := c.connect(peer, ip, ""); err != nil {
+		c.linkFailed(peer)
+		return err
+	}
+	return nil
+}
+
+func (c *ConnectionManager) connect(peer, ip, name string) error {
 	time.Sleep(100 * time.Millisecond)
 
 	conn, err := c.dialTCP(ip)
@@ -324,21 +667,25 @@ func (c *ConnectionManager) Connect(ip, name string) error {
 	}
 
 	fmt.Printf("[DEBUG] Initiating persistent connection to %s\n", ip)
-	return c.establishConnection(ip, name, conn, true)
-}
-
-func (c *ConnectionManager) establishConnection(ip, name string, conn net.Conn, isHub bool) error {
-	c.mu.Lock()
-
-	if _, exists := c.connections[ip]; exists {
-		c.mu.Unlock()
-		conn.Close()
-		fmt.Printf("[DEBUG] Already connected to %s, closing duplicate\n", ip)
-		return fmt.Errorf("already connected to %s", ip)
+	state, err := c.establishConnection(peer, ip, name, conn, conn, nil, true)
+	if err != nil {
+		// The peer's own connection got in first
+		if c.IsConnected(peer) {
+			return nil
+		}
+		return err
 	}
+	return c.awaitConfirm(state)
+}
 
+// establishConnection starts a connection we dialed, or one we accepted
+// when opening holds the dialer's first hello, or is nil for peers too old
+// to send one
+func (c *ConnectionManager) establishConnection(peer, ip, name string, conn net.Conn, reader io.Reader, opening *HelloMessage, isHub bool) (*ConnectionState, error) {
 	state := &ConnectionState{
 		conn:          conn,
+		reader:        reader,
+		key:           peer,
 		ip:            ip,
 		name:          name,
 		isHub:         isHub,
@@ -346,9 +693,28 @@ func (c *ConnectionManager) establishConnection(ip, name string, conn net.Conn,
 		readChan:      make(chan Message, 100),
 		writeChan:     make(chan Message, 100),
 		closeChan:     make(chan struct{}),
+		confirmed:     make(chan struct{}),
+		relayQueue:    make(chan Message, relayQueueSize),
+		nonce:         newMessageID(),
+	}
+	state.stats.since = time.Now()
+
+	// The opening hello is taken in before anything else the dialer sends
+	if opening != nil {
+		state.peerNonce = opening.Nonce
+		state.deviceID = opening.DeviceID
+		state.peerName = opening.Name
+		state.groups = c.provenGroups(NormalizeGroups(opening.Groups), nil, state.nonce, "")
 	}
 
-	c.connections[ip] = state
+	c.mu.Lock()
+	if _, exists := c.connections[peer]; exists {
+		c.mu.Unlock()
+		conn.Close()
+		fmt.Printf("[DEBUG] Already connected to %s, closing duplicate\n", peer)
+		return nil, fmt.Errorf("already connected to %s", peer)
+	}
+	c.connections[peer] = state
 	c.mu.Unlock()
 
 	fmt.Printf("[DEBUG] Connection established with %s (isHub=%v)\n", ip, isHub)
@@ -356,12 +722,38 @@ func (c *ConnectionManager) establishConnection(ip, name string, conn net.Conn,
 	go c.readLoop(state)
 	go c.writeLoop(state)
 	go c.heartbeatLoop(state)
+	go c.relayLoop(state)
+
+	// Our hello opens the handshake when we dialed, and answers the
+	// dialer's when we accepted. The dialer's answer then confirms the
+	// connection; dialers too old to send a nonce never answer.
+	c.sendHello(state, false)
+	if !isHub && state.peerNonce == "" {
+		c.confirm(state)
+	}
+
+	return state, nil
+}
+
+// connectionLive starts using a connection both sides agreed on
+func (c *ConnectionManager) connectionLive(state *ConnectionState) {
+	connectedPeers.Add(1)
+	peer := state.peer()
+	c.rememberAddress(peer, state.ip)
+	c.linkUp(peer, state.name, state.isHub)
 
 	if c.onConnEstablished != nil {
-		c.onConnEstablished(ip)
+		c.onConnEstablished(peer)
 	}
 
-	return nil
+	if queue := c.outboundQueue(); queue != nil {
+		if c.trusts(state) {
+			queue.Trust(peer)
+		}
+		go c.flushQueue(state, queue)
+	}
+	go c.resumeTransfers(state)
+	go c.announcePeers(state)
 }
 
 // ---------- CONNECTION LOOPS ----------
@@ -369,7 +761,9 @@ func (c *ConnectionManager) readLoop(state *ConnectionState) {
 	defer c.handleConnectionClose(state)
 
 	// Use JSON decoder for proper streaming
-	dec := json.NewDecoder(state.conn)
+	frames := &frameLimitReader{r: countingReader{state.reader, &state.stats.bytesIn}, limit: maxFrameSize}
+	dec := json.NewDecoder(frames)
+	frames.dec = dec
 
 	for {
 		select {
@@ -383,8 +777,12 @@ func (c *ConnectionManager) readLoop(state *ConnectionState) {
 		var msg Message
 		if err := dec.Decode(&msg); err != nil {
 			fmt.Printf("[DEBUG] Read/decode error from %s: %v\n", state.ip, err)
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				state.stats.errors.Add(1)
+			}
 			return
 		}
+		state.stats.messagesIn.Add(1)
 
 		c.handleMessage(state, msg)
 	}
@@ -392,7 +790,7 @@ func (c *ConnectionManager) readLoop(state *ConnectionState) {
 
 func (c *ConnectionManager) writeLoop(state *ConnectionState) {
 	// Use JSON encoder for proper streaming
-	enc := json.NewEncoder(state.conn)
+	enc := json.NewEncoder(countingWriter{state.conn, &state.stats.bytesOut})
 
 	for {
 		select {
@@ -402,8 +800,43 @@ func (c *ConnectionManager) writeLoop(state *ConnectionState) {
 			state.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if err := enc.Encode(&msg); err != nil {
 				fmt.Printf("[DEBUG] Write error to %s: %v\n", state.ip, err)
+				state.stats.errors.Add(1)
+				state.conn.Close()
 				return
 			}
+			state.stats.messagesOut.Add(1)
+			if msg.written != nil {
+				close(msg.written)
+			}
+		}
+	}
+}
+
+// sendWritten queues a message and waits until the write loop wrote it to
+// the socket. Being queued says nothing: the connection may drop before
+// the write loop gets to it.
+func (s *ConnectionState) sendWritten(msg Message, timeout time.Duration) bool {
+	written := make(chan struct{})
+	msg.written = written
+
+	select {
+	case s.writeChan <- msg:
+	case <-s.closeChan:
+		return false
+	case <-time.After(timeout):
+		return false
+	}
+
+	select {
+	case <-written:
+		return true
+	case <-s.closeChan:
+		// It may have gone out just before the connection closed
+		select {
+		case <-written:
+			return true
+		default:
+			return false
 		}
 	}
 }
@@ -417,6 +850,8 @@ func (c *ConnectionManager) heartbeatLoop(state *ConnectionState) {
 		case <-state.closeChan:
 			return
 		case <-ticker.C:
+			state.stats.sample()
+
 			hb := HeartbeatMessage{
 				FromIP:    c.LocalIP,
 				Timestamp: time.Now(),
@@ -427,6 +862,7 @@ func (c *ConnectionManager) heartbeatLoop(state *ConnectionState) {
 			select {
 			case state.writeChan <- msg:
 			case <-time.After(1 * time.Second):
+				state.stats.errors.Add(1)
 				return
 			}
 
@@ -436,6 +872,8 @@ func (c *ConnectionManager) heartbeatLoop(state *ConnectionState) {
 
 			if time.Since(lastHB) > connectionTimeout {
 				fmt.Printf("[DEBUG] Connection to %s timed out\n", state.ip)
+				state.stats.errors.Add(1)
+				state.conn.Close()
 				return
 			}
 		}
@@ -443,9 +881,22 @@ func (c *ConnectionManager) heartbeatLoop(state *ConnectionState) {
 }
 
 func (c *ConnectionManager) handleMessage(state *ConnectionState, msg Message) {
+	// Messages carrying an ID may reach us over several paths, and only
+	// concern members of the groups they are scoped to. They are relayed
+	// once we accepted them ourselves.
+	if msg.ID != "" {
+		if !c.seen.add(msg.ID) {
+			return
+		}
+		if len(SharedGroups(msg.Groups, c.groupTags())) == 0 {
+			return
+		}
+	}
+
 	switch msg.Type {
 	case MsgTypeHeartbeat:
-		ack := Message{Type: MsgTypeHeartbeatAck}
+		// The echoed timestamp lets the sender measure the round trip
+		ack := Message{Type: MsgTypeHeartbeatAck, Data: msg.Data}
 		select {
 		case state.writeChan <- ack:
 		default:
@@ -456,18 +907,53 @@ func (c *ConnectionManager) handleMessage(state *ConnectionState, msg Message) {
 		state.lastHeartbeat = time.Now()
 		state.mu.Unlock()
 
+		var hb HeartbeatMessage
+		if err := json.Unmarshal(msg.Data, &hb); err == nil && !hb.Timestamp.IsZero() {
+			if rtt := time.Since(hb.Timestamp); rtt >= 0 {
+				state.stats.observeRTT(rtt)
+			}
+		}
+
+	case MsgTypeHello:
+		var hello HelloMessage
+		if err := json.Unmarshal(msg.Data, &hello); err == nil {
+			c.handleHello(state, hello)
+		}
+
 	case MsgTypeClipboard:
 		var clipData ClipboardData
 		if err := json.Unmarshal(msg.Data, &clipData); err == nil {
+			if !c.acceptClipboard(state, clipData) {
+				return
+			}
+			c.relay(state, msg)
+			clipboardReceived.With(clipboardType(msg.Type)).Inc()
 			if c.OnClipboard != nil {
 				c.OnClipboard(clipData)
 			}
 		}
 
+	case MsgTypePrimary:
+		var clipData ClipboardData
+		if err := json.Unmarshal(msg.Data, &clipData); err == nil {
+			if !c.acceptClipboard(state, clipData) {
+				return
+			}
+			c.relay(state, msg)
+			clipboardReceived.With(clipboardType(msg.Type)).Inc()
+			if c.OnPrimary != nil {
+				c.OnPrimary(clipData)
+			}
+		}
+
 	case MsgTypeFileChunkStart:
 		var start FileChunkStart
 		if err := json.Unmarshal(msg.Data, &start); err == nil {
-			if c.OnFileChunkStart != nil {
+			if !c.acceptTransfer(state, start) {
+				return
+			}
+			c.relay(state, msg)
+			if start.TextType == "" && c.OnFileChunkStart != nil {
 				c.OnFileChunkStart(start)
 			}
 		}
@@ -475,7 +961,12 @@ func (c *ConnectionManager) handleMessage(state *ConnectionState, msg Message) {
 	case MsgTypeFileChunkData:
 		var chunk FileChunkData
 		if err := json.Unmarshal(msg.Data, &chunk); err == nil {
-			if c.OnFileChunkData != nil {
+			isText, ok := c.trackChunk(state, chunk)
+			if !ok {
+				return
+			}
+			c.relay(state, msg)
+			if !isText && c.OnFileChunkData != nil {
 				c.OnFileChunkData(chunk)
 			}
 		}
@@ -483,6 +974,20 @@ func (c *ConnectionManager) handleMessage(state *ConnectionState, msg Message) {
 	case MsgTypeFileChunkComplete:
 		var complete FileChunkComplete
 		if err := json.Unmarshal(msg.Data, &complete); err == nil {
+			c.transfersMu.Lock()
+			transfer, exists := c.transfers[complete.FileID]
+			delete(c.transfers, complete.FileID)
+			c.transfersMu.Unlock()
+			if !exists {
+				return
+			}
+			c.relay(state, msg)
+			if transfer.start.TextType != "" {
+				c.completeText(transfer)
+				return
+			}
+			transferDuration.With(directionReceived).ObserveDuration(time.Since(transfer.started))
+			clipboardReceived.With(clipboardType(MsgTypeFileChunkStart)).Inc()
 			if c.OnFileChunkComplete != nil {
 				c.OnFileChunkComplete(complete)
 			}
@@ -491,45 +996,232 @@ func (c *ConnectionManager) handleMessage(state *ConnectionState, msg Message) {
 	case MsgTypeDisconnect:
 		var discMsg DisconnectMessage
 		if err := json.Unmarshal(msg.Data, &discMsg); err == nil {
+			state.markClosing(discMsg.Forget)
+			if discMsg.Forget {
+				c.forget(state.peer())
+			}
 			if c.OnDisconnect != nil {
-				c.OnDisconnect(discMsg.FromIP, discMsg.Reason)
+				c.OnDisconnect(state.peer(), discMsg.Reason)
 			}
 		}
 
 	case MsgTypeShutdown:
+		state.markClosing(false)
 		if c.OnDisconnect != nil {
-			c.OnDisconnect(state.ip, "Hub shutdown")
+			c.OnDisconnect(state.peer(), "Hub shutdown")
+		}
+
+	case MsgTypeFileResume:
+		var resume FileResume
+		if err := json.Unmarshal(msg.Data, &resume); err == nil {
+			c.handleResume(state, resume)
+		}
+	}
+}
+
+// acceptTransfer registers an incoming transfer, refusing it when it
+// exceeds the receive limit
+func (c *ConnectionManager) acceptTransfer(state *ConnectionState, start FileChunkStart) bool {
+	limit := c.Limits().MaxReceiveSize
+	if start.TotalSize < 0 || (limit > 0 && start.TotalSize > limit) {
+		fmt.Printf("[NET] Refusing %s from %s: %d bytes exceeds limit of %d\n",
+			start.FileName, state.ip, start.TotalSize, limit)
+		transferFailures.With(directionReceived, "too_large").Inc()
+		if c.OnTooLarge != nil {
+			c.OnTooLarge(start.FromIP, start.FileName, start.TotalSize)
+		}
+		return false
+	}
+
+	transfer := &incomingTransfer{
+		start:     start,
+		remaining: start.TotalSize,
+		received:  make(map[int]bool),
+		started:   time.Now(),
+		updated:   time.Now(),
+	}
+	if start.TextType != "" {
+		transfer.text = make(map[int][]byte)
+	}
+
+	c.transfersMu.Lock()
+	c.pruneTransfersLocked()
+	c.transfers[start.FileID] = transfer
+	c.transfersMu.Unlock()
+	return true
+}
+
+// acceptClipboard checks text sent in a single message, as older peers
+// send even large text, against the receive limit
+func (c *ConnectionManager) acceptClipboard(state *ConnectionState, clip ClipboardData) bool {
+	size := int64(len(clip.Content))
+	for _, rep := range clip.Representations {
+		size += int64(len(rep.Data))
+	}
+
+	limit := c.Limits().MaxReceiveSize
+	if limit <= 0 || size <= limit {
+		return true
+	}
+	fmt.Printf("[NET] Refusing clipboard text from %s: %d bytes exceeds limit of %d\n", state.ip, size, limit)
+	transferFailures.With(directionReceived, "too_large").Inc()
+	if c.OnTooLarge != nil {
+		c.OnTooLarge(clip.FromIP, "clipboard text", size)
+	}
+	return false
+}
+
+// trackChunk checks a chunk against its transfer and keeps it if the
+// transfer carries text. A peer sending more than it announced loses the
+// transfer.
+func (c *ConnectionManager) trackChunk(state *ConnectionState, chunk FileChunkData) (isText, ok bool) {
+	c.transfersMu.Lock()
+	defer c.transfersMu.Unlock()
+
+	transfer, exists := c.transfers[chunk.FileID]
+	if !exists || transfer.received[chunk.ChunkIndex] {
+		return false, false
+	}
+	transfer.received[chunk.ChunkIndex] = true
+	transfer.remaining -= int64(len(chunk.Data))
+	transferBytes.With(directionReceived).Add(int64(len(chunk.Data)))
+	transfer.updated = time.Now()
+	if transfer.remaining < 0 {
+		fmt.Printf("[NET] %s from %s is larger than announced, dropping it\n",
+			transfer.start.FileName, state.ip)
+		transferFailures.With(directionReceived, "oversized").Inc()
+		delete(c.transfers, chunk.FileID)
+		return false, false
+	}
+	if transfer.text != nil {
+		transfer.text[chunk.ChunkIndex] = chunk.Data
+		return true, true
+	}
+	return false, true
+}
+
+// pruneTransfersLocked forgets transfers that stalled, e.g. because the
+// sender went away
+func (c *ConnectionManager) pruneTransfersLocked() {
+	for id, transfer := range c.transfers {
+		if time.Since(transfer.updated) > transferTimeout {
+			transferFailures.With(directionReceived, "stalled").Inc()
+			delete(c.transfers, id)
+		}
+	}
+}
+
+// completeText delivers text that arrived over the chunked path as if it
+// had been sent in one message
+func (c *ConnectionManager) completeText(transfer *incomingTransfer) {
+	text := make([]byte, 0, transfer.start.TotalSize)
+	for i := 0; i < transfer.start.TotalChunks; i++ {
+		text = append(text, transfer.text[i]...)
+	}
+
+	if transfer.remaining != 0 {
+		fmt.Printf("[NET] Chunked text from %s is incomplete\n", transfer.start.FromIP)
+		transferFailures.With(directionReceived, "incomplete").Inc()
+		return
+	}
+	if !VerifyChecksum(text, transfer.start.Checksum) {
+		fmt.Printf("[NET] Chunked text from %s is corrupted\n", transfer.start.FromIP)
+		transferFailures.With(directionReceived, "corrupted").Inc()
+		return
+	}
+	transferDuration.With(directionReceived).ObserveDuration(time.Since(transfer.started))
+	clipboardReceived.With(clipboardType(transfer.start.TextType)).Inc()
+
+	data := ClipboardData{
+		FromIP:    transfer.start.FromIP,
+		Content:   string(text),
+		Timestamp: time.Now().Unix(),
+	}
+	switch transfer.start.TextType {
+	case MsgTypeClipboard:
+		if c.OnClipboard != nil {
+			c.OnClipboard(data)
+		}
+	case MsgTypePrimary:
+		if c.OnPrimary != nil {
+			c.OnPrimary(data)
 		}
 	}
 }
 
 func (c *ConnectionManager) handleConnectionClose(state *ConnectionState) {
+	state.shutdown()
 	state.conn.Close()
 
+	// A connection closing mid-handshake never goes live
+	state.confirmOnce.Do(func() {})
+	if state.isConfirmed() {
+		connectedPeers.Add(-1)
+	}
+
+	peer := state.peer()
 	c.mu.Lock()
-	delete(c.connections, state.ip)
+	if c.connections[peer] == state {
+		delete(c.connections, peer)
+	}
 	c.mu.Unlock()
 
 	fmt.Printf("[DEBUG] Connection closed with %s\n", state.ip)
+	if state.isConfirmed() {
+		go c.announcePeers(state)
+	}
+
+	// Another connection to the peer took over
+	if state.isReplaced() {
+		return
+	}
+
+	// A failed handshake is reported by whoever dialed, and leaves any
+	// link to the peer alone
+	if !state.isConfirmed() {
+		return
+	}
+
+	// Links that drop without either side ending them come back by
+	// themselves. That takes a device ID to find the peer again; clients
+	// without one are simply gone.
+	state.mu.RLock()
+	closing, forget, known := state.closing, state.forget, state.deviceID != ""
+	state.mu.RUnlock()
+	if !closing && known {
+		c.linkDropped(peer)
+		return
+	}
+	c.linkDown(peer, forget || !known)
 
 	if c.OnDisconnect != nil {
-		c.OnDisconnect(state.ip, "Connection closed")
+		c.OnDisconnect(peer, "Connection closed")
 	}
 }
 
 // ---------- DISCONNECTION ----------
-func (c *ConnectionManager) Disconnect(ip string) error {
+
+// Disconnect ends a connection on the user's request. Neither side queues
+// items for the other afterwards.
+func (c *ConnectionManager) Disconnect(peer string) error {
+	c.forget(peer)
+	return c.disconnect(peer, true)
+}
+
+func (c *ConnectionManager) disconnect(peer string, forget bool) error {
 	c.mu.Lock()
-	state, exists := c.connections[ip]
+	state, exists := c.connections[peer]
 	c.mu.Unlock()
 
 	if !exists {
-		return fmt.Errorf("not connected to %s", ip)
+		return fmt.Errorf("not connected to %s", peer)
 	}
+	state.markClosing(forget)
 
 	discMsg := DisconnectMessage{
 		FromIP: c.LocalIP,
 		Reason: "User disconnected",
+		Forget: forget,
 	}
 	msg := Message{Type: MsgTypeDisconnect}
 	msg.Data, _ = json.Marshal(discMsg)
@@ -540,20 +1232,21 @@ func (c *ConnectionManager) Disconnect(ip string) error {
 	case <-time.After(1 * time.Second):
 	}
 
-	close(state.closeChan)
+	state.shutdown()
 	return nil
 }
 
 func (c *ConnectionManager) DisconnectAll() {
 	c.mu.RLock()
-	ips := make([]string, 0, len(c.connections))
-	for ip := range c.connections {
-		ips = append(ips, ip)
+	peers := make([]string, 0, len(c.connections))
+	for peer := range c.connections {
+		peers = append(peers, peer)
 	}
 	c.mu.RUnlock()
 
-	for _, ip := range ips {
-		c.Disconnect(ip)
+	// Peers stay trusted, so items copied meanwhile reach them later
+	for _, peer := range peers {
+		c.disconnect(peer, false)
 	}
 }
 
@@ -574,35 +1267,151 @@ func (c *ConnectionManager) ShutdownAsHub() {
 }
 
 // ---------- CLIPBOARD BROADCAST ----------
-func (c *ConnectionManager) BroadcastClipboard(content string) {
-	clipData := ClipboardData{
-		FromIP:    c.LocalIP,
-		Content:   content,
-		Timestamp: time.Now().Unix(),
+func (c *ConnectionManager) BroadcastClipboard(content string, representations ...Representation) error {
+	return c.broadcastText(MsgTypeClipboard, content, representations)
+}
+
+// BroadcastPrimary sends the PRIMARY selection to all connected peers
+func (c *ConnectionManager) BroadcastPrimary(content string) error {
+	return c.broadcastText(MsgTypePrimary, content, nil)
+}
+
+// checkSendSize refuses items above the send limit
+func (c *ConnectionManager) checkSendSize(name string, size int64) error {
+	if limit := c.Limits().MaxSendSize; limit > 0 && size > limit {
+		fmt.Printf("[NET] Not sending %s: %d bytes exceeds limit of %d\n", name, size, limit)
+		return fmt.Errorf("%s (%d bytes): %w", name, size, ErrTooLarge)
 	}
+	return nil
+}
 
-	msg := Message{Type: MsgTypeClipboard}
-	msg.Data, _ = json.Marshal(clipData)
+func (c *ConnectionManager) broadcastText(msgType MessageType, content string, representations []Representation) error {
+	if err := c.checkSendSize("text", int64(len(content))); err != nil {
+		return err
+	}
+	c.enqueueOffline(QueuedItem{
+		Kind:            msgType,
+		Name:            "text",
+		Representations: representations,
+	}, []byte(content))
+	clipboardSent.With(clipboardType(msgType)).Inc()
+
+	// Large text goes over the chunked path. Rich representations are
+	// dropped there; the plain text is what matters at that size.
+	if len(content) > TextChunkThreshold {
+		data := []byte(content)
+		sum := md5.Sum(data)
+		start := c.newFileStart(textFileName, data, hex.EncodeToString(sum[:]))
+		start.TextType = msgType
+		c.broadcastChunked(start, data)
+		return nil
+	}
+
+	msg := c.textMessage(msgType, content, representations)
+	groups := c.groupTags()
 
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
 	for _, state := range c.connections {
+		scope := SharedGroups(groups, c.peerGroups(state))
+		if len(scope) == 0 || !state.isConfirmed() {
+			continue
+		}
+		scoped := msg
+		scoped.Groups = scope
+
 		select {
-		case state.writeChan <- msg:
+		case state.writeChan <- scoped:
 		case <-time.After(500 * time.Millisecond):
 			fmt.Printf("Failed to send clipboard to %s\n", state.ip)
+			state.stats.errors.Add(1)
 		}
 	}
+	return nil
+}
+
+func (c *ConnectionManager) textMessage(msgType MessageType, content string, representations []Representation) Message {
+	clipData := ClipboardData{
+		FromIP:          c.LocalIP,
+		Content:         content,
+		Timestamp:       time.Now().Unix(),
+		Representations: representations,
+	}
+
+	msg := Message{Type: msgType, ID: newMessageID(), Origin: c.ownID()}
+	msg.Data, _ = json.Marshal(clipData)
+	c.seen.add(msg.ID)
+	return msg
 }
 
 // ---------- FILE TRANSFER WITH CHUNKING ----------
-func (c *ConnectionManager) BroadcastFileClipboard(fileName string, fileData []byte, checksum string) {
-	fileID := fmt.Sprintf("%s_%d", fileName, time.Now().Unix())
-	fileSize := int64(len(fileData))
-	totalChunks := (len(fileData) + FileChunkSize - 1) / FileChunkSize
 
-	fmt.Printf("[NET] Broadcasting file %s in %d chunks (%d KB)\n", fileName, totalChunks, fileSize/1024)
+// VerifyChecksum reports whether received data has the MD5 checksum its
+// sender announced, counting mismatches
+func VerifyChecksum(data []byte, checksum string) bool {
+	sum := md5.Sum(data)
+	if hex.EncodeToString(sum[:]) == checksum {
+		return true
+	}
+	checksumMismatches.Inc()
+	return false
+}
+func (c *ConnectionManager) BroadcastFileClipboard(fileName string, fileData []byte, checksum string) error {
+	if err := c.checkSendSize(fileName, int64(len(fileData))); err != nil {
+		return err
+	}
+	c.broadcastFile(fileName, fileData, checksum, "", 0)
+	return nil
+}
+
+// BroadcastFiles sends several files as one batch. The limit applies to
+// the batch as a whole.
+func (c *ConnectionManager) BroadcastFiles(files []OutgoingFile) error {
+	var total int64
+	for _, f := range files {
+		total += int64(len(f.Data))
+	}
+	if err := c.checkSendSize(fmt.Sprintf("%d files", len(files)), total); err != nil {
+		return err
+	}
+
+	batchID := fmt.Sprintf("batch_%d", time.Now().UnixNano())
+	for _, f := range files {
+		c.broadcastFile(f.Name, f.Data, f.Checksum, batchID, len(files))
+	}
+	return nil
+}
+
+func (c *ConnectionManager) broadcastFile(fileName string, fileData []byte, checksum, batchID string, batchTotal int) {
+	c.enqueueOffline(QueuedItem{
+		Kind:       MsgTypeFileChunkStart,
+		Name:       fileName,
+		Checksum:   checksum,
+		BatchID:    batchID,
+		BatchTotal: batchTotal,
+	}, fileData)
+
+	start := c.newFileStart(fileName, fileData, checksum)
+	clipboardSent.With(clipboardType(MsgTypeFileChunkStart)).Inc()
+	start.BatchID = batchID
+	start.BatchTotal = batchTotal
+	c.broadcastChunked(start, fileData)
+}
+
+func (c *ConnectionManager) newFileStart(fileName string, fileData []byte, checksum string) FileChunkStart {
+	return FileChunkStart{
+		FileID:      fmt.Sprintf("%s_%d", fileName, time.Now().UnixNano()),
+		FileName:    fileName,
+		TotalSize:   int64(len(fileData)),
+		TotalChunks: (len(fileData) + FileChunkSize - 1) / FileChunkSize,
+		Checksum:    checksum,
+		FromIP:      c.LocalIP,
+	}
+}
+
+func (c *ConnectionManager) broadcastChunked(start FileChunkStart, fileData []byte) {
+	fmt.Printf("[NET] Broadcasting file %s in %d chunks (%d KB)\n", start.FileName, start.TotalChunks, start.TotalSize/1024)
 
 	c.mu.RLock()
 	connections := make([]*ConnectionState, 0, len(c.connections))
@@ -611,46 +1420,65 @@ func (c *ConnectionManager) BroadcastFileClipboard(fileName string, fileData []b
 	}
 	c.mu.RUnlock()
 
+	connections = slices.DeleteFunc(connections, func(state *ConnectionState) bool {
+		return !state.isConfirmed() || len(c.scopeFor(state)) == 0
+	})
+
 	//Use WaitGroup to ensure all sends complete
 	var wg sync.WaitGroup
 	for _, state := range connections {
 		wg.Add(1)
 		go func(st *ConnectionState) {
 			defer wg.Done()
-			c.sendFileToConnection(st, fileID, fileName, fileData, fileSize, totalChunks, checksum)
+			scope := c.scopeFor(st)
+			if !c.sendChunks(st, start, fileData, scope, nil) {
+				transferFailures.With(directionSent, "interrupted").Inc()
+				c.keepForResume(st.peer(), &pendingTransfer{start: start, data: fileData, scope: scope, since: time.Now()})
+			}
 		}(state)
 	}
 	wg.Wait()
 	fmt.Printf("[NET] All file transfers initiated\n")
 }
 
-func (c *ConnectionManager) sendFileToConnection(state *ConnectionState, fileID, fileName string,
-	fileData []byte, fileSize int64, totalChunks int, checksum string) {
+func (c *ConnectionManager) sendFileToConnection(state *ConnectionState, start FileChunkStart, fileData []byte) bool {
+	return c.sendChunks(state, start, fileData, c.scopeFor(state), nil)
+}
 
-	// 1. Send start message
-	start := FileChunkStart{
-		FileID:      fileID,
-		FileName:    fileName,
-		TotalSize:   fileSize,
-		TotalChunks: totalChunks,
-		Checksum:    checksum,
-		FromIP:      c.LocalIP,
+// sendChunks sends a transfer in chunks. When resuming, have holds the
+// chunks the peer already got, and the start message is left out.
+func (c *ConnectionManager) sendChunks(state *ConnectionState, start FileChunkStart, fileData []byte, scope []string, have map[int]bool) bool {
+	fileID, fileName, totalChunks, checksum := start.FileID, start.FileName, start.TotalChunks, start.Checksum
+	began := time.Now()
+
+	// 1. Send start message. Message IDs derive from the file ID, so every
+	// peer sees the same ID for the same chunk. A resumed send gets IDs of
+	// its own, or relays would drop it as already seen.
+	prefix := fileID
+	if have != nil {
+		prefix += "/" + newMessageID()
 	}
+	if have == nil {
+		msg := c.chunkMessage(MsgTypeFileChunkStart, prefix+"/start", scope, start)
 
-	msg := Message{Type: MsgTypeFileChunkStart}
-	msg.Data, _ = json.Marshal(start)
-
-	select {
-	case state.writeChan <- msg:
-	case <-time.After(5 * time.Second):
-		fmt.Printf("[NET] Failed to send file start to %s\n", state.ip)
-		return
+		select {
+		case state.writeChan <- msg:
+		case <-state.closeChan:
+			return false
+		case <-time.After(5 * time.Second):
+			fmt.Printf("[NET] Failed to send file start to %s\n", state.ip)
+			state.stats.errors.Add(1)
+			return false
+		}
 	}
 
 	fmt.Printf("[NET] Sending file %s to %s in %d chunks\n", fileName, state.ip, totalChunks)
 
 	// 2. Send chunks
 	for i := 0; i < totalChunks; i++ {
+		if have[i] {
+			continue
+		}
 		startIdx := i * FileChunkSize
 		endIdx := startIdx + FileChunkSize
 		if endIdx > len(fileData) {
@@ -663,15 +1491,19 @@ func (c *ConnectionManager) sendFileToConnection(state *ConnectionState, fileID,
 			Data:       fileData[startIdx:endIdx],
 		}
 
-		msg := Message{Type: MsgTypeFileChunkData}
-		msg.Data, _ = json.Marshal(chunkData)
+		msg := c.chunkMessage(MsgTypeFileChunkData, fmt.Sprintf("%s/%d", prefix, i), scope, chunkData)
 
 		select {
 		case state.writeChan <- msg:
 			// No delay for maximum speed
+			transferBytes.With(directionSent).Add(int64(len(chunkData.Data)))
+		case <-state.closeChan:
+			fmt.Printf("[NET] Connection to %s lost at chunk %d/%d\n", state.ip, i+1, totalChunks)
+			return false
 		case <-time.After(10 * time.Second):
 			fmt.Printf("[NET] Failed to send chunk %d/%d to %s\n", i+1, totalChunks, state.ip)
-			return
+			state.stats.errors.Add(1)
+			return false
 		}
 
 		if (i+1)%10 == 0 || i == totalChunks-1 {
@@ -685,139 +1517,160 @@ func (c *ConnectionManager) sendFileToConnection(state *ConnectionState, fileID,
 		Checksum: checksum,
 	}
 
-	msg = Message{Type: MsgTypeFileChunkComplete}
-	msg.Data, _ = json.Marshal(complete)
-
-	select {
-	case state.writeChan <- msg:
-		fmt.Printf("[NET] File %s sent successfully to %s\n", fileName, state.ip)
-	case <-time.After(5 * time.Second):
+	// The transfer only counts as sent once all of it reached the socket;
+	// until then a drop keeps it for resuming
+	msg := c.chunkMessage(MsgTypeFileChunkComplete, prefix+"/complete", scope, complete)
+	if !state.sendWritten(msg, 5*time.Second) {
 		fmt.Printf("[NET] Failed to send file complete to %s\n", state.ip)
+		state.stats.errors.Add(1)
+		return false
 	}
+	fmt.Printf("[NET] File %s sent successfully to %s\n", fileName, state.ip)
+	transferDuration.With(directionSent).ObserveDuration(time.Since(began))
+	return true
 }
 
-// ---------- STATE QUERIES ----------
-func (c *ConnectionManager) IsConnected(ip string) bool {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	_, exists := c.connections[ip]
-	return exists
-}
-
-func (c *ConnectionManager) GetConnectedIPs() []string {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// ---------- OFFLINE QUEUE ----------
 
-	ips := make([]string, 0, len(c.connections))
-	for ip := range c.connections {
-		ips = append(ips, ip)
+// Approve records that the user accepted a connection request from a
+// device. Only connections we dialed or approved, and proven group
+// members, make a peer trusted for the queue; a device that merely
+// connects to us is not.
+func (c *ConnectionManager) Approve(peer string) {
+	if peer == "" {
+		return
 	}
-	return ips
+	c.mu.Lock()
+	c.approved[peer] = true
+	c.mu.Unlock()
 }
 
-func (c *ConnectionManager) SetOnConnEstablished(callback func(string)) {
-	c.onConnEstablished = callback
+// trusts reports whether a live connection may make its peer trusted:
+// one we dialed, one the user approved, or one that proved it shares a
+// group with a secret. Peers without a device ID are never trusted, as
+// their address may belong to another device tomorrow.
+func (c *ConnectionManager) trusts(state *ConnectionState) bool {
+	state.mu.RLock()
+	peer, id := state.key, state.deviceID
+	state.mu.RUnlock()
+	if id == "" || peer != id {
+		return false
+	}
+	c.mu.RLock()
+	approved := c.approved[peer]
+	c.mu.RUnlock()
+	return state.isHub || approved || c.SharesSecretGroup(c.peerGroups(state))
 }
 
-// ---------- NETWORK UTILITIES ----------
-func (c *ConnectionManager) dialTCP(toIP string) (net.Conn, error) {
-	localIP := c.LocalIP
-	laddr, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:0", localIP))
-	raddr, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", toIP, connectionPort))
-
-	dialer := net.Dialer{
-		LocalAddr: laddr,
-		Timeout:   5 * time.Second,
+// forget stops trusting a peer
+func (c *ConnectionManager) forget(peer string) {
+	c.mu.Lock()
+	delete(c.approved, peer)
+	c.mu.Unlock()
+	if queue := c.outboundQueue(); queue != nil {
+		queue.Forget(peer)
 	}
-
-	return dialer.Dial("tcp", raddr.String())
 }
 
-func getPreferredLocalIP() string {
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		return "127.0.0.1"
+// enqueueOffline queues an item for trusted peers that aren't connected
+func (c *ConnectionManager) enqueueOffline(item QueuedItem, data []byte) {
+	queue := c.outboundQueue()
+	if queue == nil {
+		return
 	}
 
-	var ethernetIP, wifiIP, otherIP string
-
-	for _, iface := range interfaces {
-		if (iface.Flags&net.FlagUp) == 0 || (iface.Flags&net.FlagLoopback) != 0 {
-			continue
+	var offline []string
+	for _, peer := range queue.Trusted() {
+		if !c.IsConnected(peer) {
+			offline = append(offline, peer)
 		}
+	}
+	if err := queue.add(item, data, offline); err != nil {
+		fmt.Printf("[QUEUE] Not queued: %v\n", err)
+	}
+}
 
-		name := strings.ToLower(iface.Name)
+// flushQueue sends a reconnected peer what was queued for it
+func (c *ConnectionManager) flushQueue(state *ConnectionState, queue *OutboundQueue) {
+	items := queue.pending(state.peer())
+	if len(items) == 0 {
+		return
+	}
+	fmt.Printf("[QUEUE] Delivering %d queued item(s) to %s\n", len(items), state.ip)
 
-		if strings.Contains(name, "vbox") ||
-			strings.Contains(name, "virtual") ||
-			strings.Contains(name, "vm") ||
-			strings.Contains(name, "docker") ||
-			strings.Contains(name, "veth") {
-			continue
-		}
+	if len(c.scopeFor(state)) == 0 {
+		return
+	}
 
-		addrs, err := iface.Addrs()
+	for _, item := range items {
+		data, err := queue.load(item.ID)
 		if err != nil {
+			fmt.Printf("[QUEUE] Failed to load %s: %v\n", item.Name, err)
 			continue
 		}
 
-		for _, addr := range addrs {
-			ipnet, ok := addr.(*net.IPNet)
-			if !ok || ipnet.IP.To4() == nil {
-				continue
-			}
-
-			ip := ipnet.IP.String()
-			if isIgnoredIP(ip) {
-				continue
-			}
+		sent := false
+		switch {
+		case item.Kind == MsgTypeFileChunkStart:
+			start := c.newFileStart(item.Name, data, item.Checksum)
+			start.BatchID = item.BatchID
+			start.BatchTotal = item.BatchTotal
+			sent = c.sendFileToConnection(state, start, data)
+		case len(data) > TextChunkThreshold:
+			sum := md5.Sum(data)
+			start := c.newFileStart(textFileName, data, hex.EncodeToString(sum[:]))
+			start.TextType = item.Kind
+			sent = c.sendFileToConnection(state, start, data)
+		default:
+			msg := c.textMessage(item.Kind, string(data), item.Representations)
+			msg.Groups = c.scopeFor(state)
+			sent = state.sendWritten(msg, 5*time.Second)
+		}
 
-			if strings.Contains(name, "eth") || strings.Contains(name, "en") {
-				if ethernetIP == "" {
-					ethernetIP = ip
-				}
-			} else if strings.Contains(name, "wlan") || strings.Contains(name, "wi") {
-				if wifiIP == "" {
-					wifiIP = ip
-				}
-			} else {
-				if otherIP == "" {
-					otherIP = ip
-				}
-			}
+		if !sent {
+			fmt.Printf("[QUEUE] Delivery to %s interrupted, keeping the rest\n", state.ip)
+			return
 		}
+		queue.delivered(item.ID, state.peer())
 	}
+}
 
-	if ethernetIP != "" {
-		fmt.Printf("Selected Ethernet IP: %s\n", ethernetIP)
-		return ethernetIP
-	}
-	if wifiIP != "" {
-		fmt.Printf("Selected Wi-Fi IP: %s\n", wifiIP)
-		return wifiIP
-	}
-	if otherIP != "" {
-		fmt.Printf("Selected other IP: %s\n", otherIP)
-		return otherIP
-	}
+// ---------- STATE QUERIES ----------
+// IsConnected reports whether there is a connection to a peer, by the
+// key from Device.Key
+func (c *ConnectionManager) IsConnected(peer string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, exists := c.connections[peer]
+	return exists
+}
+
+func (c *ConnectionManager) GetConnectedIPs() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err == nil {
-		defer conn.Close()
-		localAddr := conn.LocalAddr().(*net.UDPAddr)
-		fmt.Printf("Selected fallback IP: %s\n", localAddr.IP.String())
-		return localAddr.IP.String()
+	ips := make([]string, 0, len(c.connections))
+	for _, state := range c.connections {
+		ips = append(ips, state.ip)
 	}
+	return ips
+}
 
-	return "127.0.0.1"
+func (c *ConnectionManager) SetOnConnEstablished(callback func(string)) {
+	c.onConnEstablished = callback
 }
 
-func isIgnoredIP(ip string) bool {
-	return ip == "127.0.0.1" ||
-		strings.HasPrefix(ip, "192.168.56.") ||
-		strings.HasPrefix(ip, "169.254.") ||
-		strings.HasPrefix(ip, "172.17.") ||
-		strings.HasPrefix(ip, "172.18.")
+// ---------- NETWORK UTILITIES ----------
+func (c *ConnectionManager) dialTCP(toIP string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+
+	// The routing table picks the interface, unless we were told which
+	// address to use
+	if c.listen.BindAddress != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(c.listen.BindAddress)}
+	}
+
+	return dialer.Dial("tcp", net.JoinHostPort(toIP, strconv.Itoa(c.peerPort(toIP))))
 }
 
 func getMACForIP(ip string) string {
@@ -843,11 +1696,18 @@ func getMACForIP(ip string) string {
 	return ""
 }
 
-func (s *DeviceStore) FindNameByIP(ip string) string {
+// FindName returns the name of the device with the given key or address.
+// Keys come first, as several devices may share an address.
+func (s *DeviceStore) FindName(peer string) string {
 	s.DevicesMu.RLock()
 	defer s.DevicesMu.RUnlock()
 	for _, d := range s.Devices {
-		if d.IP == ip {
+		if d.Key() == peer {
+			return d.Name
+		}
+	}
+	for _, d := range s.Devices {
+		if slices.Contains(d.Addresses, peer) {
 			return d.Name
 		}
 	}
@@ -858,11 +1718,11 @@ func (c *ConnectionManager) CheckDisconnects(ds *DeviceStore, update func()) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	for ip := range c.connections {
+	for peer := range c.connections {
 		found := false
 		ds.DevicesMu.RLock()
 		for _, d := range ds.Devices {
-			if d.IP == ip {
+			if d.Key() == peer {
 				found = true
 				break
 			}
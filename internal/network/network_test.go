@@ -0,0 +1,75 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func frameDecoder(stream []byte, limit int64) *json.Decoder {
+	frames := &frameLimitReader{r: bytes.NewReader(stream), limit: limit}
+	dec := json.NewDecoder(frames)
+	frames.dec = dec
+	return dec
+}
+
+func encodeFrames(t *testing.T, sizes ...int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, size := range sizes {
+		if err := enc.Encode(Message{Type: MsgTypeClipboard, ID: strings.Repeat("x", size)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestFrameLimitPerMessage(t *testing.T) {
+	// Many messages under the limit add up to far more than it
+	dec := frameDecoder(encodeFrames(t, 600, 600, 600, 600, 600), 1024)
+	for i := range 5 {
+		var msg Message
+		if err := dec.Decode(&msg); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+
+	// One message over it fails, even after small ones
+	dec = frameDecoder(encodeFrames(t, 100, 2000), 1024)
+	var msg Message
+	if err := dec.Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&msg); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("got %v, want ErrTooLarge", err)
+	}
+}
+
+func TestAcceptClipboardLimit(t *testing.T) {
+	c := &ConnectionManager{}
+	c.SetLimits(Limits{MaxReceiveSize: 100})
+	var refused int64
+	c.OnTooLarge = func(fromIP, name string, size int64) { refused = size }
+	state := &ConnectionState{ip: "10.0.0.2"}
+
+	if !c.acceptClipboard(state, ClipboardData{Content: strings.Repeat("a", 100)}) {
+		t.Error("text at the limit refused")
+	}
+
+	// Representations count towards the limit
+	big := ClipboardData{
+		Content:         strings.Repeat("a", 60),
+		Representations: []Representation{{MimeType: "text/html", Data: make([]byte, 60)}},
+	}
+	if c.acceptClipboard(state, big) || refused != 120 {
+		t.Errorf("accepted text over the limit, refused %d", refused)
+	}
+
+	c.SetLimits(Limits{})
+	if !c.acceptClipboard(state, big) {
+		t.Error("refused text without a limit")
+	}
+}
@@ -0,0 +1,170 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Peers are tracked by device ID, so a device that comes back on another
+// address, e.g. over IPv6 or with a new DHCP lease, keeps its link, its
+// interrupted transfers and its queued items. Addresses are only where a
+// peer is dialed. Peers too old to announce an ID are tracked by address.
+
+// peerAddrs is where a peer can be dialed
+type peerAddrs struct {
+	addrs []string // the one most likely to work first
+	port  int
+}
+
+// peerKey identifies a peer: its device ID, or its address without one
+func peerKey(id, ip string) string {
+	if id != "" {
+		return id
+	}
+	return ip
+}
+
+// Key identifies the device to the ConnectionManager, e.g. for
+// IsConnected, Link and Disconnect
+func (d Device) Key() string {
+	return peerKey(d.ID, d.IP)
+}
+
+// UpdatePeer records where a discovered device can be reached now. Its
+// link is redialed on these addresses from now on.
+func (c *ConnectionManager) UpdatePeer(d Device) {
+	addrs := slices.Clone(d.Addresses)
+	if d.IP != "" && !slices.Contains(addrs, d.IP) {
+		addrs = append(addrs, d.IP)
+	}
+	slices.SortStableFunc(addrs, func(a, b string) int { return addressRank(a) - addressRank(b) })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peers[d.Key()] = &peerAddrs{addrs: addrs, port: d.Port}
+}
+
+// SetPeerPort records the port a peer listens on, for peers known only by
+// address so far
+func (c *ConnectionManager) SetPeerPort(ip string, port int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.peers[ip]; ok {
+		p.port = port
+		return
+	}
+	c.peers[ip] = &peerAddrs{addrs: []string{ip}, port: port}
+}
+
+// rememberAddress puts the address a peer was reached on first in line
+// for redialing it
+func (c *ConnectionManager) rememberAddress(peer, ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.peers[peer]
+	if !ok {
+		p = &peerAddrs{port: c.peerPortLocked(ip)}
+		c.peers[peer] = p
+	}
+	p.addrs = append([]string{ip}, slices.DeleteFunc(p.addrs, func(a string) bool { return a == ip })...)
+}
+
+// peerAddresses returns where to dial a peer, best first
+func (c *ConnectionManager) peerAddresses(peer string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if p, ok := c.peers[peer]; ok && len(p.addrs) > 0 {
+		return slices.Clone(p.addrs)
+	}
+	if parseIP(peer) != nil {
+		return []string{peer}
+	}
+	return nil
+}
+
+func (c *ConnectionManager) peerPort(ip string) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.peerPortLocked(ip)
+}
+
+func (c *ConnectionManager) peerPortLocked(ip string) int {
+	if p, ok := c.peers[ip]; ok && p.port != 0 {
+		return p.port
+	}
+	for _, p := range c.peers {
+		if p.port != 0 && slices.Contains(p.addrs, ip) {
+			return p.port
+		}
+	}
+	return DefaultPort
+}
+
+// dialPeer connects to a peer on the first of its addresses that answers
+func (c *ConnectionManager) dialPeer(peer, name string) error {
+	addrs := c.peerAddresses(peer)
+	if len(addrs) == 0 {
+		return fmt.Errorf("no address known for %s", peer)
+	}
+	var errs []error
+	for _, ip := range addrs {
+		err := c.connect(peer, ip, name)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// rekey files a connection under the device ID from the peer's hello. A
+// connection known only by address so far moves to the ID; one that
+// reached another device than expected is closed.
+func (c *ConnectionManager) rekey(state *ConnectionState, id string) bool {
+	c.mu.Lock()
+	state.mu.Lock()
+	old := state.key
+	if old == id {
+		state.mu.Unlock()
+		c.mu.Unlock()
+		return true
+	}
+	if old != state.ip {
+		state.mu.Unlock()
+		c.mu.Unlock()
+		fmt.Printf("[NET] %s is not the device we expected, closing\n", state.ip)
+		state.markClosing(false)
+		state.shutdown()
+		state.conn.Close()
+		return false
+	}
+	state.key = id
+	state.mu.Unlock()
+
+	if c.connections[old] == state {
+		delete(c.connections, old)
+	}
+	if l, ok := c.links[old]; ok {
+		delete(c.links, old)
+		if _, taken := c.links[id]; taken {
+			stopRetryLocked(l)
+		} else {
+			c.links[id] = l
+		}
+	}
+	other := c.connections[id]
+	if other == nil {
+		c.connections[id] = state
+	}
+	c.mu.Unlock()
+
+	if other != nil {
+		fmt.Printf("[DEBUG] Already connected to %s, closing duplicate\n", id)
+		state.markReplaced()
+		state.shutdown()
+		state.conn.Close()
+		return false
+	}
+	return true
+}
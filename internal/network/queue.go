@@ -0,0 +1,312 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// QueueLimits caps the offline queue
+type QueueLimits struct {
+	MaxItems int
+	MaxBytes int64
+	TTL      time.Duration
+}
+
+// QueuedItem is a clipboard item or file waiting for offline peers. The
+// payload is stored next to the index, in <ID>.data, unencrypted and
+// readable by the user only.
+type QueuedItem struct {
+	ID   string      `json:"id"`
+	Kind MessageType `json:"kind"` // MsgTypeClipboard, MsgTypePrimary or MsgTypeFileChunkStart
+	Name string      `json:"name"`
+	Size int64       `json:"size"`
+
+	// Peers still waiting for the item, by device ID
+	Peers []string `json:"peers"`
+
+	Checksum        string           `json:"checksum,omitempty"`
+	BatchID         string           `json:"batch_id,omitempty"`
+	BatchTotal      int              `json:"batch_total,omitempty"`
+	Representations []Representation `json:"representations,omitempty"`
+
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// queueState is what queue.json holds
+type queueState struct {
+	// Trusted peers, by device ID, get items queued while they are
+	// offline. A peer is trusted once connected with the user's consent,
+	// see ConnectionManager.Approve, and forgotten when either side
+	// disconnects on purpose.
+	Trusted []string      `json:"trusted"`
+	Items   []*QueuedItem `json:"items"`
+}
+
+// OutboundQueue keeps items for trusted peers that are offline and hands
+// them out when the peer reconnects
+type OutboundQueue struct {
+	dir    string
+	limits QueueLimits
+	state  queueState
+	mu     sync.Mutex
+
+	// OnChange is called after items were added, delivered or removed
+	OnChange func()
+}
+
+// NewOutboundQueue loads the queue stored in dir, dropping expired items
+func NewOutboundQueue(dir string, limits QueueLimits) (*OutboundQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create queue dir: %w", err)
+	}
+
+	q := &OutboundQueue{dir: dir, limits: limits}
+
+	data, err := os.ReadFile(q.indexPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read queue: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &q.state); err != nil {
+			fmt.Printf("[QUEUE] Discarding unreadable queue: %v\n", err)
+			q.state = queueState{}
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.state.Items = slices.DeleteFunc(q.state.Items, func(item *QueuedItem) bool {
+		_, err := os.Stat(q.dataPath(item.ID))
+		return err != nil
+	})
+
+	// Older versions trusted addresses, which may belong to another
+	// device by now
+	isAddress := func(peer string) bool { return parseIP(peer) != nil }
+	q.state.Trusted = slices.DeleteFunc(q.state.Trusted, isAddress)
+	for _, item := range q.state.Items {
+		item.Peers = slices.DeleteFunc(item.Peers, isAddress)
+	}
+	q.pruneLocked()
+	q.removeOrphansLocked()
+	return q, q.saveLocked()
+}
+
+// Trust marks a peer as one that gets items queued while offline
+func (q *OutboundQueue) Trust(peer string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if slices.Contains(q.state.Trusted, peer) {
+		return
+	}
+	q.state.Trusted = append(q.state.Trusted, peer)
+	q.saveLocked()
+}
+
+// Forget stops queueing for a peer and drops what was waiting for it
+func (q *OutboundQueue) Forget(peer string) {
+	q.mu.Lock()
+	q.state.Trusted = slices.DeleteFunc(q.state.Trusted, func(t string) bool { return t == peer })
+	for _, item := range q.state.Items {
+		item.Peers = slices.DeleteFunc(item.Peers, func(p string) bool { return p == peer })
+	}
+	q.pruneLocked()
+	q.saveLocked()
+	q.mu.Unlock()
+
+	q.changed()
+}
+
+// Trusted returns the trusted peers
+func (q *OutboundQueue) Trusted() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return slices.Clone(q.state.Trusted)
+}
+
+// Items returns a snapshot of the queued items, oldest first
+func (q *OutboundQueue) Items() []QueuedItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pruneLocked()
+	items := make([]QueuedItem, 0, len(q.state.Items))
+	for _, item := range q.state.Items {
+		copied := *item
+		copied.Peers = slices.Clone(item.Peers)
+		items = append(items, copied)
+	}
+	return items
+}
+
+// Cancel removes an item for all peers
+func (q *OutboundQueue) Cancel(id string) error {
+	q.mu.Lock()
+	index := slices.IndexFunc(q.state.Items, func(item *QueuedItem) bool { return item.ID == id })
+	if index < 0 {
+		q.mu.Unlock()
+		return fmt.Errorf("no queued item %q", id)
+	}
+	q.state.Items[index].Peers = nil
+	q.pruneLocked()
+	err := q.saveLocked()
+	q.mu.Unlock()
+
+	q.changed()
+	return err
+}
+
+// add queues data for the given peers. Text replaces text of the same
+// kind that is still waiting, since only the latest clipboard matters.
+func (q *OutboundQueue) add(item QueuedItem, data []byte, peers []string) error {
+	if len(peers) == 0 {
+		return nil
+	}
+	if q.limits.MaxBytes > 0 && int64(len(data)) > q.limits.MaxBytes {
+		return fmt.Errorf("%s (%d bytes) does not fit in the queue: %w", item.Name, len(data), ErrTooLarge)
+	}
+
+	now := time.Now()
+	item.ID = fmt.Sprintf("q%d", now.UnixNano())
+	item.Size = int64(len(data))
+	item.Peers = slices.Clone(peers)
+	item.Created = now
+	if q.limits.TTL > 0 {
+		item.Expires = now.Add(q.limits.TTL)
+	}
+
+	if err := os.WriteFile(q.dataPath(item.ID), data, 0600); err != nil {
+		return fmt.Errorf("failed to store queued item: %w", err)
+	}
+
+	q.mu.Lock()
+	if item.Kind != MsgTypeFileChunkStart {
+		for _, queued := range q.state.Items {
+			if queued.Kind == item.Kind {
+				queued.Peers = slices.DeleteFunc(queued.Peers, func(p string) bool { return slices.Contains(peers, p) })
+			}
+		}
+	}
+	q.state.Items = append(q.state.Items, &item)
+	q.pruneLocked()
+
+	// Make room by dropping the oldest items
+	for q.overLimitLocked() && len(q.state.Items) > 1 {
+		fmt.Printf("[QUEUE] Queue full, dropping %s\n", q.state.Items[0].Name)
+		q.state.Items[0].Peers = nil
+		q.pruneLocked()
+	}
+	err := q.saveLocked()
+	q.mu.Unlock()
+
+	fmt.Printf("[QUEUE] Queued %s (%d bytes) for %d offline peer(s)\n", item.Name, item.Size, len(peers))
+	q.changed()
+	return err
+}
+
+// pending returns the items waiting for a peer, oldest first
+func (q *OutboundQueue) pending(peer string) []QueuedItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pruneLocked()
+	var items []QueuedItem
+	for _, item := range q.state.Items {
+		if slices.Contains(item.Peers, peer) {
+			items = append(items, *item)
+		}
+	}
+	return items
+}
+
+// load reads the payload of a queued item
+func (q *OutboundQueue) load(id string) ([]byte, error) {
+	return os.ReadFile(q.dataPath(id))
+}
+
+// delivered records that a peer received an item
+func (q *OutboundQueue) delivered(id, peer string) {
+	q.mu.Lock()
+	for _, item := range q.state.Items {
+		if item.ID == id {
+			item.Peers = slices.DeleteFunc(item.Peers, func(p string) bool { return p == peer })
+		}
+	}
+	q.pruneLocked()
+	q.saveLocked()
+	q.mu.Unlock()
+
+	q.changed()
+}
+
+func (q *OutboundQueue) changed() {
+	if q.OnChange != nil {
+		q.OnChange()
+	}
+}
+
+// pruneLocked removes expired items and items no peer waits for
+func (q *OutboundQueue) pruneLocked() {
+	now := time.Now()
+	q.state.Items = slices.DeleteFunc(q.state.Items, func(item *QueuedItem) bool {
+		expired := !item.Expires.IsZero() && now.After(item.Expires)
+		if !expired && len(item.Peers) > 0 {
+			return false
+		}
+		os.Remove(q.dataPath(item.ID))
+		return true
+	})
+}
+
+func (q *OutboundQueue) overLimitLocked() bool {
+	if q.limits.MaxItems > 0 && len(q.state.Items) > q.limits.MaxItems {
+		return true
+	}
+	if q.limits.MaxBytes <= 0 {
+		return false
+	}
+	var total int64
+	for _, item := range q.state.Items {
+		total += item.Size
+	}
+	return total > q.limits.MaxBytes
+}
+
+// removeOrphansLocked deletes payloads left behind by a crash
+func (q *OutboundQueue) removeOrphansLocked() {
+	files, _ := filepath.Glob(filepath.Join(q.dir, "*.data"))
+	for _, file := range files {
+		id := filepath.Base(file)
+		id = id[:len(id)-len(".data")]
+		if !slices.ContainsFunc(q.state.Items, func(item *QueuedItem) bool { return item.ID == id }) {
+			os.Remove(file)
+		}
+	}
+}
+
+func (q *OutboundQueue) saveLocked() error {
+	data, err := json.MarshalIndent(&q.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(q.indexPath(), data, 0600); err != nil {
+		fmt.Printf("[QUEUE] Failed to save queue: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+func (q *OutboundQueue) indexPath() string {
+	return filepath.Join(q.dir, "queue.json")
+}
+
+func (q *OutboundQueue) dataPath(id string) string {
+	return filepath.Join(q.dir, id+".data")
+}
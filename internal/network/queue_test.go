@@ -0,0 +1,137 @@
+package network
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestQueue(t *testing.T, dir string, limits QueueLimits) *OutboundQueue {
+	t.Helper()
+	q, err := NewOutboundQueue(dir, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func queueFile(t *testing.T, q *OutboundQueue, name string, size int, peers ...string) {
+	t.Helper()
+	if err := q.add(QueuedItem{Kind: MsgTypeFileChunkStart, Name: name}, make([]byte, size), peers); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func queuedNames(q *OutboundQueue) []string {
+	var names []string
+	for _, item := range q.Items() {
+		names = append(names, item.Name)
+	}
+	return names
+}
+
+func dataFiles(t *testing.T, dir string) int {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+func TestQueueTTL(t *testing.T) {
+	dir := t.TempDir()
+	q := newTestQueue(t, dir, QueueLimits{TTL: 50 * time.Millisecond})
+	queueFile(t, q, "a", 10, "peer")
+	if len(q.pending("peer")) != 1 {
+		t.Fatal("item not queued")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if items := q.pending("peer"); len(items) != 0 {
+		t.Errorf("expired items handed out: %v", items)
+	}
+	if n := dataFiles(t, dir); n != 0 {
+		t.Errorf("%d payloads left after expiry", n)
+	}
+}
+
+func TestQueueEviction(t *testing.T) {
+	q := newTestQueue(t, t.TempDir(), QueueLimits{MaxItems: 2})
+	for _, name := range []string{"a", "b", "c"} {
+		queueFile(t, q, name, 10, "peer")
+	}
+	if names := queuedNames(q); len(names) != 2 || names[0] != "b" || names[1] != "c" {
+		t.Errorf("kept %v, want the newest two", names)
+	}
+
+	q = newTestQueue(t, t.TempDir(), QueueLimits{MaxBytes: 100})
+	queueFile(t, q, "a", 60, "peer")
+	queueFile(t, q, "b", 30, "peer")
+	queueFile(t, q, "c", 30, "peer")
+	if names := queuedNames(q); len(names) != 2 || names[0] != "b" || names[1] != "c" {
+		t.Errorf("kept %v, want the newest two", names)
+	}
+
+	// An item over the whole budget is refused outright
+	err := q.add(QueuedItem{Kind: MsgTypeFileChunkStart, Name: "big"}, make([]byte, 101), []string{"peer"})
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("got %v, want ErrTooLarge", err)
+	}
+}
+
+func TestQueueCancel(t *testing.T) {
+	dir := t.TempDir()
+	q := newTestQueue(t, dir, QueueLimits{})
+	changes := 0
+	q.OnChange = func() { changes++ }
+	queueFile(t, q, "a", 10, "peer", "other")
+
+	id := q.Items()[0].ID
+	if err := q.Cancel(id); err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Items()) != 0 || dataFiles(t, dir) != 0 || changes != 2 {
+		t.Errorf("items %v, %d payloads, %d changes after cancel", q.Items(), dataFiles(t, dir), changes)
+	}
+	if err := q.Cancel(id); err == nil {
+		t.Error("cancelled an item twice")
+	}
+}
+
+func TestQueueReload(t *testing.T) {
+	dir := t.TempDir()
+	q := newTestQueue(t, dir, QueueLimits{})
+	q.Trust("peer")
+	queueFile(t, q, "a", 10, "peer")
+	if err := q.add(QueuedItem{Kind: MsgTypeClipboard, Name: "text"}, []byte("hello"), []string{"peer"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A payload without an index entry is left over from a crash
+	os.WriteFile(filepath.Join(dir, "orphan.data"), []byte("x"), 0600)
+
+	q = newTestQueue(t, dir, QueueLimits{})
+	if trusted := q.Trusted(); len(trusted) != 1 || trusted[0] != "peer" {
+		t.Errorf("trusted %v after restart", trusted)
+	}
+	items := q.pending("peer")
+	if len(items) != 2 || items[0].Name != "a" || items[1].Name != "text" {
+		t.Fatalf("pending %v after restart", items)
+	}
+	if data, err := q.load(items[1].ID); err != nil || string(data) != "hello" {
+		t.Errorf("payload %q, %v", data, err)
+	}
+	if n := dataFiles(t, dir); n != 2 {
+		t.Errorf("%d payloads, want 2", n)
+	}
+
+	// Delivered items stay gone
+	q.delivered(items[0].ID, "peer")
+	q = newTestQueue(t, dir, QueueLimits{})
+	if names := queuedNames(q); len(names) != 1 || names[0] != "text" {
+		t.Errorf("queued %v after delivery and restart", names)
+	}
+}
@@ -0,0 +1,381 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// Reconnecting dropped links. The side that dialed a connection dials
+// again after it drops, so the two don't race; the other side waits for
+// it. Transfers cut off by the drop carry on where they stopped.
+
+// LinkState is where the link to a peer stands
+type LinkState int
+
+const (
+	LinkConnecting LinkState = iota
+	LinkConnected
+	LinkReconnecting
+	LinkOffline
+)
+
+func (s LinkState) String() string {
+	switch s {
+	case LinkConnecting:
+		return "connecting"
+	case LinkConnected:
+		return "connected"
+	case LinkReconnecting:
+		return "reconnecting"
+	default:
+		return "offline"
+	}
+}
+
+const (
+	reconnectBaseDelay = time.Second
+	reconnectMaxDelay  = time.Minute
+
+	// reconnectGiveUp is how long a dropped link is retried before the
+	// peer counts as offline
+	reconnectGiveUp = 10 * time.Minute
+
+	// resumeTimeout bounds waiting for a peer to say which chunks of an
+	// interrupted transfer it has. Older peers never answer.
+	resumeTimeout = 5 * time.Second
+)
+
+// MsgTypeFileResume asks which chunks of a transfer a peer has received,
+// and carries the answer
+const MsgTypeFileResume MessageType = "file_resume"
+
+// FileResume is the payload of MsgTypeFileResume
+type FileResume struct {
+	FileID string `json:"file_id"`
+	Reply  bool   `json:"reply,omitempty"`
+
+	// Set in replies: whether the transfer is known, and its chunks
+	// received so far
+	Known bool  `json:"known,omitempty"`
+	Have  []int `json:"have,omitempty"`
+}
+
+// link tracks a peer across connections
+type link struct {
+	state       LinkState
+	name        string
+	dialer      bool // we dialed the last connection, so we redial it
+	established bool
+	stop        chan struct{} // closed to end a running retry
+}
+
+// pendingTransfer is an outgoing transfer cut off by a dropped link
+type pendingTransfer struct {
+	start FileChunkStart
+	data  []byte
+	scope []string
+	since time.Time
+}
+
+// Link returns the state of the link to a peer, if there is one
+func (c *ConnectionManager) Link(peer string) (LinkState, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	l, ok := c.links[peer]
+	if !ok {
+		return 0, false
+	}
+	return l.state, true
+}
+
+func (c *ConnectionManager) setLinkState(peer string, state LinkState) {
+	c.mu.Lock()
+	l, ok := c.links[peer]
+	if !ok {
+		l = &link{}
+		c.links[peer] = l
+	}
+	changed := !ok || l.state != state
+	l.state = state
+	c.mu.Unlock()
+
+	if changed {
+		c.notifyLink(peer, state)
+	}
+}
+
+func (c *ConnectionManager) notifyLink(peer string, state LinkState) {
+	fmt.Printf("[NET] Link to %s: %s\n", peer, state)
+	if c.OnLinkState != nil {
+		c.OnLinkState(peer, state)
+	}
+}
+
+func stopRetryLocked(l *link) {
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+}
+
+// linkUp records a new connection to a peer
+func (c *ConnectionManager) linkUp(peer, name string, dialer bool) {
+	c.mu.Lock()
+	l, ok := c.links[peer]
+	if !ok {
+		l = &link{}
+		c.links[peer] = l
+	}
+	stopRetryLocked(l)
+	l.dialer = dialer
+	l.established = true
+	if name != "" {
+		l.name = name
+	}
+	c.mu.Unlock()
+
+	c.setLinkState(peer, LinkConnected)
+}
+
+// linkFailed records that connecting to a peer failed. Peers we were never
+// connected to are not tracked further.
+func (c *ConnectionManager) linkFailed(peer string) {
+	c.mu.Lock()
+	l, ok := c.links[peer]
+	if ok && !l.established {
+		delete(c.links, peer)
+	}
+	c.mu.Unlock()
+
+	if ok && !l.established {
+		c.notifyLink(peer, LinkOffline)
+		return
+	}
+	c.setLinkState(peer, LinkOffline)
+}
+
+// linkDown records a connection that ended on purpose. Forgotten peers
+// are not tracked further.
+func (c *ConnectionManager) linkDown(peer string, forget bool) {
+	c.mu.Lock()
+	l, ok := c.links[peer]
+	if ok {
+		stopRetryLocked(l)
+		if forget {
+			delete(c.links, peer)
+		}
+	}
+	c.mu.Unlock()
+
+	if forget {
+		c.resumeMu.Lock()
+		delete(c.pending, peer)
+		c.resumeMu.Unlock()
+		c.notifyLink(peer, LinkOffline)
+		return
+	}
+	c.setLinkState(peer, LinkOffline)
+}
+
+// linkDropped starts getting a lost connection back
+func (c *ConnectionManager) linkDropped(peer string) {
+	c.mu.Lock()
+	l, ok := c.links[peer]
+	if !ok {
+		l = &link{established: true}
+		c.links[peer] = l
+	}
+	stopRetryLocked(l)
+	stop := make(chan struct{})
+	l.stop = stop
+	name, dialer := l.name, l.dialer
+	c.mu.Unlock()
+
+	c.setLinkState(peer, LinkReconnecting)
+	go c.redial(peer, name, dialer, stop)
+}
+
+// Reconnect retries an offline link we had dialed, e.g. once discovery
+// finds the peer again, on the addresses from UpdatePeer. Other peers are
+// left alone.
+func (c *ConnectionManager) Reconnect(peer string) {
+	c.mu.Lock()
+	l, ok := c.links[peer]
+	if !ok || l.state != LinkOffline || !l.dialer || c.connections[peer] != nil {
+		c.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	l.stop = stop
+	name := l.name
+	c.mu.Unlock()
+
+	c.setLinkState(peer, LinkReconnecting)
+	go c.redial(peer, name, true, stop)
+}
+
+// redial connects to a peer again with jittered exponential backoff until it
+// works, stop is closed or reconnectGiveUp passed. Without dial it only
+// waits for the peer to come back.
+func (c *ConnectionManager) redial(peer, name string, dial bool, stop chan struct{}) {
+	giveUp := time.After(reconnectGiveUp)
+	for attempt := 0; ; attempt++ {
+		var wait <-chan time.Time
+		if dial {
+			wait = time.After(reconnectDelay(attempt))
+		}
+		select {
+		case <-stop:
+			return
+		case <-giveUp:
+			c.mu.Lock()
+			l, ok := c.links[peer]
+			current := ok && l.stop == stop
+			if current {
+				l.stop = nil
+			}
+			c.mu.Unlock()
+			if current {
+				c.setLinkState(peer, LinkOffline)
+			}
+			return
+		case <-wait:
+		}
+
+		if c.IsConnected(peer) {
+			return
+		}
+		if err := c.dialPeer(peer, name); err != nil {
+			fmt.Printf("[NET] Reconnecting to %s failed (attempt %d): %v\n", peer, attempt+1, err)
+		}
+	}
+}
+
+// reconnectDelay doubles with every attempt up to reconnectMaxDelay. The
+// jitter keeps peers that dropped together from redialing in lockstep.
+func reconnectDelay(attempt int) time.Duration {
+	delay := reconnectMaxDelay
+	if attempt < 16 {
+		delay = min(reconnectBaseDelay<<attempt, reconnectMaxDelay)
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// ---------- RESUMING TRANSFERS ----------
+
+// keepForResume remembers a transfer cut off by a dropped link
+func (c *ConnectionManager) keepForResume(peer string, transfer *pendingTransfer) {
+	c.resumeMu.Lock()
+	defer c.resumeMu.Unlock()
+	c.pending[peer] = append(c.pending[peer], transfer)
+}
+
+// resumeTransfers finishes the transfers to a peer that the last drop
+// interrupted. Chunks the peer already has are not sent again.
+func (c *ConnectionManager) resumeTransfers(state *ConnectionState) {
+	peer := state.peer()
+	c.resumeMu.Lock()
+	pending := c.pending[peer]
+	delete(c.pending, peer)
+	c.resumeMu.Unlock()
+
+	// The receiver forgets stalled transfers after transferTimeout
+	pending = slices.DeleteFunc(pending, func(p *pendingTransfer) bool {
+		return time.Since(p.since) > transferTimeout
+	})
+	for i, p := range pending {
+		have, known := c.askResume(state, p.start.FileID)
+		if known {
+			fmt.Printf("[NET] Resuming %s to %s (%d/%d chunks there)\n",
+				p.start.FileName, state.ip, len(have), p.start.TotalChunks)
+		} else {
+			// A peer that lost the transfer, or is too old to say, gets it
+			// again from the start
+			fmt.Printf("[NET] Sending %s to %s again\n", p.start.FileName, state.ip)
+			p.start.FileID = fmt.Sprintf("%s_%d", p.start.FileName, time.Now().UnixNano())
+		}
+
+		if !c.sendChunks(state, p.start, p.data, p.scope, have) {
+			for _, rest := range pending[i:] {
+				c.keepForResume(peer, rest)
+			}
+			return
+		}
+	}
+}
+
+// askResume asks the peer which chunks of a transfer it has
+func (c *ConnectionManager) askResume(state *ConnectionState, fileID string) (map[int]bool, bool) {
+	reply := make(chan FileResume, 1)
+	c.resumeMu.Lock()
+	c.resumeReplies[fileID] = reply
+	c.resumeMu.Unlock()
+	defer func() {
+		c.resumeMu.Lock()
+		delete(c.resumeReplies, fileID)
+		c.resumeMu.Unlock()
+	}()
+
+	msg := Message{Type: MsgTypeFileResume}
+	msg.Data, _ = json.Marshal(FileResume{FileID: fileID})
+	select {
+	case state.writeChan <- msg:
+	case <-state.closeChan:
+		return nil, false
+	}
+
+	select {
+	case resume := <-reply:
+		if !resume.Known {
+			return nil, false
+		}
+		have := make(map[int]bool, len(resume.Have))
+		for _, i := range resume.Have {
+			have[i] = true
+		}
+		return have, true
+	case <-state.closeChan:
+	case <-time.After(resumeTimeout):
+	}
+	return nil, false
+}
+
+// handleResume answers a peer asking about a transfer, or hands its
+// answer to askResume
+func (c *ConnectionManager) handleResume(state *ConnectionState, resume FileResume) {
+	if resume.Reply {
+		c.resumeMu.Lock()
+		reply, ok := c.resumeReplies[resume.FileID]
+		c.resumeMu.Unlock()
+		if ok {
+			select {
+			case reply <- resume:
+			default:
+			}
+		}
+		return
+	}
+
+	answer := FileResume{FileID: resume.FileID, Reply: true}
+	c.transfersMu.Lock()
+	if transfer, ok := c.transfers[resume.FileID]; ok {
+		answer.Known = true
+		for i := range transfer.received {
+			answer.Have = append(answer.Have, i)
+		}
+		// Keep it from being pruned while the rest arrives
+		transfer.updated = time.Now()
+	}
+	c.transfersMu.Unlock()
+
+	msg := Message{Type: MsgTypeFileResume}
+	msg.Data, _ = json.Marshal(answer)
+	select {
+	case state.writeChan <- msg:
+	case <-state.closeChan:
+	case <-time.After(time.Second):
+	}
+}
@@ -0,0 +1,50 @@
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+// closedConnection files a confirmed connection under key and returns it
+// with the link states the close reports
+func closedConnection(t *testing.T, key, deviceID string) (*ConnectionManager, *[]LinkState) {
+	t.Helper()
+	c := newBareManager()
+	c.links = make(map[string]*link)
+	c.pending = make(map[string][]*pendingTransfer)
+	var states []LinkState
+	c.OnLinkState = func(peer string, state LinkState) { states = append(states, state) }
+
+	conn, other := net.Pipe()
+	t.Cleanup(func() { other.Close() })
+	confirmed := make(chan struct{})
+	close(confirmed)
+	state := &ConnectionState{key: key, ip: "10.0.0.2", deviceID: deviceID, conn: conn, confirmed: confirmed, closeChan: make(chan struct{})}
+	c.connections[key] = state
+	c.linkUp(key, "", false)
+
+	c.handleConnectionClose(state)
+	t.Cleanup(func() { c.linkDown(key, true) })
+	return c, &states
+}
+
+func TestDropReconnectsKnownDevice(t *testing.T) {
+	c, states := closedConnection(t, "device-id", "device-id")
+	if got, _ := c.Link("device-id"); got != LinkReconnecting {
+		t.Errorf("link %v, want reconnecting", got)
+	}
+	if len(*states) != 2 || (*states)[1] != LinkReconnecting {
+		t.Errorf("states %v", *states)
+	}
+}
+
+func TestDropForgetsUnknownClient(t *testing.T) {
+	// A client that never told us who it is can't be found again
+	c, states := closedConnection(t, "10.0.0.2", "")
+	if _, ok := c.Link("10.0.0.2"); ok {
+		t.Error("kept a link to an unknown client")
+	}
+	if len(*states) != 2 || (*states)[1] != LinkOffline {
+		t.Errorf("states %v", *states)
+	}
+}
@@ -0,0 +1,191 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRelayHops is how often a message may be forwarded unless
+	// configured otherwise: across one device in between
+	DefaultRelayHops = 1
+
+	// seenTTL is how long message IDs are remembered
+	seenTTL = 10 * time.Minute
+
+	// relayQueueSize is how many relayed messages may wait for a slow
+	// peer before more are dropped; up to 32MB of file chunks
+	relayQueueSize = 64
+)
+
+// seenSet remembers recent message IDs so that a message reaching us
+// over several paths is handled and relayed only once
+type seenSet struct {
+	ids       map[string]time.Time
+	lastPrune time.Time
+	mu        sync.Mutex
+}
+
+func newSeenSet() *seenSet {
+	return &seenSet{ids: make(map[string]time.Time), lastPrune: time.Now()}
+}
+
+// add records id and reports whether it was new
+func (s *seenSet) add(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastPrune) > seenTTL {
+		for seenID, at := range s.ids {
+			if now.Sub(at) > seenTTL {
+				delete(s.ids, seenID)
+			}
+		}
+		s.lastPrune = now
+	}
+
+	if _, exists := s.ids[id]; exists {
+		return false
+	}
+	s.ids[id] = now
+	return true
+}
+
+func newMessageID() string {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// SetRelayHops sets how often messages from other peers are forwarded.
+// Zero disables relaying.
+func (c *ConnectionManager) SetRelayHops(hops int) {
+	c.mu.Lock()
+	c.relayHops = hops
+	c.mu.Unlock()
+}
+
+// chunkMessage builds a file transfer message with the given ID and marks
+// it as seen, so copies relayed back to us are dropped
+func (c *ConnectionManager) chunkMessage(msgType MessageType, id string, scope []string, payload interface{}) Message {
+	msg := Message{Type: msgType, ID: id, Groups: scope, Origin: c.ownID()}
+	msg.Data, _ = json.Marshal(payload)
+	c.seen.add(id)
+	return msg
+}
+
+func (c *ConnectionManager) ownID() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.deviceID
+}
+
+// relay forwards a clipboard or file message to the peers the origin
+// isn't connected to itself, so that A -> B -> C reaches C without
+// everyone sending everything to everyone. Peers outside the message's
+// groups don't get it. Messages wait in a queue per peer, so a slow peer
+// never holds up the connection the message came in on.
+func (c *ConnectionManager) relay(from *ConnectionState, msg Message) {
+	// Old peers send messages without IDs, which can't be deduplicated
+	if msg.ID == "" {
+		return
+	}
+
+	c.mu.RLock()
+	maxHops := c.relayHops
+	targets := make([]*ConnectionState, 0, len(c.connections))
+	for _, state := range c.connections {
+		if state != from && state.isConfirmed() && !state.reaches(msg.Origin) {
+			targets = append(targets, state)
+		}
+	}
+	c.mu.RUnlock()
+
+	if msg.Hops >= maxHops || len(targets) == 0 {
+		return
+	}
+	msg.Hops++
+
+	for _, state := range targets {
+		scoped := msg
+		scoped.Groups = SharedGroups(msg.Groups, c.peerGroups(state))
+		if len(scoped.Groups) == 0 {
+			continue
+		}
+
+		select {
+		case state.relayQueue <- scoped:
+		default:
+			fmt.Printf("[NET] Relay queue to %s is full, dropping %s\n", state.ip, msg.Type)
+			state.stats.errors.Add(1)
+		}
+	}
+}
+
+// reaches reports whether the peer said it is connected to the device
+// with the given ID, or is that device
+func (s *ConnectionState) reaches(id string) bool {
+	if id == "" {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.deviceID == id || slices.Contains(s.peers, id)
+}
+
+// relayLoop hands relayed messages to the write loop as it keeps up
+func (c *ConnectionManager) relayLoop(state *ConnectionState) {
+	for {
+		select {
+		case <-state.closeChan:
+			return
+		case msg := <-state.relayQueue:
+			select {
+			case state.writeChan <- msg:
+			case <-state.closeChan:
+				return
+			}
+		}
+	}
+}
+
+// connectedIDs returns the device IDs of the confirmed connections,
+// which hellos announce
+func (c *ConnectionManager) connectedIDs() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var ids []string
+	for peer, state := range c.connections {
+		state.mu.RLock()
+		id := state.deviceID
+		state.mu.RUnlock()
+		if id != "" && id == peer && state.isConfirmed() {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// announcePeers tells the peers other than except whom we are connected
+// to now, after a connection came or went
+func (c *ConnectionManager) announcePeers(except *ConnectionState) {
+	c.mu.RLock()
+	states := make([]*ConnectionState, 0, len(c.connections))
+	for _, state := range c.connections {
+		if state != except && state.isConfirmed() {
+			states = append(states, state)
+		}
+	}
+	c.mu.RUnlock()
+
+	for _, state := range states {
+		c.sendHello(state, false)
+	}
+}
@@ -0,0 +1,93 @@
+package network
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// relayPair sets up a manager with a connection a message comes in on
+// and a second confirmed one it may be relayed to
+func relayPair(t *testing.T) (c *ConnectionManager, from, to *ConnectionState) {
+	t.Helper()
+	c = newBareManager()
+	confirmed := make(chan struct{})
+	close(confirmed)
+	from = &ConnectionState{key: "from", ip: "10.0.0.2", confirmed: confirmed, relayQueue: make(chan Message, 4)}
+	to = &ConnectionState{key: "to", ip: "10.0.0.3", confirmed: confirmed, relayQueue: make(chan Message, 4)}
+	c.connections["from"] = from
+	c.connections["to"] = to
+	return c, from, to
+}
+
+// newBareManager returns a manager without a listener
+func newBareManager() *ConnectionManager {
+	return &ConnectionManager{
+		connections: make(map[string]*ConnectionState),
+		relayHops:   DefaultRelayHops,
+		seen:        newSeenSet(),
+		transfers:   make(map[string]*incomingTransfer),
+	}
+}
+
+func clipboardMessage(t *testing.T, text string) Message {
+	t.Helper()
+	data, err := json.Marshal(ClipboardData{Content: text})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Message{Type: MsgTypeClipboard, Data: data, ID: newMessageID(), Groups: []string{DefaultGroup}, Origin: "origin"}
+}
+
+func TestRelayAfterAccepting(t *testing.T) {
+	c, from, to := relayPair(t)
+	c.SetLimits(Limits{MaxReceiveSize: 10})
+
+	// What we refuse ourselves goes no further
+	c.handleMessage(from, clipboardMessage(t, strings.Repeat("a", 11)))
+	if len(to.relayQueue) != 0 {
+		t.Fatal("relayed text over our limit")
+	}
+
+	msg := clipboardMessage(t, "short")
+	c.handleMessage(from, msg)
+	if len(to.relayQueue) != 1 {
+		t.Fatal("accepted text not relayed")
+	}
+	if relayed := <-to.relayQueue; relayed.ID != msg.ID || relayed.Hops != 1 {
+		t.Errorf("relayed %+v", relayed)
+	}
+
+	// Each message once, and never back where it came from
+	c.handleMessage(from, msg)
+	if len(to.relayQueue) != 0 || len(from.relayQueue) != 0 {
+		t.Error("relayed a message twice")
+	}
+}
+
+func TestRelayHopLimit(t *testing.T) {
+	c, from, to := relayPair(t)
+
+	msg := clipboardMessage(t, "far")
+	msg.Hops = DefaultRelayHops
+	c.handleMessage(from, msg)
+	if len(to.relayQueue) != 0 {
+		t.Error("relayed past the hop limit")
+	}
+
+	c.SetRelayHops(0)
+	c.handleMessage(from, clipboardMessage(t, "near"))
+	if len(to.relayQueue) != 0 {
+		t.Error("relayed with relaying off")
+	}
+}
+
+func TestRelaySkipsPeersOfOrigin(t *testing.T) {
+	c, from, to := relayPair(t)
+	to.peers = []string{"origin"}
+
+	c.handleMessage(from, clipboardMessage(t, "hi"))
+	if len(to.relayQueue) != 0 {
+		t.Error("relayed to a peer the origin reaches itself")
+	}
+}
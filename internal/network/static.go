@@ -0,0 +1,164 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Manually added peers, for VPNs and networks where multicast discovery
+// never gets through
+
+// BackendStatic probes the addresses listed in the config file
+const BackendStatic = "static"
+
+// probeTimeout bounds connecting to a static peer and its answer
+const probeTimeout = 2 * time.Second
+
+// ParsePeerAddress splits "host" or "host:port". The port defaults to the
+// one all devices listen on.
+func ParsePeerAddress(addr string) (string, int, error) {
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return "", 0, fmt.Errorf("empty address")
+	}
+	if ip := parseIP(strings.Trim(addr, "[]")); ip != nil {
+		return strings.Trim(addr, "[]"), DefaultPort, nil
+	}
+	if !strings.Contains(addr, ":") {
+		return addr, DefaultPort, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port in %q", addr)
+	}
+	return host, port, nil
+}
+
+// ResolvePeer looks up a peer address, returning its IP and port
+func ResolvePeer(addr string) (string, int, error) {
+	host, port, err := ParsePeerAddress(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	if len(addrs) == 0 {
+		return "", 0, fmt.Errorf("no address for %s", host)
+	}
+
+	// Prefer IPv4, which works on more networks
+	for _, a := range addrs {
+		if ip := parseIP(a); ip != nil && ip.To4() != nil {
+			return a, port, nil
+		}
+	}
+	return addrs[0], port, nil
+}
+
+// StaticDiscoverer probes a fixed list of peer addresses on every scan
+type StaticDiscoverer struct {
+	mu    sync.Mutex
+	peers []string
+}
+
+// NewStaticDiscoverer probes the given "host" or "host:port" addresses
+func NewStaticDiscoverer(peers []string) *StaticDiscoverer {
+	return &StaticDiscoverer{peers: slices.Clone(peers)}
+}
+
+// SetPeers replaces the probed addresses
+func (s *StaticDiscoverer) SetPeers(peers []string) {
+	s.mu.Lock()
+	s.peers = slices.Clone(peers)
+	s.mu.Unlock()
+}
+
+func (s *StaticDiscoverer) Name() string { return BackendStatic }
+
+// Discover probes all peers at once. Peers that are down are left out
+// without an error, like devices that don't answer multicast.
+func (s *StaticDiscoverer) Discover(self DeviceInfo, timeout time.Duration) ([]Discovered, error) {
+	s.mu.Lock()
+	peers := slices.Clone(s.peers)
+	s.mu.Unlock()
+
+	results := make([]*Discovered, len(peers))
+	var wg sync.WaitGroup
+	for i, addr := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if found, err := probePeer(addr, min(timeout, probeTimeout)); err == nil {
+				results[i] = &found
+			}
+		}()
+	}
+	wg.Wait()
+
+	var found []Discovered
+	for _, d := range results {
+		if d != nil {
+			found = append(found, *d)
+		}
+	}
+	return found, nil
+}
+
+func (s *StaticDiscoverer) Close() error { return nil }
+
+// probePeer asks the device at addr to describe itself
+func probePeer(addr string, timeout time.Duration) (Discovered, error) {
+	ip, port, err := ResolvePeer(addr)
+	if err != nil {
+		return Discovered{}, err
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return Discovered{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := json.NewEncoder(conn).Encode(Message{Type: MsgTypeProbe}); err != nil {
+		return Discovered{}, err
+	}
+	var reply Message
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+		return Discovered{}, fmt.Errorf("no answer from %s: %w", addr, err)
+	}
+	if reply.Type != MsgTypeProbe {
+		return Discovered{}, fmt.Errorf("unexpected answer %q from %s", reply.Type, addr)
+	}
+
+	var info DeviceInfo
+	if err := json.Unmarshal(reply.Data, &info); err != nil || info.Name == "" {
+		return Discovered{}, fmt.Errorf("invalid answer from %s", addr)
+	}
+	// The configured port wins; it may be a forwarded one
+	info.Port = port
+	return Discovered{IP: ip, Info: info}, nil
+}
+
+// answerProbe describes this device to a peer that added us by address
+func (c *ConnectionManager) answerProbe(conn net.Conn) {
+	defer conn.Close()
+
+	msg := Message{Type: MsgTypeProbe}
+	msg.Data, _ = json.Marshal(c.DeviceInfo())
+	conn.SetWriteDeadline(time.Now().Add(probeTimeout))
+	json.NewEncoder(conn).Encode(msg)
+}
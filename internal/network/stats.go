@@ -0,0 +1,163 @@
+package network
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Per-connection statistics, for the device cards and --stats
+
+// ConnStats describes one connection
+type ConnStats struct {
+	IP    string    `json:"ip"`
+	Name  string    `json:"name,omitempty"`
+	Since time.Time `json:"since"`
+
+	// RTT is the smoothed heartbeat round trip; zero until measured or
+	// when the peer is too old to echo heartbeats
+	RTT time.Duration `json:"rtt"`
+
+	BytesIn     int64 `json:"bytes_in"`
+	BytesOut    int64 `json:"bytes_out"`
+	MessagesIn  int64 `json:"messages_in"`
+	MessagesOut int64 `json:"messages_out"`
+
+	// Bytes per second over the last heartbeat interval, and since the
+	// connection opened
+	RateIn     float64 `json:"rate_in"`
+	RateOut    float64 `json:"rate_out"`
+	AvgRateIn  float64 `json:"avg_rate_in"`
+	AvgRateOut float64 `json:"avg_rate_out"`
+
+	// Errors counts failed reads and writes, sends that timed out and
+	// heartbeats that went unanswered
+	Errors int64 `json:"errors"`
+}
+
+// connStats is what a ConnectionState counts. The counters are updated
+// from the read and write loops without locking.
+type connStats struct {
+	since       time.Time
+	bytesIn     atomic.Int64
+	bytesOut    atomic.Int64
+	messagesIn  atomic.Int64
+	messagesOut atomic.Int64
+	errors      atomic.Int64
+
+	mu        sync.Mutex
+	rtt       time.Duration
+	sampledAt time.Time
+	sampleIn  int64
+	sampleOut int64
+	rateIn    float64
+	rateOut   float64
+}
+
+// observeRTT smooths like TCP does, so one slow heartbeat doesn't swing it
+func (s *connStats) observeRTT(rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rtt == 0 {
+		s.rtt = rtt
+	} else {
+		s.rtt = (7*s.rtt + rtt) / 8
+	}
+}
+
+// sample updates the current rates; called once per heartbeat
+func (s *connStats) sample() {
+	now := time.Now()
+	in, out := s.bytesIn.Load(), s.bytesOut.Load()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.sampledAt.IsZero() {
+		elapsed := now.Sub(s.sampledAt).Seconds()
+		s.rateIn = float64(in-s.sampleIn) / elapsed
+		s.rateOut = float64(out-s.sampleOut) / elapsed
+	}
+	s.sampledAt, s.sampleIn, s.sampleOut = now, in, out
+}
+
+// countingReader and countingWriter add the bytes they move to n
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// Stats returns the statistics of every connection, ordered by address
+func (c *ConnectionManager) Stats() []ConnStats {
+	c.mu.RLock()
+	states := make([]*ConnectionState, 0, len(c.connections))
+	for _, state := range c.connections {
+		states = append(states, state)
+	}
+	c.mu.RUnlock()
+
+	stats := make([]ConnStats, 0, len(states))
+	for _, state := range states {
+		stats = append(stats, state.snapshot())
+	}
+	slices.SortFunc(stats, func(a, b ConnStats) int { return strings.Compare(a.IP, b.IP) })
+	return stats
+}
+
+// ConnectionStats returns the statistics of the connection to a peer
+func (c *ConnectionManager) ConnectionStats(peer string) (ConnStats, bool) {
+	c.mu.RLock()
+	state, ok := c.connections[peer]
+	c.mu.RUnlock()
+	if !ok {
+		return ConnStats{}, false
+	}
+	return state.snapshot(), true
+}
+
+func (s *ConnectionState) snapshot() ConnStats {
+	st := &s.stats
+	stats := ConnStats{
+		IP:          s.ip,
+		Since:       st.since,
+		BytesIn:     st.bytesIn.Load(),
+		BytesOut:    st.bytesOut.Load(),
+		MessagesIn:  st.messagesIn.Load(),
+		MessagesOut: st.messagesOut.Load(),
+		Errors:      st.errors.Load(),
+	}
+
+	s.mu.RLock()
+	stats.Name = s.peerName
+	s.mu.RUnlock()
+
+	st.mu.Lock()
+	stats.RTT = st.rtt
+	stats.RateIn, stats.RateOut = st.rateIn, st.rateOut
+	st.mu.Unlock()
+
+	if elapsed := time.Since(st.since).Seconds(); elapsed > 0 {
+		stats.AvgRateIn = float64(stats.BytesIn) / elapsed
+		stats.AvgRateOut = float64(stats.BytesOut) / elapsed
+	}
+	return stats
+}
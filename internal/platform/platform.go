@@ -0,0 +1,43 @@
+package platform
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Integration groups the desktop features that only exist on some
+// operating systems. Current returns the implementation for the running
+// OS; unsupported features return errors.ErrUnsupported.
+type Integration interface {
+	// ShowMessage tells the user something when there is no GUI to do it,
+	// e.g. when the context menu helper can't reach the running app
+	ShowMessage(msg string)
+
+	RegisterContextMenu() error
+	UnregisterContextMenu() error
+	IsContextMenuRegistered() bool
+
+	EnableAutostart() error
+	DisableAutostart() error
+	IsAutostartEnabled() bool
+}
+
+// Current returns the integration for the running operating system
+func Current() Integration {
+	return newIntegration()
+}
+
+// logMessage appends msg to the application log in the temp directory
+func logMessage(msg string) {
+	logFile := filepath.Join(os.TempDir(), "share-my-clipboard.log")
+	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	timestamp := time.Now().Format("2006-01-02 15:04:05")
+	fmt.Fprintf(f, "[%s] %s\n", timestamp, msg)
+}
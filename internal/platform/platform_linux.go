@@ -0,0 +1,82 @@
+package platform
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/Krasnovvvvv/share-my-clipboard/internal/contextmenu"
+)
+
+type linuxIntegration struct{}
+
+func newIntegration() Integration {
+	return linuxIntegration{}
+}
+
+// ShowMessage raises a desktop notification when notify-send is available
+// and always keeps a copy in the log file
+func (linuxIntegration) ShowMessage(msg string) {
+	logMessage(msg)
+	if path, err := exec.LookPath("notify-send"); err == nil {
+		exec.Command(path, "Share My Clipboard", msg).Run()
+	}
+}
+
+func (linuxIntegration) RegisterContextMenu() error {
+	return contextmenu.Register()
+}
+
+func (linuxIntegration) UnregisterContextMenu() error {
+	return contextmenu.Unregister()
+}
+
+func (linuxIntegration) IsContextMenuRegistered() bool {
+	return contextmenu.IsRegistered()
+}
+
+// EnableAutostart installs an XDG autostart entry for the current user
+func (linuxIntegration) EnableAutostart() error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %w", err)
+	}
+
+	r := strings.NewReplacer(`\`, `\\\\`, `"`, `\\"`, "`", "\\\\`", `$`, `\\$`)
+	content := fmt.Sprintf(`[Desktop Entry]
+Type=Application
+Name=Share My Clipboard
+Exec="%s"
+Terminal=false
+X-GNOME-Autostart-enabled=true
+`, r.Replace(filepath.Clean(exePath)))
+
+	path := autostartPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(content), 0644)
+}
+
+func (linuxIntegration) DisableAutostart() error {
+	if err := os.Remove(autostartPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (linuxIntegration) IsAutostartEnabled() bool {
+	_, err := os.Stat(autostartPath())
+	return err == nil
+}
+
+func autostartPath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		home, _ := os.UserHomeDir()
+		configDir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configDir, "autostart", "share-my-clipboard.desktop")
+}
@@ -0,0 +1,40 @@
+//go:build !windows && !linux
+
+package platform
+
+import "errors"
+
+// noopIntegration is used on platforms without desktop integration
+type noopIntegration struct{}
+
+func newIntegration() Integration {
+	return noopIntegration{}
+}
+
+func (noopIntegration) ShowMessage(msg string) {
+	logMessage(msg)
+}
+
+func (noopIntegration) RegisterContextMenu() error {
+	return errors.ErrUnsupported
+}
+
+func (noopIntegration) UnregisterContextMenu() error {
+	return errors.ErrUnsupported
+}
+
+func (noopIntegration) IsContextMenuRegistered() bool {
+	return false
+}
+
+func (noopIntegration) EnableAutostart() error {
+	return errors.ErrUnsupported
+}
+
+func (noopIntegration) DisableAutostart() error {
+	return errors.ErrUnsupported
+}
+
+func (noopIntegration) IsAutostartEnabled() bool {
+	return false
+}
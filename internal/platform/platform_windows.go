@@ -0,0 +1,80 @@
+package platform
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows/registry"
+
+	"github.com/Krasnovvvvv/share-my-clipboard/internal/contextmenu"
+)
+
+const (
+	runKey       = `Software\Microsoft\Windows\CurrentVersion\Run`
+	runValueName = "ShareMyClipboard"
+)
+
+type windowsIntegration struct{}
+
+func newIntegration() Integration {
+	return windowsIntegration{}
+}
+
+// ShowMessage logs to file instead of showing a MessageBox, so the
+// context menu helper never blocks Explorer
+func (windowsIntegration) ShowMessage(msg string) {
+	logMessage(msg)
+}
+
+func (windowsIntegration) RegisterContextMenu() error {
+	return contextmenu.Register()
+}
+
+func (windowsIntegration) UnregisterContextMenu() error {
+	return contextmenu.Unregister()
+}
+
+func (windowsIntegration) IsContextMenuRegistered() bool {
+	return contextmenu.IsRegistered()
+}
+
+// EnableAutostart adds the executable to the current user's Run key
+func (windowsIntegration) EnableAutostart() error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %w", err)
+	}
+
+	key, _, err := registry.CreateKey(registry.CURRENT_USER, runKey, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer key.Close()
+
+	return key.SetStringValue(runValueName, fmt.Sprintf(`"%s"`, filepath.Clean(exePath)))
+}
+
+func (windowsIntegration) DisableAutostart() error {
+	key, err := registry.OpenKey(registry.CURRENT_USER, runKey, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer key.Close()
+
+	if err := key.DeleteValue(runValueName); err != nil && err != registry.ErrNotExist {
+		return err
+	}
+	return nil
+}
+
+func (windowsIntegration) IsAutostartEnabled() bool {
+	key, err := registry.OpenKey(registry.CURRENT_USER, runKey, registry.QUERY_VALUE)
+	if err != nil {
+		return false
+	}
+	defer key.Close()
+
+	_, _, err = key.GetStringValue(runValueName)
+	return err == nil
+}
@@ -2,6 +2,7 @@ package ui
 
 import (
 	"image/color"
+	"strings"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/canvas"
@@ -11,9 +12,27 @@ import (
 	"fyne.io/fyne/v2/widget"
 )
 
-func MakeDeviceCard(name, ip string, isConnected bool, onConnect func(ip string), onDisconnect func(ip string)) fyne.CanvasObject {
+// DeviceCard is what a device card shows
+type DeviceCard struct {
+	Name    string
+	IP      string
+	Groups  []string
+	Details string // platform and version, one line
+
+	// Fingerprint is shown shortened, if the device has one
+	Fingerprint string
+
+	// Status describes a dropped link, e.g. "reconnecting"
+	Status string
+
+	// Stats sums up a live connection: round trip, throughput, errors
+	Stats string
+}
+
+func MakeDeviceCard(dev DeviceCard, isConnected bool, onConnect func(ip string), onDisconnect func(ip string)) fyne.CanvasObject {
+	ip := dev.IP
 	icon := widget.NewIcon(theme.ComputerIcon())
-	title := widget.NewLabelWithStyle(name, fyne.TextAlignCenter, fyne.TextStyle{Bold: true})
+	title := widget.NewLabelWithStyle(dev.Name, fyne.TextAlignCenter, fyne.TextStyle{Bold: true})
 	address := widget.NewLabelWithStyle(ip, fyne.TextAlignCenter, fyne.TextStyle{})
 
 	var btn *widget.Button
@@ -32,9 +51,31 @@ func MakeDeviceCard(name, ip string, isConnected bool, onConnect func(ip string)
 		container.NewCenter(icon),
 		container.NewCenter(title),
 		container.NewCenter(address),
-		container.NewCenter(btn),
-		NewMargin(10),
 	)
+	if dev.Details != "" {
+		details := widget.NewLabelWithStyle(dev.Details, fyne.TextAlignCenter, fyne.TextStyle{})
+		card.Add(container.NewCenter(details))
+	}
+	if dev.Fingerprint != "" {
+		fingerprint := dev.Fingerprint
+		if len(fingerprint) > 16 {
+			fingerprint = fingerprint[:16] + "…"
+		}
+		card.Add(container.NewCenter(widget.NewLabelWithStyle("Key "+fingerprint, fyne.TextAlignCenter, fyne.TextStyle{Monospace: true})))
+	}
+	if dev.Status != "" {
+		status := widget.NewLabelWithStyle(strings.ToUpper(dev.Status[:1])+dev.Status[1:], fyne.TextAlignCenter, fyne.TextStyle{Italic: true})
+		card.Add(container.NewCenter(status))
+	}
+	if dev.Stats != "" {
+		card.Add(container.NewCenter(widget.NewLabelWithStyle(dev.Stats, fyne.TextAlignCenter, fyne.TextStyle{Monospace: true})))
+	}
+	if len(dev.Groups) > 0 {
+		membership := widget.NewLabelWithStyle("Groups: "+strings.Join(dev.Groups, ", "), fyne.TextAlignCenter, fyne.TextStyle{Italic: true})
+		card.Add(container.NewCenter(membership))
+	}
+	card.Add(container.NewCenter(btn))
+	card.Add(NewMargin(10))
 	border := canvas.NewRectangle(color.NRGBA{R: 210, G: 210, B: 210, A: 255})
 	border.SetMinSize(fyne.NewSize(400, 2))
 	return container.NewVBox(card, border)
@@ -49,6 +90,60 @@ func ConfirmConnection(w fyne.Window, requester string, cb func(bool)) {
 	)
 }
 
+// EditGroups asks for the groups to join, one per line, each optionally
+// followed by ": secret"
+func EditGroups(w fyne.Window, current []string, secrets map[string]string, onSave func(groups []string, secrets map[string]string)) {
+	lines := make([]string, 0, len(current))
+	for _, group := range current {
+		if secret := secrets[group]; secret != "" {
+			group += ": " + secret
+		}
+		lines = append(lines, group)
+	}
+
+	entry := widget.NewMultiLineEntry()
+	entry.SetText(strings.Join(lines, "\n"))
+	entry.SetPlaceHolder("home: a passphrase shared by the group\ndesign-team")
+
+	dialog.ShowForm("Groups", "Save", "Cancel",
+		[]*widget.FormItem{widget.NewFormItem("Join", entry)},
+		func(ok bool) {
+			if !ok {
+				return
+			}
+			var groups []string
+			secrets := make(map[string]string)
+			for _, line := range strings.Split(entry.Text, "\n") {
+				group, secret, _ := strings.Cut(line, ":")
+				group = strings.TrimSpace(group)
+				if group == "" {
+					continue
+				}
+				groups = append(groups, group)
+				if secret = strings.TrimSpace(secret); secret != "" {
+					secrets[strings.ToLower(group)] = secret
+				}
+			}
+			onSave(groups, secrets)
+		}, w)
+}
+
+// AddDevice asks for the address of a device that discovery can't find
+func AddDevice(w fyne.Window, validate func(addr string) error, onAdd func(addr string)) {
+	entry := widget.NewEntry()
+	entry.SetPlaceHolder("100.64.0.2 or laptop.example:54322")
+	entry.Validator = validate
+
+	dialog.ShowForm("Add device by address", "Add", "Cancel",
+		[]*widget.FormItem{widget.NewFormItem("Address", entry)},
+		func(ok bool) {
+			if !ok {
+				return
+			}
+			onAdd(strings.TrimSpace(entry.Text))
+		}, w)
+}
+
 func NotifySuccess(title, msg string) {
 	fyne.CurrentApp().SendNotification(&fyne.Notification{Title: title, Content: msg})
 }
@@ -64,3 +159,35 @@ func NewMargin(h float32) fyne.CanvasObject {
 	r.SetMinSize(fyne.NewSize(0, h))
 	return r
 }
+
+// QueueRow is one entry of the offline queue dialog
+type QueueRow struct {
+	ID     string
+	Title  string
+	Detail string
+}
+
+// ShowQueue lists the items waiting for offline devices, each with a
+// button to cancel it
+func ShowQueue(w fyne.Window, rows []QueueRow, onCancel func(id string)) {
+	list := container.NewVBox()
+	if len(rows) == 0 {
+		list.Add(widget.NewLabel("Nothing is waiting for offline devices."))
+	}
+
+	for _, row := range rows {
+		id := row.ID
+		label := widget.NewLabel(row.Title + "\n" + row.Detail)
+		cancelBtn := widget.NewButtonWithIcon("", theme.DeleteIcon(), nil)
+		entry := container.NewBorder(nil, nil, nil, cancelBtn, label)
+		cancelBtn.OnTapped = func() {
+			onCancel(id)
+			list.Remove(entry)
+		}
+		list.Add(entry)
+	}
+
+	scroll := container.NewVScroll(list)
+	scroll.SetMinSize(fyne.NewSize(360, 240))
+	dialog.ShowCustom("Offline Queue", "Close", scroll, w)
+}
@@ -1,26 +1,68 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/Krasnovvvvv/share-my-clipboard/internal/app"
-	"github.com/Krasnovvvvv/share-my-clipboard/internal/contextmenu"
+	"github.com/Krasnovvvvv/share-my-clipboard/internal/config"
 	"github.com/Krasnovvvvv/share-my-clipboard/internal/ipc"
+	"github.com/Krasnovvvvv/share-my-clipboard/internal/metrics"
+	"github.com/Krasnovvvvv/share-my-clipboard/internal/network"
+	"github.com/Krasnovvvvv/share-my-clipboard/internal/platform"
 )
 
 func main() {
 	// Define flags
-	registerMenu := flag.Bool("register-menu", false, "Register context menu in Windows Explorer")
-	unregisterMenu := flag.Bool("unregister-menu", false, "Unregister context menu from Windows Explorer")
+	registerMenu := flag.Bool("register-menu", false, "Register 'Send to Connected Devices' in the file manager context menu")
+	unregisterMenu := flag.Bool("unregister-menu", false, "Unregister the file manager context menu entry")
 	sendFiles := flag.String("send", "", "Send file to connected devices (used by context menu)")
+	enableAutostart := flag.Bool("enable-autostart", false, "Start the application when you log in")
+	disableAutostart := flag.Bool("disable-autostart", false, "Don't start the application when you log in")
+	listQueue := flag.Bool("queue", false, "List items waiting for offline devices")
+	cancelQueued := flag.String("queue-cancel", "", "Cancel a queued item by its ID")
+	connectTo := flag.String("connect", "", "Ask a device to connect, by IP or host:port address")
+	showStats := flag.Bool("stats", false, "Show round trip, traffic and errors of each connection")
+	configDir := flag.String("config-dir", "", "Keep the config file and app state in this directory")
+	port := flag.Int("port", 0, "TCP port for connections from other devices")
+	ipcPort := flag.Int("ipc-port", 0, "Local control port; use a different one for each instance")
+	bindAddress := flag.String("bind", "", "Accept connections on this address only")
+	interfaces := flag.String("interfaces", "", "Comma-separated network interfaces to use")
+	metricsAddress := flag.String("metrics-address", "", "Serve Prometheus metrics on this address, e.g. "+metrics.DefaultAddress)
 
 	flag.Parse()
 
+	integration := platform.Current()
+
+	// Settings the running instance and the commands below agree on
+	if *configDir != "" {
+		config.SetDir(*configDir)
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Printf("Warning: Failed to load config: %v\n", err)
+	}
+	config.OverrideNetwork(config.NetworkSettings{
+		Port:           *port,
+		IPCPort:        *ipcPort,
+		BindAddress:    *bindAddress,
+		Interfaces:     config.SplitList(*interfaces),
+		MetricsAddress: *metricsAddress,
+	})
+	netSettings, err := cfg.EffectiveNetwork()
+	if err != nil {
+		fmt.Printf("Invalid network settings: %v\n", err)
+		os.Exit(1)
+	}
+	ipc.SetPort(netSettings.IPCPort)
+
 	// Handle context menu registration
 	if *registerMenu {
-		if err := contextmenu.Register(); err != nil {
+		if err := integration.RegisterContextMenu(); err != nil {
 			fmt.Printf("Failed to register context menu: %v\n", err)
 			os.Exit(1)
 		}
@@ -30,7 +72,7 @@ func main() {
 	}
 
 	if *unregisterMenu {
-		if err := contextmenu.Unregister(); err != nil {
+		if err := integration.UnregisterContextMenu(); err != nil {
 			fmt.Printf("Failed to unregister context menu: %v\n", err)
 			os.Exit(1)
 		}
@@ -38,6 +80,62 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Handle autostart
+	if *enableAutostart {
+		if err := integration.EnableAutostart(); err != nil {
+			fmt.Printf("Failed to enable autostart: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Autostart enabled!")
+		os.Exit(0)
+	}
+
+	if *disableAutostart {
+		if err := integration.DisableAutostart(); err != nil {
+			fmt.Printf("Failed to disable autostart: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Autostart disabled!")
+		os.Exit(0)
+	}
+
+	// Handle the offline queue of the running instance
+	if *listQueue {
+		if err := printQueue(); err != nil {
+			fmt.Printf("Failed to list queue: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *cancelQueued != "" {
+		req := ipc.QueueCancelRequest{ID: *cancelQueued}
+		if err := ipc.NewIPCClient().Query("queue_cancel", req, nil); err != nil {
+			fmt.Printf("Failed to cancel %s: %v\n", *cancelQueued, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Canceled %s\n", *cancelQueued)
+		os.Exit(0)
+	}
+
+	if *showStats {
+		if err := printStats(); err != nil {
+			fmt.Printf("Failed to get connection stats: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *connectTo != "" {
+		req := ipc.ConnectRequest{Address: *connectTo}
+		if err := ipc.NewIPCClient().Query("connect", req, nil); err != nil {
+			fmt.Printf("Failed to connect to %s: %v\n", *connectTo, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Connection request sent to %s\n", *connectTo)
+		os.Exit(0)
+	}
+
 	// Handle file sending from context menu
 	if *sendFiles != "" {
 		// Collect all file paths from arguments
@@ -52,24 +150,47 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Check if another instance is already running
-	if ipc.IsRunning() {
-		fmt.Println("Application is already running.")
-		os.Exit(1)
+	// Take the single-instance lock, or hand off to the instance holding it
+	lock, err := ipc.AcquireInstanceLock()
+	if errors.Is(err, ipc.ErrAlreadyRunning) {
+		fmt.Printf("%v - activating the running instance.\n", err)
+		if err := ipc.NewIPCClient().Activate(flag.Args()); err != nil {
+			fmt.Printf("Failed to reach the running instance: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Printf("Warning: Failed to acquire instance lock: %v\n", err)
 	}
+	defer lock.Release()
 
 	// Auto-register context menu on first run
-	if !contextmenu.IsRegistered() {
-		fmt.Println("First run detected - registering context menu...")
-		if err := contextmenu.Register(); err != nil {
+	if !integration.IsContextMenuRegistered() {
+		switch err := integration.RegisterContextMenu(); {
+		case errors.Is(err, errors.ErrUnsupported):
+			// No file manager integration on this platform
+		case err != nil:
 			fmt.Printf("Warning: Failed to register context menu: %v\n", err)
-		} else {
+		default:
 			fmt.Println("✓ Context menu registered!")
 		}
 	}
 
+	if netSettings.MetricsAddress != "" {
+		server, err := metrics.Serve(netSettings.MetricsAddress)
+		if err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		} else {
+			defer server.Close()
+		}
+	}
+
 	// Start normal GUI application
-	app.Run()
+	app.Run(cfg, network.ListenConfig{
+		Port:        netSettings.Port,
+		BindAddress: netSettings.BindAddress,
+		Interfaces:  netSettings.Interfaces,
+	})
 }
 
 // sendFilesToRunningApp sends files to already running application instance
@@ -91,3 +212,65 @@ func sendFilesToRunningApp(filePaths []string) error {
 
 	return client.SendFiles(validPaths)
 }
+
+// printQueue lists the offline queue of the running application
+func printQueue() error {
+	var items []network.QueuedItem
+	if err := ipc.NewIPCClient().Query("queue_list", nil, &items); err != nil {
+		return err
+	}
+
+	if len(items) == 0 {
+		fmt.Println("Nothing is waiting for offline devices.")
+		return nil
+	}
+	for _, item := range items {
+		fmt.Printf("%s  %-30s %10d bytes  for %s",
+			item.ID, item.Name, item.Size, strings.Join(item.Peers, ", "))
+		if !item.Expires.IsZero() {
+			fmt.Printf("  (expires %s)", item.Expires.Format(time.DateTime))
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+// printStats lists the connections of the running application
+func printStats() error {
+	var stats []network.ConnStats
+	if err := ipc.NewIPCClient().Query("stats", nil, &stats); err != nil {
+		return err
+	}
+
+	if len(stats) == 0 {
+		fmt.Println("Not connected to any device.")
+		return nil
+	}
+	fmt.Printf("%-26s %-16s %8s %10s %10s %11s %11s %12s %11s %6s\n",
+		"ADDRESS", "NAME", "RTT", "IN", "OUT", "RATE IN", "RATE OUT", "AVG IN/OUT", "MSGS IN/OUT", "ERRORS")
+	for _, s := range stats {
+		rtt := "-"
+		if s.RTT > 0 {
+			rtt = fmt.Sprintf("%.1fms", float64(s.RTT.Microseconds())/1000)
+		}
+		fmt.Printf("%-26s %-16s %8s %10s %10s %11s %11s %12s %11s %6d\n",
+			s.IP, s.Name, rtt,
+			formatBytes(float64(s.BytesIn)), formatBytes(float64(s.BytesOut)),
+			formatBytes(s.RateIn)+"/s", formatBytes(s.RateOut)+"/s",
+			formatBytes(s.AvgRateIn)+"/"+formatBytes(s.AvgRateOut),
+			fmt.Sprintf("%d/%d", s.MessagesIn, s.MessagesOut),
+			s.Errors)
+	}
+	return nil
+}
+
+func formatBytes(n float64) string {
+	switch {
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1fM", n/(1024*1024))
+	case n >= 1024:
+		return fmt.Sprintf("%.1fK", n/1024)
+	default:
+		return fmt.Sprintf("%.0fB", n)
+	}
+}